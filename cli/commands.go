@@ -5,9 +5,11 @@ package cli
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
 	"github.com/wsnipex/mirrorbits/core"
 	"github.com/wsnipex/mirrorbits/database"
 	"github.com/wsnipex/mirrorbits/filesystem"
@@ -81,6 +83,7 @@ func (c *cli) CmdHelp() error {
 		{"edit", "Edit a mirror"},
 		{"enable", "Enable a mirror"},
 		{"export", "Export the mirror database"},
+		{"history", "Show the state history of a mirror"},
 		{"list", "List all mirrors"},
 		{"refresh", "Refresh the local repository"},
 		{"reload", "Reload configuration"},
@@ -88,6 +91,7 @@ func (c *cli) CmdHelp() error {
 		{"scan", "(Re-)Scan a mirror"},
 		{"show", "Print a mirror configuration"},
 		{"stats", "Show download stats"},
+		{"token", "Manage the admin API tokens"},
 		{"upgrade", "Seamless binary upgrade"},
 		{"version", "Print version information"},
 	} {
@@ -196,7 +200,7 @@ func (c *cli) CmdList(args ...string) error {
 			}
 			fmt.Fprintf(w, "%s ", mirror.ID)
 			if *http == true {
-				fmt.Fprintf(w, "\t%s ", mirror.HttpURL)
+				fmt.Fprintf(w, "\t%s ", mirror.MainURL())
 			}
 			if *rsync == true {
 				fmt.Fprintf(w, "\t%s ", mirror.RsyncURL)
@@ -234,6 +238,7 @@ func (c *cli) CmdList(args ...string) error {
 func (c *cli) CmdAdd(args ...string) error {
 	cmd := SubCmd("add", "[OPTIONS] IDENTIFIER", "Add a new mirror")
 	http := cmd.String("http", "", "HTTP base URL")
+	https := cmd.String("https", "", "HTTPS base URL (when different from the HTTP one)")
 	rsync := cmd.String("rsync", "", "RSYNC base URL (for scanning only)")
 	ftp := cmd.String("ftp", "", "FTP base URL (for scanning only)")
 	sponsorName := cmd.String("sponsor-name", "", "Name of the sponsor")
@@ -241,11 +246,19 @@ func (c *cli) CmdAdd(args ...string) error {
 	sponsorLogo := cmd.String("sponsor-logo", "", "URL of a logo to display for this mirror")
 	adminName := cmd.String("admin-name", "", "Admin's name")
 	adminEmail := cmd.String("admin-email", "", "Admin's email")
+	noAdminEmails := cmd.Bool("no-admin-emails", false, "Never email the admin when the mirror is down")
 	customData := cmd.String("custom-data", "", "Associated data to return when the mirror is selected (i.e. json document)")
 	continentOnly := cmd.Bool("continent-only", false, "The mirror should only handle its continent")
 	countryOnly := cmd.Bool("country-only", false, "The mirror should only handle its country")
 	asOnly := cmd.Bool("as-only", false, "The mirror should only handle clients in the same AS number")
 	score := cmd.Int("score", 0, "Weight to give to the mirror during selection")
+	tier := cmd.Int("tier", 0, "Tier of the mirror (e.g. 1 for a push mirror used as a sync source)")
+	bandwidth := cmd.Int("bandwidth", 0, "Bandwidth available to the mirror (in Mbps)")
+	quota := cmd.Int64("quota", 0, "Monthly transfer quota of the mirror (in GB)")
+	checkMethod := cmd.String("check-method", "", "HTTP method used by the health checks (HEAD or GET)")
+	checkFiles := cmd.String("check-files", "", "Comma separated list of files to request during the health checks")
+	scanInterval := cmd.Int("scan-interval", 0, "Interval between the scans of the mirror (in minutes, 0 for the global ScanInterval)")
+	pushSync := cmd.Bool("push-sync", false, "Only scan the mirror when a rescan is requested (e.g. by the mirror after its sync)")
 	comment := cmd.String("comment", "", "Comment")
 
 	if err := cmd.Parse(args); err != nil {
@@ -261,16 +274,25 @@ func (c *cli) CmdAdd(args ...string) error {
 		os.Exit(-1)
 	}
 
-	if *http == "" {
-		fmt.Fprintf(os.Stderr, "You *must* pass at least an HTTP URL\n")
+	if *http == "" && *https == "" {
+		fmt.Fprintf(os.Stderr, "You *must* pass at least an HTTP or HTTPS URL\n")
 		os.Exit(-1)
 	}
 
-	if !strings.HasPrefix(*http, "http://") && !strings.HasPrefix(*http, "https://") {
+	if *http != "" && !strings.HasPrefix(*http, "http://") && !strings.HasPrefix(*http, "https://") {
 		*http = "http://" + *http
 	}
 
-	u, err := url.Parse(*http)
+	if *https != "" && !strings.HasPrefix(*https, "https://") {
+		*https = "https://" + strings.TrimPrefix(*https, "http://")
+	}
+
+	baseURL := *http
+	if baseURL == "" {
+		baseURL = *https
+	}
+
+	u, err := url.Parse(baseURL)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Can't parse HTTP url\n")
 		os.Exit(-1)
@@ -290,34 +312,6 @@ func (c *cli) CmdAdd(args ...string) error {
 
 	geoRec := geo.GetRecord(ip)
 
-	r := database.NewRedis()
-	conn, err := r.Connect()
-	if err != nil {
-		log.Fatal("Redis: ", err)
-	}
-	defer conn.Close()
-
-	key := fmt.Sprintf("MIRROR_%s", cmd.Arg(0))
-	exists, err := redis.Bool(conn.Do("EXISTS", key))
-	if err != nil {
-		return err
-	}
-	if exists {
-		fmt.Fprintf(os.Stderr, "Mirror %s already exists!\n", cmd.Arg(0))
-		os.Exit(-1)
-	}
-
-	// Normalize the URLs
-	if http != nil {
-		*http = utils.NormalizeURL(*http)
-	}
-	if rsync != nil {
-		*rsync = utils.NormalizeURL(*rsync)
-	}
-	if ftp != nil {
-		*ftp = utils.NormalizeURL(*ftp)
-	}
-
 	var latitude, longitude float32
 	var continentCode, countryCode string
 
@@ -330,47 +324,57 @@ func (c *cli) CmdAdd(args ...string) error {
 		fmt.Fprintf(os.Stderr, "Warning: unable to guess the geographic location of %s\n", cmd.Arg(0))
 	}
 
-	_, err = conn.Do("HMSET", key,
-		"ID", cmd.Arg(0),
-		"http", *http,
-		"rsync", *rsync,
-		"ftp", *ftp,
-		"sponsorName", *sponsorName,
-		"sponsorURL", *sponsorURL,
-		"sponsorLogo", *sponsorLogo,
-		"adminName", *adminName,
-		"adminEmail", *adminEmail,
-		"customData", *customData,
-		"continentOnly", *continentOnly,
-		"countryOnly", *countryOnly,
-		"asOnly", *asOnly,
-		"score", *score,
-		"latitude", fmt.Sprintf("%f", latitude),
-		"longitude", fmt.Sprintf("%f", longitude),
-		"continentCode", continentCode,
-		"countryCodes", countryCode,
-		"asnum", geoRec.ASNum,
-		"comment", strings.TrimSpace(*comment),
-		"enabled", false,
-		"up", false)
-	if err != nil {
-		goto oops
+	mirror := mirrors.Mirror{
+		ID:             cmd.Arg(0),
+		HttpURL:        *http,
+		HttpsURL:       *https,
+		RsyncURL:       *rsync,
+		FtpURL:         *ftp,
+		SponsorName:    *sponsorName,
+		SponsorURL:     *sponsorURL,
+		SponsorLogoURL: *sponsorLogo,
+		AdminName:      *adminName,
+		AdminEmail:     *adminEmail,
+		NoAdminEmails:  *noAdminEmails,
+		CustomData:     *customData,
+		ContinentOnly:  *continentOnly,
+		CountryOnly:    *countryOnly,
+		ASOnly:         *asOnly,
+		Score:          *score,
+		Tier:           *tier,
+		Bandwidth:      *bandwidth,
+		MonthlyQuota:   *quota,
+		CheckMethod:    *checkMethod,
+		CheckFiles:     *checkFiles,
+		ScanInterval:   *scanInterval,
+		PushSync:       *pushSync,
+		Latitude:       latitude,
+		Longitude:      longitude,
+		ContinentCode:  continentCode,
+		CountryCodes:   countryCode,
+		Asnum:          geoRec.ASNum,
+		Comment:        *comment,
+	}
+
+	// Normalize the URLs and the location codes
+	mirror.Normalize()
+
+	if err = mirror.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(-1)
 	}
 
-	_, err = conn.Do("LPUSH", "MIRRORS", cmd.Arg(0))
-	if err != nil {
-		goto oops
+	err = mirrors.AddMirror(database.NewRedis(), mirror)
+	if err == mirrors.ErrMirrorExists {
+		fmt.Fprintf(os.Stderr, "Mirror %s already exists!\n", cmd.Arg(0))
+		os.Exit(-1)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Oops: %s", err)
+		os.Exit(-1)
 	}
 
-	// Publish update
-	database.Publish(conn, database.MIRROR_UPDATE, cmd.Arg(0))
-
 	fmt.Println("Mirror added successfully")
 	return nil
-oops:
-	fmt.Fprintf(os.Stderr, "Oops: %s", err)
-	os.Exit(-1)
-	return nil
 }
 
 func (c *cli) CmdRemove(args ...string) error {
@@ -401,58 +405,11 @@ func (c *cli) CmdRemove(args ...string) error {
 
 	identifier := list[0]
 
-	r := database.NewRedis()
-	conn, err := r.Connect()
-	if err != nil {
-		log.Fatal("Redis: ", err)
-	}
-	defer conn.Close()
-
-	// First disable the mirror
-	mirrors.DisableMirror(r, identifier)
-
-	// Get all files supported by the given mirror
-	files, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("MIRROR_%s_FILES", identifier)))
-	if err != nil {
-		log.Fatal("Error: Cannot fetch file list: ", err)
-	}
-
-	conn.Send("MULTI")
-
-	// Remove each FILEINFO / FILEMIRRORS
-	for _, file := range files {
-		conn.Send("DEL", fmt.Sprintf("FILEINFO_%s_%s", identifier, file))
-		conn.Send("SREM", fmt.Sprintf("FILEMIRRORS_%s", file), identifier)
-		conn.Send("PUBLISH", database.MIRROR_FILE_UPDATE, fmt.Sprintf("%s %s", identifier, file))
-	}
-
-	_, err = conn.Do("EXEC")
-	if err != nil {
-		log.Fatal("Error: FILEINFO/FILEMIRRORS keys could not be removed: ", err)
-	}
-
-	// Remove all other keys
-	_, err = conn.Do("DEL",
-		fmt.Sprintf("MIRROR_%s", identifier),
-		fmt.Sprintf("MIRROR_%s_FILES", identifier),
-		fmt.Sprintf("MIRROR_%s_FILES_TMP", identifier),
-		fmt.Sprintf("HANDLEDFILES_%s", identifier),
-		fmt.Sprintf("SCANNING_%s", identifier))
-
-	if err != nil {
-		log.Fatal("Error: MIRROR keys could not be removed: ", err)
-	}
-
-	// Remove the last reference
-	_, err = conn.Do("LREM", "MIRRORS", 0, identifier)
-
+	err = mirrors.RemoveMirror(database.NewRedis(), identifier)
 	if err != nil {
-		log.Fatal("Error: Could not remove the reference from key MIRRORS")
+		log.Fatal("Error: ", err)
 	}
 
-	// Publish update
-	database.Publish(conn, database.MIRROR_UPDATE, identifier)
-
 	fmt.Println("Mirror removed successfully")
 	return nil
 }
@@ -463,10 +420,15 @@ func (c *cli) CmdScan(args ...string) error {
 	all := cmd.Bool("all", false, "Scan all mirrors at once")
 	ftp := cmd.Bool("ftp", false, "Force a scan using FTP")
 	rsync := cmd.Bool("rsync", false, "Force a scan using rsync")
+	http := cmd.Bool("http", false, "Force a scan using HTTP")
+	schedule := cmd.Bool("schedule", false, "Show when the mirrors will be scanned next instead of scanning them")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
+	if *schedule && cmd.NArg() <= 1 {
+		return c.printScanSchedule(cmd.Arg(0))
+	}
 	if !*all && cmd.NArg() != 1 || *all && cmd.NArg() != 0 {
 		cmd.Usage()
 		return nil
@@ -531,12 +493,14 @@ func (c *cli) CmdScan(args ...string) error {
 
 		err = NoSyncMethod
 
-		if *rsync == true || *ftp == true {
+		if *rsync == true || *ftp == true || *http == true {
 			// Use the requested protocol
 			if *rsync == true && mirror.RsyncURL != "" {
 				err = scan.Scan(scan.RSYNC, r, mirror.RsyncURL, id, nil)
 			} else if *ftp == true && mirror.FtpURL != "" {
 				err = scan.Scan(scan.FTP, r, mirror.FtpURL, id, nil)
+			} else if *http == true && mirror.MainURL() != "" {
+				err = scan.Scan(scan.HTTP, r, mirror.MainURL(), id, nil)
 			}
 		} else {
 			// Use rsync (if applicable) and fallback to FTP
@@ -546,6 +510,10 @@ func (c *cli) CmdScan(args ...string) error {
 			if err != nil && mirror.FtpURL != "" {
 				err = scan.Scan(scan.FTP, r, mirror.FtpURL, id, nil)
 			}
+			// Only crawl over HTTP when there's nothing else
+			if mirror.RsyncURL == "" && mirror.FtpURL == "" && mirror.MainURL() != "" {
+				err = scan.Scan(scan.HTTP, r, mirror.MainURL(), id, nil)
+			}
 		}
 
 		if err != nil {
@@ -563,6 +531,85 @@ func (c *cli) CmdScan(args ...string) error {
 	return nil
 }
 
+// printScanSchedule prints the time of the next scan of the
+// mirrors matching the given text, or of all of them
+func (c *cli) printScanSchedule(text string) error {
+	r := database.NewRedis()
+	conn, err := r.Connect()
+	if err != nil {
+		log.Fatal("Redis: ", err)
+	}
+	defer conn.Close()
+
+	var ids []string
+	if text == "" {
+		ids, err = redis.Strings(conn.Do("LRANGE", "MIRRORS", "0", "-1"))
+		if err != nil {
+			return errors.New("Cannot fetch the list of mirrors")
+		}
+	} else {
+		ids, err = c.matchMirror(text)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			fmt.Fprintf(os.Stderr, "No match for %s\n", text)
+			return nil
+		}
+	}
+
+	conn.Send("MULTI")
+	for _, id := range ids {
+		conn.Send("HGETALL", fmt.Sprintf("MIRROR_%s", id))
+	}
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		log.Fatal("Redis: ", err)
+	}
+
+	var list mirrors.Mirrors
+	for _, e := range res {
+		var mirror mirrors.Mirror
+		if err := redis.ScanStruct(e.([]interface{}), &mirror); err != nil {
+			log.Fatal("ScanStruct:", err)
+		}
+		list = append(list, mirror)
+	}
+
+	interval, backoff := GetConfig().ScanInterval, GetConfig().MaxScanBackoff
+	sort.Stable(mirrors.ByNextScan{Mirrors: list, DefaultInterval: interval, MaxBackoff: backoff})
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprint(w, "Identifier \tINTERVAL \tFAILURES \tLAST SCAN \tNEXT SCAN\n")
+
+	now := time.Now()
+	for _, m := range list {
+		last := "never"
+		if m.LastSync > 0 {
+			last = time.Unix(m.LastSync, 0).Format("2006-01-02 15:04")
+		}
+
+		next := m.NextScan(interval, backoff)
+		var when string
+		switch {
+		case !m.Enabled:
+			when = "disabled"
+		case m.PushSync:
+			when = "on request (push)"
+		case !next.After(now):
+			when = "due"
+		default:
+			when = fmt.Sprintf("%s (in %s)", next.Format("2006-01-02 15:04"), next.Sub(now).Truncate(time.Minute))
+		}
+
+		fmt.Fprintf(w, "%s \t%d min \t%d \t%s \t%s\n", m.ID, m.ScanDelay(interval, backoff)/time.Minute, m.ScanFailures, last, when)
+	}
+	w.Flush()
+
+	return nil
+}
+
 func (c *cli) CmdRefresh(args ...string) error {
 	cmd := SubCmd("refresh", "", "Scan the local repository")
 
@@ -664,6 +711,7 @@ func (c *cli) CmdEdit(args ...string) error {
 	if err != nil {
 		return err
 	}
+	enabled := mirror.Enabled
 
 	// Generate a yaml configuration string from the struct
 	out, err := yaml.Marshal(mirror)
@@ -721,6 +769,11 @@ reopen:
 
 	// Fill the struct from the yaml
 	err = yaml.Unmarshal([]byte(yamlstr), &mirror)
+	if err == nil {
+		// Reformat the country codes, continent code and URLs
+		mirror.Normalize()
+		err = mirror.Validate()
+	}
 	if err != nil {
 	eagain:
 		fmt.Printf("%s\nRetry? [Y/n]", err.Error())
@@ -737,62 +790,21 @@ reopen:
 		}
 	}
 
-	// Reformat contry codes
-	mirror.CountryCodes = strings.Replace(mirror.CountryCodes, ",", " ", -1)
-	ccodes := strings.Fields(mirror.CountryCodes)
-	mirror.CountryCodes = ""
-	for _, c := range ccodes {
-		mirror.CountryCodes += strings.ToUpper(c) + " "
-	}
-	mirror.CountryCodes = strings.TrimRight(mirror.CountryCodes, " ")
-
-	// Reformat continent code
-	//FIXME sanitize
-	mirror.ContinentCode = strings.ToUpper(mirror.ContinentCode)
-
-	// Normalize URLs
-	if mirror.HttpURL != "" {
-		mirror.HttpURL = utils.NormalizeURL(mirror.HttpURL)
-	}
-	if mirror.RsyncURL != "" {
-		mirror.RsyncURL = utils.NormalizeURL(mirror.RsyncURL)
-	}
-	if mirror.FtpURL != "" {
-		mirror.FtpURL = utils.NormalizeURL(mirror.FtpURL)
-	}
-
+	mirror.ID = id
 	mirror.Comment = comment
 
 	// Save the values back into redis
-	_, err = conn.Do("HMSET", key,
-		"ID", id,
-		"http", mirror.HttpURL,
-		"rsync", mirror.RsyncURL,
-		"ftp", mirror.FtpURL,
-		"sponsorName", mirror.SponsorName,
-		"sponsorURL", mirror.SponsorURL,
-		"sponsorLogo", mirror.SponsorLogoURL,
-		"adminName", mirror.AdminName,
-		"adminEmail", mirror.AdminEmail,
-		"customData", mirror.CustomData,
-		"continentOnly", mirror.ContinentOnly,
-		"countryOnly", mirror.CountryOnly,
-		"asOnly", mirror.ASOnly,
-		"score", mirror.Score,
-		"latitude", mirror.Latitude,
-		"longitude", mirror.Longitude,
-		"continentCode", mirror.ContinentCode,
-		"countryCodes", mirror.CountryCodes,
-		"asnum", mirror.Asnum,
-		"comment", mirror.Comment,
-		"enabled", mirror.Enabled)
-
+	err = mirrors.UpdateMirror(r, mirror)
 	if err != nil {
 		log.Fatal("Couldn't save the configuration into redis:", err)
 	}
 
-	// Publish update
-	database.Publish(conn, database.MIRROR_UPDATE, id)
+	if mirror.Enabled != enabled {
+		err = mirrors.SetMirrorEnabled(r, id, mirror.Enabled)
+		if err != nil {
+			log.Fatal("Couldn't change the state of the mirror:", err)
+		}
+	}
 
 	fmt.Println("Mirror edited successfully")
 
@@ -927,6 +939,9 @@ func (c *cli) CmdExport(args ...string) error {
 			if *http == true && mirror.HttpURL != "" {
 				urls = append(urls, mirror.HttpURL)
 			}
+			if *http == true && mirror.HttpsURL != "" {
+				urls = append(urls, mirror.HttpsURL)
+			}
 			if *ftp == true && mirror.FtpURL != "" {
 				urls = append(urls, mirror.FtpURL)
 			}
@@ -1199,6 +1214,165 @@ func (c *cli) CmdStats(args ...string) error {
 	return nil
 }
 
+func (c *cli) CmdHistory(args ...string) error {
+	cmd := SubCmd("history", "[OPTIONS] IDENTIFIER", "Show the state transitions, the uptime and the latency of a mirror")
+	days := cmd.Int("days", 30, "Number of days to report")
+	jsonOutput := cmd.Bool("json", false, "Print the history in JSON")
+
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 || *days <= 0 {
+		cmd.Usage()
+		return nil
+	}
+
+	// Guess which mirror to use
+	list, err := c.matchMirror(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Fprintf(os.Stderr, "No match for %s\n", cmd.Arg(0))
+		return nil
+	} else if len(list) > 1 {
+		for _, e := range list {
+			fmt.Fprintf(os.Stderr, "%s\n", e)
+		}
+		return nil
+	}
+
+	id := list[0]
+
+	// Connect to the database
+	r := database.NewRedis()
+	conn, err := r.Connect()
+	if err != nil {
+		log.Fatal("Redis: ", err)
+	}
+	defer conn.Close()
+
+	// Get the current state of the mirror
+	m, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("MIRROR_%s", id)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot fetch mirror details: %s\n", err)
+		return err
+	}
+
+	var mirror mirrors.Mirror
+	err = redis.ScanStruct(m, &mirror)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	since := now.AddDate(0, 0, -*days)
+
+	history, err := mirrors.GetHistory(r, id, since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot fetch the history: %s\n", err)
+		return err
+	}
+
+	if *jsonOutput {
+		out, err := json.MarshalIndent(mirrors.NewHistoryReport(history, since, now, mirror.Up), "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+
+	fmt.Fprintf(w, "Identifier:\t%s\n", id)
+	fmt.Fprintf(w, "Period:\t%s - %s\n", since.Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04"))
+	fmt.Fprintf(w, "Uptime:\t%.3f%%\n", history.Uptime(since, now, mirror.Up))
+	if latency := history.AverageLatency(); latency > 0 {
+		fmt.Fprintf(w, "Average latency:\t%dms (%d samples)\n", latency, len(history.Latencies))
+	}
+	w.Flush()
+
+	fmt.Println("\nTransitions:")
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	for i := len(history.States) - 1; i >= 0; i-- {
+		change := history.States[i]
+		if change.Time < since.Unix() {
+			continue
+		}
+		state := "down"
+		if change.Up {
+			state = "up"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", time.Unix(change.Time, 0).Format("2006-01-02 15:04:05"), state, change.Reason)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func (c *cli) CmdToken(args ...string) error {
+	cmd := SubCmd("token", "[add|remove|list] [NAME]", "Manage the tokens granting access to the admin API")
+
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	r := database.NewRedis()
+
+	switch cmd.Arg(0) {
+	case "add":
+		if cmd.NArg() != 2 {
+			cmd.Usage()
+			return nil
+		}
+		token, err := database.AddAPIToken(r, cmd.Arg(1))
+		if err == database.ErrTokenExists {
+			fmt.Fprintf(os.Stderr, "Token %s already exists!\n", cmd.Arg(1))
+			os.Exit(-1)
+		} else if err != nil {
+			log.Fatal("Couldn't add the token: ", err)
+		}
+		fmt.Println("Token added successfully, keep it safe as it won't be displayed again:")
+		fmt.Println(token)
+	case "remove":
+		if cmd.NArg() != 2 {
+			cmd.Usage()
+			return nil
+		}
+		err := database.RemoveAPIToken(r, cmd.Arg(1))
+		if err == database.ErrTokenNotFound {
+			fmt.Fprintf(os.Stderr, "No match for %s\n", cmd.Arg(1))
+			return nil
+		} else if err != nil {
+			log.Fatal("Couldn't remove the token: ", err)
+		}
+		fmt.Println("Token removed successfully")
+	case "list":
+		tokens, err := database.ListAPITokens(r)
+		if err != nil {
+			log.Fatal("Cannot fetch the list of tokens: ", err)
+		}
+		names := make([]string, 0, len(tokens))
+		for _, name := range tokens {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	default:
+		cmd.Usage()
+	}
+
+	return nil
+}
+
 func (c *cli) CmdReload(args ...string) error {
 	pid := process.GetRemoteProcPid()
 	if pid > 0 {
@@ -9,6 +9,7 @@ import (
 	"github.com/wsnipex/mirrorbits/core"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -22,6 +23,10 @@ var (
 		Templates:              "",
 		OutputMode:             "auto",
 		ListenAddress:          ":8080",
+		AdminListenAddress:     "",
+		TLSListenAddress:       ":8443",
+		TLSCertificate:         "",
+		TLSKey:                 "",
 		Gzip:                   false,
 		RedisAddress:           "127.0.0.1:6379",
 		RedisPassword:          "",
@@ -33,17 +38,60 @@ var (
 		DownloadStatsPath:      "",
 		ConcurrentSync:         2,
 		ScanInterval:           30,
+		MaxScanBackoff:         720,
 		CheckInterval:          1,
 		RepositoryScanInterval: 5,
+		RepositoryWatch:        false,
 		MaxLinkHeaders:         10,
 		Hashes: hashing{
-			SHA1:   true,
-			SHA256: false,
-			MD5:    false,
+			SHA1:    true,
+			SHA256:  false,
+			SHA512:  false,
+			BLAKE2b: false,
+			MD5:     false,
+			Workers: 2,
+			MaxRate: 0,
 		},
+		ChecksumSigningKey:      "",
+		ChecksumKeyPassphrase:   "",
 		DisallowRedirects:       false,
 		WeightDistributionRange: 1.5,
+		LatencyWeight:           0,
+		SelectionEngine:         "default",
+		ExcludedTiers:           []int{},
 		DisableOnMissingFile:    false,
+		HTTPScanFileLists:       []string{},
+		TraceFile:               "",
+		MaxTraceLag:             24,
+		WebhookDebounce:         60,
+		WebhookRetries:          5,
+		HealthCheck: checkconf{
+			Method:        "HEAD",
+			Files:         []string{},
+			FilesPerCheck: 1,
+			CheckSize:     false,
+			Timeout:       20,
+			Deadline:      40,
+			Workers:       10,
+
+			FailuresBeforeDown: 1,
+			SuccessesBeforeUp:  1,
+			MaxFlaps:           0,
+			FlapWindow:         60,
+			QuarantineDuration: 60,
+		},
+		AdminNotifications: adminmail{
+			Threshold:      120,
+			ResendInterval: 24,
+		},
+		Feedback: feedback{
+			Threshold:      0,
+			Window:         10,
+			MinSpeed:       0,
+			Penalty:        30,
+			MaxReports:     10,
+			TrustedProxies: []string{},
+		},
 		UserAgentStatsConf: uaconf{
 			LogUnknown:           false,
 			CountOnlySpecialPath: false,
@@ -58,6 +106,12 @@ var (
 
 	subscribers     []chan bool
 	subscribersLock sync.RWMutex
+
+	// RequestTypes are the names of the request types accepted in
+	// ListenAddresses, in the order of the RequestType constants of the
+	// http package
+	RequestTypes = []string{"standard", "mirrorlist", "stats", "mirrorstats", "downloadstats",
+		"useragentstats", "checksum", "feedback", "metrics"}
 )
 
 type configuration struct {
@@ -65,6 +119,11 @@ type configuration struct {
 	Templates               string     `yaml:"Templates"`
 	OutputMode              string     `yaml:"OutputMode"`
 	ListenAddress           string     `yaml:"ListenAddress"`
+	AdminListenAddress      string     `yaml:"AdminListenAddress"`
+	TLSListenAddress        string     `yaml:"TLSListenAddress"`
+	TLSCertificate          string     `yaml:"TLSCertificate"`
+	TLSKey                  string     `yaml:"TLSKey"`
+	ListenAddresses         []listener `yaml:"ListenAddresses"`
 	Gzip                    bool       `yaml:"Gzip"`
 	RedisAddress            string     `yaml:"RedisAddress"`
 	RedisPassword           string     `yaml:"RedisPassword"`
@@ -75,13 +134,29 @@ type configuration struct {
 	GeoipDatabasePath       string     `yaml:"GeoipDatabasePath"`
 	ConcurrentSync          int        `yaml:"ConcurrentSync"`
 	ScanInterval            int        `yaml:"ScanInterval"`
+	MaxScanBackoff          int        `yaml:"MaxScanBackoff"`
 	CheckInterval           int        `yaml:"CheckInterval"`
 	RepositoryScanInterval  int        `yaml:"RepositoryScanInterval"`
+	RepositoryWatch         bool       `yaml:"RepositoryWatch"`
 	MaxLinkHeaders          int        `yaml:"MaxLinkHeaders"`
 	Hashes                  hashing    `yaml:"Hashes"`
+	ChecksumSigningKey      string     `yaml:"ChecksumSigningKey"`
+	ChecksumKeyPassphrase   string     `yaml:"ChecksumKeyPassphrase"`
 	DisallowRedirects       bool       `yaml:"DisallowRedirects"`
 	WeightDistributionRange float32    `yaml:"WeightDistributionRange"`
+	LatencyWeight           float32    `yaml:"LatencyWeight"`
+	SelectionEngine         string     `yaml:"SelectionEngine"`
+	ExcludedTiers           []int      `yaml:"ExcludedTiers"`
 	DisableOnMissingFile    bool       `yaml:"DisableOnMissingFile"`
+	HTTPScanFileLists       []string   `yaml:"HTTPScanFileLists"`
+	HealthCheck             checkconf  `yaml:"HealthCheck"`
+	TraceFile               string     `yaml:"TraceFile"`
+	MaxTraceLag             int        `yaml:"MaxTraceLag"`
+	Webhooks                []webhook  `yaml:"Webhooks"`
+	WebhookDebounce         int        `yaml:"WebhookDebounce"`
+	WebhookRetries          int        `yaml:"WebhookRetries"`
+	AdminNotifications      adminmail  `yaml:"AdminNotifications"`
+	Feedback                feedback   `yaml:"Feedback"`
 	Fallbacks               []fallback `yaml:"Fallbacks"`
 	DownloadStatsPath       string     `yaml:"DownloadStatsPath"`
 	UserAgentStatsConf      uaconf     `yaml:"UserAgentStatsConf"`
@@ -96,14 +171,63 @@ type fallback struct {
 	ContinentCode string `yaml:"ContinentCode"`
 }
 
+type checkconf struct {
+	Method        string   `yaml:"Method"`
+	Files         []string `yaml:"Files"`
+	FilesPerCheck int      `yaml:"FilesPerCheck"`
+	CheckSize     bool     `yaml:"CheckSize"`
+	Timeout       int      `yaml:"Timeout"`
+	Deadline      int      `yaml:"Deadline"`
+	Workers       int      `yaml:"Workers"`
+
+	FailuresBeforeDown int `yaml:"FailuresBeforeDown"`
+	SuccessesBeforeUp  int `yaml:"SuccessesBeforeUp"`
+	MaxFlaps           int `yaml:"MaxFlaps"`
+	FlapWindow         int `yaml:"FlapWindow"`
+	QuarantineDuration int `yaml:"QuarantineDuration"`
+}
+
+type webhook struct {
+	URL    string   `yaml:"URL"`
+	Events []string `yaml:"Events"`
+}
+
+type adminmail struct {
+	SMTPServer     string `yaml:"SMTPServer"`
+	SMTPUsername   string `yaml:"SMTPUsername"`
+	SMTPPassword   string `yaml:"SMTPPassword"`
+	From           string `yaml:"From"`
+	Threshold      int    `yaml:"Threshold"`
+	ResendInterval int    `yaml:"ResendInterval"`
+}
+
+type feedback struct {
+	Threshold      int      `yaml:"Threshold"`
+	Window         int      `yaml:"Window"`
+	MinSpeed       int      `yaml:"MinSpeed"`
+	Penalty        int      `yaml:"Penalty"`
+	MaxReports     int      `yaml:"MaxReports"`
+	TrustedProxies []string `yaml:"TrustedProxies"`
+}
+
+type listener struct {
+	Address      string   `yaml:"Address"`
+	TLS          bool     `yaml:"TLS"`
+	RequestTypes []string `yaml:"RequestTypes"`
+}
+
 type sentinels struct {
 	Host string `yaml:"Host"`
 }
 
 type hashing struct {
-	SHA1   bool `yaml:"SHA1"`
-	SHA256 bool `yaml:"SHA256"`
-	MD5    bool `yaml:"MD5"`
+	SHA1    bool `yaml:"SHA1"`
+	SHA256  bool `yaml:"SHA256"`
+	SHA512  bool `yaml:"SHA512"`
+	BLAKE2b bool `yaml:"BLAKE2b"`
+	MD5     bool `yaml:"MD5"`
+	Workers int  `yaml:"Workers"`
+	MaxRate int  `yaml:"MaxRate"`
 }
 
 type uaconf struct {
@@ -158,6 +282,23 @@ func ReloadConfig() error {
 	if c.WeightDistributionRange <= 0 {
 		return fmt.Errorf("WeightDistributionRange must be > 0")
 	}
+	if c.Feedback.Threshold < 0 || c.Feedback.Window <= 0 {
+		return fmt.Errorf("Config: Feedback Threshold must be >= 0 and Window > 0")
+	}
+	if c.Feedback.MaxReports < 0 {
+		c.Feedback.MaxReports = 0
+	}
+	for _, p := range c.Feedback.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return fmt.Errorf("Config: invalid Feedback TrustedProxies entry '%s'", p)
+		}
+	}
+	if c.Hashes.Workers < 1 {
+		c.Hashes.Workers = 1
+	}
+	if c.LatencyWeight < 0 {
+		return fmt.Errorf("LatencyWeight must be >= 0")
+	}
 	if !isInSlice(c.OutputMode, []string{"auto", "json", "redirect"}) {
 		return fmt.Errorf("Config: outputMode can only be set to 'auto', 'json' or 'redirect'")
 	}
@@ -165,6 +306,48 @@ func ReloadConfig() error {
 	if c.RepositoryScanInterval < 0 {
 		c.RepositoryScanInterval = 0
 	}
+	if c.MaxScanBackoff < 0 {
+		c.MaxScanBackoff = 0
+	}
+	c.HealthCheck.Method = strings.ToUpper(c.HealthCheck.Method)
+	if !isInSlice(c.HealthCheck.Method, []string{"HEAD", "GET"}) {
+		return fmt.Errorf("Config: HealthCheck.Method can only be set to 'HEAD' or 'GET'")
+	}
+	if c.HealthCheck.FilesPerCheck < 1 {
+		c.HealthCheck.FilesPerCheck = 1
+	}
+	if c.HealthCheck.Workers < 1 {
+		c.HealthCheck.Workers = 1
+	}
+	if c.HealthCheck.FailuresBeforeDown < 1 {
+		c.HealthCheck.FailuresBeforeDown = 1
+	}
+	if c.HealthCheck.SuccessesBeforeUp < 1 {
+		c.HealthCheck.SuccessesBeforeUp = 1
+	}
+	if c.HealthCheck.Timeout <= 0 || c.HealthCheck.Deadline < c.HealthCheck.Timeout {
+		return fmt.Errorf("Config: HealthCheck.Timeout must be > 0 and lower than HealthCheck.Deadline")
+	}
+	if c.TraceFile != "" && !strings.HasPrefix(c.TraceFile, "/") {
+		c.TraceFile = "/" + c.TraceFile
+	}
+	if c.WebhookDebounce < 0 {
+		c.WebhookDebounce = 0
+	}
+	for _, l := range c.ListenAddresses {
+		for _, t := range l.RequestTypes {
+			if !isInSlice(strings.ToLower(t), RequestTypes) {
+				return fmt.Errorf("Config: unknown request type '%s' for %s", t, l.Address)
+			}
+		}
+	}
+	for _, w := range c.Webhooks {
+		for _, e := range w.Events {
+			if !isInSlice(e, []string{"up", "down", "disabled", "syncfailed"}) {
+				return fmt.Errorf("Config: unknown webhook event '%s'", e)
+			}
+		}
+	}
 
 	if config != nil &&
 		(c.RedisAddress != config.RedisAddress ||
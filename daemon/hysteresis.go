@@ -0,0 +1,104 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package daemon
+
+import (
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/metrics"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/wsnipex/mirrorbits/utils"
+	"time"
+)
+
+var (
+	mirrorFlaps = metrics.NewGauge("mirrorbits_mirror_flaps",
+		"Number of state changes of the mirror within the flap window", "mirror")
+	mirrorQuarantined = metrics.NewGauge("mirrorbits_mirror_quarantined",
+		"Whether the mirror is quarantined (1) for changing state too often", "mirror")
+)
+
+// confirmState records the result of a health check and returns true
+// if the mirror should be marked in the given state. A change of state
+// only happens after FailuresBeforeDown consecutive failures or
+// SuccessesBeforeUp consecutive successes. A mirror changing state
+// more than MaxFlaps times within FlapWindow is kept down for
+// QuarantineDuration.
+func (m *Monitor) confirmState(mirror mirrors.Mirror, up bool) bool {
+	confirmed, quarantineUntil := m.recordCheck(mirror, up)
+	if quarantineUntil > 0 {
+		mirrors.MarkMirrorDown(m.redis, mirror.ID, fmt.Sprintf("Flapping (quarantined until %s)",
+			time.Unix(quarantineUntil, 0).Format("15:04")))
+	}
+	return confirmed
+}
+
+// recordCheck updates the counters of the mirror and returns true if the
+// state is confirmed. The end of the quarantine is returned the first time
+// the mirror is kept down because of it.
+func (m *Monitor) recordCheck(mirror mirrors.Mirror, up bool) (bool, int64) {
+	conf := GetConfig().HealthCheck
+	now := time.Now().Unix()
+
+	m.mapLock.Lock()
+	defer m.mapLock.Unlock()
+
+	mm, ok := m.mirrors[mirror.ID]
+	if !ok {
+		return true, 0
+	}
+
+	if up {
+		mm.successes++
+		mm.failures = 0
+	} else {
+		mm.failures++
+		mm.successes = 0
+	}
+
+	// Forget about the state changes outside of the window
+	window := now - int64(conf.FlapWindow*60)
+	for len(mm.stateChanges) > 0 && mm.stateChanges[0] < window {
+		mm.stateChanges = mm.stateChanges[1:]
+	}
+	mirrorFlaps.Set(float64(len(mm.stateChanges)), mirror.ID)
+
+	quarantined := mm.quarantineUntil > now
+	mirrorQuarantined.Set(utils.BoolToFloat(quarantined), mirror.ID)
+
+	if mirror.Up == up {
+		// No change of state
+		return true, 0
+	}
+
+	if up {
+		if quarantined {
+			if mm.quarantineSaved {
+				return false, 0
+			}
+			mm.quarantineSaved = true
+			return false, mm.quarantineUntil
+		}
+		if mm.successes < conf.SuccessesBeforeUp {
+			log.Infof("%s: success %d/%d before being up", mirror.ID, mm.successes, conf.SuccessesBeforeUp)
+			return false, 0
+		}
+	} else if mm.failures < conf.FailuresBeforeDown {
+		log.Infof("%s: failure %d/%d before being down", mirror.ID, mm.failures, conf.FailuresBeforeDown)
+		return false, 0
+	}
+
+	mm.stateChanges = append(mm.stateChanges, now)
+	mirrorFlaps.Set(float64(len(mm.stateChanges)), mirror.ID)
+
+	if conf.MaxFlaps > 0 && len(mm.stateChanges) > conf.MaxFlaps && !up {
+		mm.quarantineUntil = now + int64(conf.QuarantineDuration*60)
+		mm.quarantineSaved = false
+		mm.stateChanges = nil
+		mirrorQuarantined.Set(1, mirror.ID)
+		log.Warningf("%s: changed state too often, quarantined for %d minutes", mirror.ID, conf.QuarantineDuration)
+	}
+
+	return true, 0
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package daemon
+
+import (
+	"github.com/wsnipex/mirrorbits/mirrors"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+func loadHysteresisConfig(t *testing.T) {
+	err := LoadTestConfig(`HealthCheck:
+    FailuresBeforeDown: 2
+    SuccessesBeforeUp: 2
+    MaxFlaps: 2
+    FlapWindow: 60
+    QuarantineDuration: 30
+`)
+	if err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err)
+	}
+}
+
+func TestMonitor_recordCheck(t *testing.T) {
+	loadHysteresisConfig(t)
+
+	m := &Monitor{
+		mirrors: make(map[string]*Mirror),
+	}
+	mirror := mirrors.Mirror{ID: "m1", Up: true}
+
+	// Unknown mirrors are not delayed
+	if confirmed, _ := m.recordCheck(mirror, false); !confirmed {
+		t.Fatalf("Expected the state of an unknown mirror to be confirmed")
+	}
+
+	m.mirrors["m1"] = &Mirror{Mirror: mirror}
+	mm := m.mirrors["m1"]
+
+	check := func(up, expected bool) {
+		t.Helper()
+		confirmed, quarantineUntil := m.recordCheck(mirror, up)
+		if confirmed != expected {
+			t.Fatalf("Expected confirmed to be %t, got %t", expected, confirmed)
+		}
+		if quarantineUntil != 0 {
+			t.Fatalf("Unexpected quarantine until %d", quarantineUntil)
+		}
+	}
+
+	// No change of state
+	check(true, true)
+
+	// Down after two consecutive failures
+	check(false, false)
+	check(true, true)
+	check(false, false)
+	check(false, true)
+	mirror.Up = false
+
+	if len(mm.stateChanges) != 1 {
+		t.Fatalf("Expected 1 state change, got %d", len(mm.stateChanges))
+	}
+
+	// Up after two consecutive successes
+	check(true, false)
+	check(true, true)
+	mirror.Up = true
+
+	// The state changes outside of the window are forgotten
+	mm.stateChanges[0] = time.Now().Add(-2 * time.Hour).Unix()
+	check(true, true)
+	if len(mm.stateChanges) != 1 {
+		t.Fatalf("Expected 1 state change, got %d", len(mm.stateChanges))
+	}
+}
+
+func TestMonitor_recordCheckQuarantine(t *testing.T) {
+	loadHysteresisConfig(t)
+
+	mirror := mirrors.Mirror{ID: "m1", Up: true}
+	m := &Monitor{
+		mirrors: map[string]*Mirror{
+			"m1": {Mirror: mirror},
+		},
+	}
+	mm := m.mirrors["m1"]
+
+	now := time.Now().Unix()
+	mm.stateChanges = []int64{now - 60, now - 30}
+
+	// The third state change within the window triggers the quarantine
+	m.recordCheck(mirror, false)
+	if confirmed, _ := m.recordCheck(mirror, false); !confirmed {
+		t.Fatalf("Expected the mirror to go down")
+	}
+	mirror.Up = false
+
+	if mm.quarantineUntil < now+29*60 {
+		t.Fatalf("Expected the mirror to be quarantined for 30 minutes")
+	}
+	if len(mm.stateChanges) != 0 {
+		t.Fatalf("Expected the state changes to be reset")
+	}
+
+	// Kept down while quarantined, the end of the quarantine
+	// is only returned the first time
+	confirmed, quarantineUntil := m.recordCheck(mirror, true)
+	if confirmed || quarantineUntil != mm.quarantineUntil {
+		t.Fatalf("Expected the mirror to be kept down until %d, got %t %d", mm.quarantineUntil, confirmed, quarantineUntil)
+	}
+	confirmed, quarantineUntil = m.recordCheck(mirror, true)
+	if confirmed || quarantineUntil != 0 {
+		t.Fatalf("Expected the mirror to be kept down silently, got %t %d", confirmed, quarantineUntil)
+	}
+
+	// Back up once the quarantine is over
+	mm.quarantineUntil = now - 1
+	if confirmed, _ := m.recordCheck(mirror, true); !confirmed {
+		t.Fatalf("Expected the mirror to go up after the quarantine")
+	}
+}
+
+func TestMonitor_confirmState(t *testing.T) {
+	loadHysteresisConfig(t)
+
+	mock, conn := PrepareRedisTest()
+
+	mirror := mirrors.Mirror{ID: "m1", Up: false}
+	m := &Monitor{
+		redis: conn,
+		mirrors: map[string]*Mirror{
+			"m1": {Mirror: mirror, quarantineUntil: time.Now().Add(10 * time.Minute).Unix()},
+		},
+	}
+
+	mock.Command("HGET", "MIRROR_m1", "up").Expect(int64(0))
+	cmd := mock.Command("HMSET", "MIRROR_m1", "up", false, "excludeReason", redigomock.NewAnyData()).Expect("ok")
+
+	for i := 0; i < 3; i++ {
+		if m.confirmState(mirror, true) {
+			t.Fatalf("Expected the quarantined mirror to be kept down")
+		}
+	}
+
+	// The reason is only saved once
+	if mock.Stats(cmd) != 1 {
+		t.Fatalf("Expected the reason to be saved once, got %d", mock.Stats(cmd))
+	}
+}
@@ -4,20 +4,26 @@
 package daemon
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/wsnipex/mirrorbits/cli"
 	. "github.com/wsnipex/mirrorbits/config"
 	"github.com/wsnipex/mirrorbits/core"
 	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/mailer"
+	"github.com/wsnipex/mirrorbits/metrics"
 	"github.com/wsnipex/mirrorbits/mirrors"
 	"github.com/wsnipex/mirrorbits/scan"
 	"github.com/wsnipex/mirrorbits/utils"
+	"github.com/wsnipex/mirrorbits/webhooks"
 	"github.com/garyburd/redigo/redis"
 	"github.com/op/go-logging"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,12 +31,12 @@ import (
 )
 
 var (
-	healthCheckThreads = 10
-	userAgent          = "Mirrorbits/" + core.VERSION + " PING CHECK"
-	clientTimeout      = time.Duration(20 * time.Second)
-	clientDeadline     = time.Duration(40 * time.Second)
-	redirectError      = errors.New("Redirect not allowed")
-	mirrorNotScanned   = errors.New("Mirror has not yet been scanned")
+	userAgent        = "Mirrorbits/" + core.VERSION + " PING CHECK"
+	redirectError    = errors.New("Redirect not allowed")
+	mirrorNotScanned = errors.New("Mirror has not yet been scanned")
+
+	healthCheckLatency = metrics.NewGauge("mirrorbits_healthcheck_latency_seconds",
+		"Response time of the last health check of a mirror", "mirror")
 
 	log = logging.MustGetLogger("main")
 )
@@ -46,6 +52,8 @@ type Monitor struct {
 	syncChan        chan string
 	stop            chan bool
 	configNotifier  chan bool
+	notifier        *webhooks.Notifier
+	mailer          *mailer.Mailer
 	wg              sync.WaitGroup
 	formatLongestID int
 
@@ -54,9 +62,17 @@ type Monitor struct {
 
 type Mirror struct {
 	mirrors.Mirror
-	checking  bool
-	scanning  bool
-	lastCheck int64
+	checking      bool
+	scanning      bool
+	scanRequested bool
+	lastCheck     int64
+
+	// Health check hysteresis
+	failures        int
+	successes       int
+	stateChanges    []int64
+	quarantineUntil int64
+	quarantineSaved bool // The reason of the quarantine is stored
 }
 
 func (m *Mirror) NeedHealthCheck() bool {
@@ -64,7 +80,15 @@ func (m *Mirror) NeedHealthCheck() bool {
 }
 
 func (m *Mirror) NeedSync() bool {
-	return utils.ElapsedSec(m.LastSync, int64(60*GetConfig().ScanInterval))
+	if m.scanRequested {
+		return true
+	}
+	if m.PushSync {
+		// Only scanned when the mirror notifies an update
+		return false
+	}
+	delay := m.ScanDelay(GetConfig().ScanInterval, GetConfig().MaxScanBackoff)
+	return utils.ElapsedSec(m.LastSync, int64(delay/time.Second))
 }
 
 func (m *Mirror) IsScanning() bool {
@@ -81,10 +105,12 @@ func NewMonitor(r *database.Redis, c *mirrors.Cache) *Monitor {
 	monitor.cache = c
 	monitor.cluster = NewCluster(r)
 	monitor.mirrors = make(map[string]*Mirror)
-	monitor.healthCheckChan = make(chan string, healthCheckThreads*5)
+	monitor.healthCheckChan = make(chan string, GetConfig().HealthCheck.Workers*5)
 	monitor.syncChan = make(chan string)
 	monitor.stop = make(chan bool)
 	monitor.configNotifier = make(chan bool, 1)
+	monitor.notifier = webhooks.NewNotifier()
+	monitor.mailer = mailer.NewMailer(r)
 
 	SubscribeConfig(monitor.configNotifier)
 
@@ -94,8 +120,9 @@ func NewMonitor(r *database.Redis, c *mirrors.Cache) *Monitor {
 		DisableKeepAlives:   true,
 		MaxIdleConnsPerHost: 0,
 		Dial: func(network, addr string) (net.Conn, error) {
-			deadline := time.Now().Add(clientDeadline)
-			c, err := net.DialTimeout(network, addr, clientTimeout)
+			conf := GetConfig().HealthCheck
+			deadline := time.Now().Add(time.Duration(conf.Deadline) * time.Second)
+			c, err := net.DialTimeout(network, addr, time.Duration(conf.Timeout)*time.Second)
 			if err != nil {
 				return nil, err
 			}
@@ -117,6 +144,7 @@ func (m *Monitor) Stop() {
 		return
 	default:
 		m.cluster.Stop()
+		m.notifier.Stop()
 		close(m.stop)
 	}
 }
@@ -141,6 +169,12 @@ func (m *Monitor) MonitorLoop() {
 	mirrorUpdateEvent := make(chan string, 10)
 	m.redis.Pubsub.SubscribeEvent(database.MIRROR_UPDATE, mirrorUpdateEvent)
 
+	scanRequestEvent := make(chan string, 10)
+	m.redis.Pubsub.SubscribeEvent(database.MIRROR_SCAN_REQ, scanRequestEvent)
+
+	checkRequestEvent := make(chan string, 10)
+	m.redis.Pubsub.SubscribeEvent(database.MIRROR_CHECK_REQ, checkRequestEvent)
+
 	// Scan the local repository
 	m.retry(func() error {
 		return m.scanRepository()
@@ -164,7 +198,7 @@ func (m *Monitor) MonitorLoop() {
 	m.cluster.Start()
 
 	// Start the health check routines
-	for i := 0; i < healthCheckThreads; i++ {
+	for i := 0; i < GetConfig().HealthCheck.Workers; i++ {
 		go m.healthCheckLoop()
 	}
 
@@ -176,6 +210,8 @@ func (m *Monitor) MonitorLoop() {
 	// Setup recurrent tasks
 	var repositoryScanTicker <-chan time.Time
 	repositoryScanInterval := -1
+	var repositoryWatchStop chan bool
+	repositoryScanRequest := make(chan bool, 1)
 	mirrorCheckTicker := time.NewTicker(1 * time.Second)
 
 	// Disable the mirror check while stopping to avoid spurious events
@@ -195,10 +231,29 @@ func (m *Monitor) MonitorLoop() {
 	for {
 		select {
 		case <-m.stop:
+			if repositoryWatchStop != nil {
+				close(repositoryWatchStop)
+			}
 			return
 		case id := <-mirrorUpdateEvent:
 			m.syncMirrorList(id)
+		case id := <-scanRequestEvent:
+			m.requestScan(id)
+		case id := <-checkRequestEvent:
+			m.mapLock.Lock()
+			if mirror, ok := m.mirrors[id]; ok {
+				// The check will be triggered by the next tick
+				mirror.lastCheck = 0
+			}
+			m.mapLock.Unlock()
 		case <-m.configNotifier:
+			if GetConfig().RepositoryWatch && repositoryWatchStop == nil {
+				repositoryWatchStop = make(chan bool)
+				go m.watchRepository(repositoryWatchStop, repositoryScanRequest)
+			} else if !GetConfig().RepositoryWatch && repositoryWatchStop != nil {
+				close(repositoryWatchStop)
+				repositoryWatchStop = nil
+			}
 			if repositoryScanInterval != GetConfig().RepositoryScanInterval {
 				repositoryScanInterval = GetConfig().RepositoryScanInterval
 
@@ -210,6 +265,8 @@ func (m *Monitor) MonitorLoop() {
 			}
 		case <-repositoryScanTicker:
 			m.scanRepository()
+		case <-repositoryScanRequest:
+			m.scanRepository()
 		case <-mirrorCheckTicker.C:
 			if m.redis.Failure() {
 				continue
@@ -231,6 +288,7 @@ func (m *Monitor) MonitorLoop() {
 					select {
 					case m.syncChan <- k:
 						m.mirrors[k].scanning = true
+						m.mirrors[k].scanRequested = false
 					default:
 					}
 				}
@@ -240,6 +298,20 @@ func (m *Monitor) MonitorLoop() {
 	}
 }
 
+// requestScan flags the given mirror to be scanned on the next tick. The
+// request is broadcasted to all the nodes but only the node handling the
+// mirror keeps it, the others would never clear it.
+func (m *Monitor) requestScan(id string) {
+	if !m.cluster.IsHandled(id) {
+		return
+	}
+	m.mapLock.Lock()
+	if mirror, ok := m.mirrors[id]; ok {
+		mirror.scanRequested = true
+	}
+	m.mapLock.Unlock()
+}
+
 // Returns a list of all mirrors ID
 func (m *Monitor) mirrorsID() ([]string, error) {
 	rconn := m.redis.Get()
@@ -314,14 +386,23 @@ func (m *Monitor) healthCheckLoop() {
 				continue
 			}
 
+			var current mirrors.Mirror
 			m.mapLock.Lock()
 			if _, ok := m.mirrors[k]; ok {
 				if !database.RedisIsLoading(err) {
 					m.mirrors[k].lastCheck = time.Now().UTC().Unix()
 				}
 				m.mirrors[k].checking = false
+				current = m.mirrors[k].Mirror
 			}
 			m.mapLock.Unlock()
+
+			// Notify the admin if the mirror is down for too long
+			if current.ID != "" && mailer.Enabled() {
+				if err := m.mailer.Check(current); err != nil && !database.RedisIsLoading(err) {
+					log.Errorf("Admin notification: %s", err.Error())
+				}
+			}
 		}
 	}
 }
@@ -368,12 +449,28 @@ func (m *Monitor) syncLoop() {
 			if err != nil && err != scan.ScanAborted && mirror.FtpURL != "" {
 				err = scan.Scan(scan.FTP, m.redis, mirror.FtpURL, k, m.stop)
 			}
+			// Crawling over HTTP is expensive, only use it
+			// for the mirrors without rsync nor FTP
+			if mirror.RsyncURL == "" && mirror.FtpURL == "" && mirror.MainURL() != "" {
+				err = scan.Scan(scan.HTTP, m.redis, mirror.MainURL(), k, m.stop)
+			}
 
 			if err == scan.ScanInProgress {
 				log.Warningf("%-30.30s Scan already in progress", k)
 				goto unlock
 			}
 
+			if err == nil {
+				m.notifier.SyncSucceeded(k)
+			} else if err != scan.ScanAborted {
+				m.notifier.SyncFailed(k, mirror.Up, mirror.StateSince, err)
+
+				// Delay the next scans of the failing mirror
+				if err := mirrors.AddScanFailure(m.redis, k); err != nil {
+					log.Warningf("syncloop: %s", err.Error())
+				}
+			}
+
 			if mirror.Up == false {
 				select {
 				case m.healthCheckChan <- k:
@@ -396,11 +493,8 @@ func (m *Monitor) healthCheck(mirror mirrors.Mirror) error {
 	// Format log output
 	format := "%-" + fmt.Sprintf("%d.%ds", m.formatLongestID+4, m.formatLongestID+4)
 
-	// Copy the stop channel to make it nilable locally
-	stopflag := m.stop
-
-	// Get the URL to a random file available on this mirror
-	file, size, err := m.getRandomFile(mirror.ID)
+	// Get the files to check on this mirror
+	files, err := m.getCheckFiles(mirror)
 	if err != nil {
 		if err == redis.ErrNil {
 			return mirrorNotScanned
@@ -410,14 +504,160 @@ func (m *Monitor) healthCheck(mirror mirrors.Mirror) error {
 		return err
 	}
 
+	var total time.Duration
+
+	for _, file := range files {
+		resp, elapsed, err := m.checkRequest(mirror, strings.TrimRight(mirror.MainURL(), "/")+file.path)
+		if utils.IsStopped(m.stop) {
+			return nil
+		}
+
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok {
+				log.Debugf("Op: %s | Net: %s | Addr: %s | Err: %s | Temporary: %t", opErr.Op, opErr.Net, opErr.Addr, opErr.Error(), opErr.Temporary())
+			}
+			if isTLSError(err) {
+				m.markMirrorDown(mirror, "TLS error")
+			} else {
+				m.markMirrorDown(mirror, "Unreachable")
+			}
+			log.Errorf(format+"Error: %s (%dms)", mirror.ID, err.Error(), elapsed/time.Millisecond)
+			return err
+		}
+
+		total += elapsed
+
+		if resp.StatusCode == 404 {
+			reason := fmt.Sprintf("File not found %s (error 404)", file.path)
+			if m.markMirrorDown(mirror, reason) && GetConfig().DisableOnMissingFile {
+				mirrors.DisableMirror(m.redis, mirror.ID)
+				if mirror.Enabled {
+					m.notifier.Disabled(mirror.ID, reason, m.stateSince(mirror))
+				}
+			}
+			log.Errorf(format+"Error: File %s not found (error 404)", mirror.ID, file.path)
+			return nil
+		} else if resp.StatusCode != 200 && resp.StatusCode != 206 {
+			m.markMirrorDown(mirror, fmt.Sprintf("Got status code %d", resp.StatusCode))
+			log.Warningf(format+"Down! Status: %d", mirror.ID, resp.StatusCode)
+			return nil
+		}
+
+		if rsize := responseSize(resp); file.size >= 0 && rsize >= 0 && rsize != file.size {
+			if GetConfig().HealthCheck.CheckSize {
+				m.markMirrorDown(mirror, fmt.Sprintf("File size mismatch %s", file.path))
+				log.Warningf(format+"Down! File size mismatch [%s] (%dms)", mirror.ID, file.path, elapsed/time.Millisecond)
+				return nil
+			}
+			log.Warningf(format+"File size mismatch! [%s] (%dms)", mirror.ID, file.path, elapsed/time.Millisecond)
+		}
+	}
+
+	elapsed := total / time.Duration(len(files))
+	healthCheckLatency.Set(elapsed.Seconds(), mirror.ID)
+	if err := mirrors.AddLatencySample(m.redis, mirror.ID, elapsed); err != nil {
+		log.Warningf("Cannot record the latency of %s: %s", mirror.ID, err.Error())
+	}
+
+	if reason := m.checkTrace(mirror); reason != "" {
+		m.markMirrorDown(mirror, reason)
+		log.Warningf(format+"Down! %s", mirror.ID, reason)
+	} else {
+		m.markMirrorUp(mirror)
+		log.Noticef(format+"Up! (%dms)", mirror.ID, elapsed/time.Millisecond)
+	}
+
+	// Check the HTTPS URL too when it's not the main one
+	if mirror.HttpURL != "" && mirror.HttpsURL != "" {
+		m.healthCheckHTTPS(mirror, files[0].path, format)
+	}
+	return nil
+}
+
+// markMirrorDown marks the mirror as down once enough consecutive failures
+// have been seen and notifies the webhooks if it was up. It returns false
+// if the mirror is kept up for now.
+func (m *Monitor) markMirrorDown(mirror mirrors.Mirror, reason string) bool {
+	if !m.confirmState(mirror, false) {
+		return false
+	}
+	if err := mirrors.MarkMirrorDown(m.redis, mirror.ID, reason); err == nil && mirror.Up {
+		m.notifier.StateChanged(mirror.ID, false, reason, m.stateSince(mirror))
+	}
+	return true
+}
+
+// markMirrorUp marks the mirror as up once enough consecutive successes
+// have been seen and notifies the webhooks if it was down
+func (m *Monitor) markMirrorUp(mirror mirrors.Mirror) {
+	if !m.confirmState(mirror, true) {
+		return
+	}
+	if err := mirrors.MarkMirrorUp(m.redis, mirror.ID); err == nil && !mirror.Up {
+		m.notifier.StateChanged(mirror.ID, true, "", m.stateSince(mirror))
+	}
+}
+
+// stateSince returns the time of the last state change of the mirror
+// as stored in the database
+func (m *Monitor) stateSince(mirror mirrors.Mirror) int64 {
+	since, err := mirrors.GetMirrorStateSince(m.redis, mirror.ID)
+	if err != nil {
+		return mirror.StateSince
+	}
+	return since
+}
+
+// Check the secondary HTTPS URL of a mirror, including the validity of its certificate
+func (m *Monitor) healthCheckHTTPS(mirror mirrors.Mirror, file, format string) {
+	resp, elapsed, err := m.checkRequest(mirror, strings.TrimRight(mirror.HttpsURL, "/")+file)
+	if utils.IsStopped(m.stop) {
+		return
+	}
+
+	if err != nil {
+		if isTLSError(err) {
+			mirrors.SetMirrorHTTPSState(m.redis, mirror.ID, false, "TLS error")
+		} else {
+			mirrors.SetMirrorHTTPSState(m.redis, mirror.ID, false, "Unreachable over HTTPS")
+		}
+		log.Errorf(format+"HTTPS error: %s (%dms)", mirror.ID, err.Error(), elapsed/time.Millisecond)
+		return
+	}
+
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		mirrors.SetMirrorHTTPSState(m.redis, mirror.ID, false, fmt.Sprintf("Got status code %d over HTTPS", resp.StatusCode))
+		log.Warningf(format+"HTTPS down! Status: %d", mirror.ID, resp.StatusCode)
+		return
+	}
+
+	mirrors.SetMirrorHTTPSState(m.redis, mirror.ID, true, "")
+	log.Debugf(format+"HTTPS up! (%dms)", mirror.ID, elapsed/time.Millisecond)
+}
+
+// Request the given URL using the health check method of the mirror, either
+// HEAD or a GET of the first byte. The request is aborted if the monitor is stopped.
+func (m *Monitor) checkRequest(mirror mirrors.Mirror, url string) (resp *http.Response, elapsed time.Duration, err error) {
+	// Copy the stop channel to make it nilable locally
+	stopflag := m.stop
+
+	method := GetConfig().HealthCheck.Method
+	if mirror.CheckMethod != "" && mirrors.IsValidCheckMethod(mirror.CheckMethod) {
+		method = mirror.CheckMethod
+	}
+
 	// Prepare the HTTP request
-	req, err := http.NewRequest("HEAD", strings.TrimRight(mirror.HttpURL, "/")+file, nil)
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
 	req.Header.Set("User-Agent", userAgent)
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
+	}
 	req.Close = true
 
 	done := make(chan bool)
-	var resp *http.Response
-	var elapsed time.Duration
 
 	// Execute the request inside a goroutine to allow aborting the request
 	go func() {
@@ -432,71 +672,106 @@ func (m *Monitor) healthCheck(mirror mirrors.Mirror) error {
 		done <- true
 	}()
 
-x:
 	for {
 		select {
 		case <-stopflag:
-			log.Debugf("Aborting health-check for %s", mirror.HttpURL)
+			log.Debugf("Aborting health-check for %s", url)
 			m.httpTransport.CancelRequest(req)
 			stopflag = nil
 		case <-done:
-			if utils.IsStopped(m.stop) {
-				return nil
-			}
-			break x
+			return
 		}
 	}
+}
 
-	if err != nil {
-		if opErr, ok := err.(*net.OpError); ok {
-			log.Debugf("Op: %s | Net: %s | Addr: %s | Err: %s | Temporary: %t", opErr.Op, opErr.Net, opErr.Addr, opErr.Error(), opErr.Temporary())
-		}
-		mirrors.MarkMirrorDown(m.redis, mirror.ID, "Unreachable")
-		log.Errorf(format+"Error: %s (%dms)", mirror.ID, err.Error(), elapsed/time.Millisecond)
-		return err
+// isTLSError returns true if the error is caused by the TLS handshake
+// or by an invalid certificate
+func isTLSError(err error) bool {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
 	}
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "x509: ") || strings.HasPrefix(err.Error(), "tls: ")
+}
+
+// checkFile is a file requested during a health check
+type checkFile struct {
+	path string
+	size int64 // -1 if unknown
+}
+
+// Get the files to request during the health check of the given mirror:
+// either the canary files or random files known to be served by the mirror
+func (m *Monitor) getCheckFiles(mirror mirrors.Mirror) ([]checkFile, error) {
+	conf := GetConfig().HealthCheck
+
+	rconn := m.redis.Get()
+	defer rconn.Close()
+
+	var paths []string
+	var err error
 
-	contentLength := resp.Header.Get("Content-Length")
+	canaries := conf.Files
+	if mirror.CheckFiles != "" {
+		canaries = strings.Fields(mirror.CheckFiles)
+	}
 
-	if resp.StatusCode == 404 {
-		mirrors.MarkMirrorDown(m.redis, mirror.ID, fmt.Sprintf("File not found %s (error 404)", file))
-		if GetConfig().DisableOnMissingFile {
-			mirrors.DisableMirror(m.redis, mirror.ID)
+	if len(canaries) > 0 {
+		for _, i := range rand.Perm(len(canaries)) {
+			if len(paths) >= conf.FilesPerCheck {
+				break
+			}
+			paths = append(paths, "/"+strings.TrimLeft(canaries[i], "/"))
 		}
-		log.Errorf(format+"Error: File %s not found (error 404)", mirror.ID, file)
-	} else if resp.StatusCode != 200 {
-		mirrors.MarkMirrorDown(m.redis, mirror.ID, fmt.Sprintf("Got status code %d", resp.StatusCode))
-		log.Warningf(format+"Down! Status: %d", mirror.ID, resp.StatusCode)
 	} else {
-		mirrors.MarkMirrorUp(m.redis, mirror.ID)
-		rsize, err := strconv.ParseInt(contentLength, 10, 64)
-		if err == nil && rsize != size {
-			log.Warningf(format+"File size mismatch! [%s] (%dms)", mirror.ID, file, elapsed/time.Millisecond)
-		} else {
-			log.Noticef(format+"Up! (%dms)", mirror.ID, elapsed/time.Millisecond)
+		paths, err = redis.Strings(rconn.Do("SRANDMEMBER", fmt.Sprintf("HANDLEDFILES_%s", mirror.ID), conf.FilesPerCheck))
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, redis.ErrNil
 		}
 	}
-	return nil
-}
 
-// Get a random filename known to be served by the given mirror
-func (m *Monitor) getRandomFile(identifier string) (file string, size int64, err error) {
-	sinterKey := fmt.Sprintf("HANDLEDFILES_%s", identifier)
+	files := make([]checkFile, 0, len(paths))
+	for _, path := range paths {
+		size, err := redis.Int64(rconn.Do("HGET", fmt.Sprintf("FILE_%s", path), "size"))
+		if err == redis.ErrNil {
+			// Canary file unknown to the local repository
+			size = -1
+		} else if err != nil {
+			return nil, err
+		}
+		files = append(files, checkFile{
+			path: path,
+			size: size,
+		})
+	}
 
-	rconn := m.redis.Get()
-	defer rconn.Close()
+	return files, nil
+}
 
-	file, err = redis.String(rconn.Do("SRANDMEMBER", sinterKey))
-	if err != nil {
-		return
+// responseSize returns the size of the file as announced by the
+// mirror or -1 if unknown
+func responseSize(resp *http.Response) int64 {
+	if resp.StatusCode == 206 {
+		// Content-Range: bytes 0-0/1234
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				return size
+			}
+		}
+		return -1
 	}
-
-	size, err = redis.Int64(rconn.Do("HGET", fmt.Sprintf("FILE_%s", file), "size"))
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
-		return
+		return -1
 	}
-
-	return
+	return size
 }
 
 // Trigger a sync of the local repository
@@ -508,6 +783,33 @@ func (m *Monitor) scanRepository() error {
 	return err
 }
 
+// watchRepository applies the changes of the local repository as they
+// happen and requests a full scan whenever some of them have been missed
+func (m *Monitor) watchRepository(stop chan bool, scanRequest chan bool) {
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	for {
+		err := scan.WatchSource(m.redis, stop)
+		if err == nil {
+			return
+		}
+		log.Errorf("Watching the repository failed: %s", err.Error())
+		if err == scan.ErrWatchOverflow {
+			select {
+			case scanRequest <- true:
+			default:
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
 // Retry a function until no errors is returned while still allowing
 // the process to be stopped.
 func (m *Monitor) retry(fn func() error, delay time.Duration) {
@@ -0,0 +1,37 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package daemon
+
+import (
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"testing"
+)
+
+func TestMonitor_requestScan(t *testing.T) {
+	// Two nodes, the first one handling m1
+	c := NewCluster(nil)
+	c.nodeTotal = 2
+	c.nodeIndex = 0
+	c.AddMirror(&mirrors.Mirror{ID: "m1"})
+	c.AddMirror(&mirrors.Mirror{ID: "m2"})
+
+	m := &Monitor{
+		cluster: c,
+		mirrors: map[string]*Mirror{
+			"m1": {Mirror: mirrors.Mirror{ID: "m1"}},
+			"m2": {Mirror: mirrors.Mirror{ID: "m2"}},
+		},
+	}
+
+	m.requestScan("m1")
+	m.requestScan("m2")
+	m.requestScan("unknown")
+
+	if !m.mirrors["m1"].scanRequested {
+		t.Fatalf("The scan of m1 should have been requested")
+	}
+	if m.mirrors["m2"].scanRequested {
+		t.Fatalf("m2 is handled by another node and must not be flagged")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errEmptyTrace = errors.New("empty trace file")
+
+	// Formats accepted on the first line of a trace file
+	traceTimeFormats = []string{
+		time.UnixDate, // output of date(1), used by Debian
+		time.RFC3339,
+		time.RFC1123,
+		time.RFC1123Z,
+		time.ANSIC,
+		"2006-01-02 15:04:05",
+	}
+)
+
+// parseTrace reads the timestamp of the last synchronization found on
+// the first line of a trace file. It can either be a unix timestamp or
+// a date in one of the common formats.
+func parseTrace(r io.Reader) (time.Time, error) {
+	scanner := bufio.NewScanner(io.LimitReader(r, 64<<10))
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return time.Time{}, err
+		}
+		return time.Time{}, errEmptyTrace
+	}
+	line := strings.TrimSpace(scanner.Text())
+
+	if ts, err := strconv.ParseInt(line, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	for _, layout := range traceTimeFormats {
+		if t, err := time.Parse(layout, line); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown date format: %s", line)
+}
+
+// sourceTrace returns the date of the trace file in the local repository
+func sourceTrace() (time.Time, error) {
+	f, err := os.Open(GetConfig().Repository + GetConfig().TraceFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	return parseTrace(f)
+}
+
+// mirrorTrace returns the date of the trace file found on the mirror
+func (m *Monitor) mirrorTrace(mirror mirrors.Mirror) (time.Time, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(mirror.MainURL(), "/")+GetConfig().TraceFile, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Close = true
+
+	// Abort the request, including the read of the body, on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return time.Time{}, fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return parseTrace(resp.Body)
+}
+
+// checkTrace compares the trace file of the mirror with the one of the
+// local repository and returns the reason why the mirror is considered
+// out of date, if any
+func (m *Monitor) checkTrace(mirror mirrors.Mirror) string {
+	if GetConfig().TraceFile == "" {
+		return ""
+	}
+
+	source, err := sourceTrace()
+	if err != nil {
+		log.Warningf("Cannot read the local trace file: %s", err.Error())
+		return ""
+	}
+
+	trace, err := m.mirrorTrace(mirror)
+	if err != nil {
+		// Not being able to get the trace file doesn't mean the mirror is broken
+		log.Warningf("%s: cannot get the trace file: %s", mirror.ID, err.Error())
+		return ""
+	}
+
+	lag := source.Sub(trace)
+	if lag > time.Duration(GetConfig().MaxTraceLag)*time.Hour {
+		return fmt.Sprintf("Out of date (%dh)", int(lag.Hours()))
+	}
+	return ""
+}
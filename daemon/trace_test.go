@@ -0,0 +1,121 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package daemon
+
+import (
+	"github.com/wsnipex/mirrorbits/mirrors"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTrace(t *testing.T) {
+	expected := time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		trace string
+		err   bool
+	}{
+		{trace: "1420211045"},
+		{trace: "1420211045\nmirror.example.org\n"},
+		{trace: "  1420211045  \n"},
+		{trace: "Fri Jan  2 15:04:05 UTC 2015\nDate: Fri Jan  2 15:04:05 UTC 2015\n"},
+		{trace: "2015-01-02T15:04:05Z"},
+		{trace: "2015-01-02T16:04:05+01:00"},
+		{trace: "Fri, 02 Jan 2015 15:04:05 UTC"},
+		{trace: "Fri, 02 Jan 2015 16:04:05 +0100"},
+		{trace: "Fri Jan  2 15:04:05 2015"},
+		{trace: "2015-01-02 15:04:05"},
+		{trace: "", err: true},
+		{trace: "\n1420211045", err: true},
+		{trace: "yesterday", err: true},
+		{trace: "2015-01-02", err: true},
+	}
+
+	for _, test := range tests {
+		ts, err := parseTrace(strings.NewReader(test.trace))
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: error expected, got %s", test.trace, ts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.trace, err)
+			continue
+		}
+		if !ts.Equal(expected) {
+			t.Errorf("%q: expected %s, got %s", test.trace, expected, ts)
+		}
+	}
+
+	if _, err := parseTrace(strings.NewReader("")); err != errEmptyTrace {
+		t.Fatalf("Expected errEmptyTrace, got %v", err)
+	}
+}
+
+func TestMonitor_mirrorTrace(t *testing.T) {
+	if err := LoadTestConfig("TraceFile: /project/trace\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err)
+	}
+
+	release := make(chan bool)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/project/trace":
+			w.Write([]byte("1420211045\n"))
+		case "/slow/project/trace":
+			// Send the headers but not the body
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	// Unblock the slow handler before closing the server
+	defer close(release)
+
+	m := &Monitor{
+		stop: make(chan bool),
+	}
+
+	trace, err := m.mirrorTrace(mirrors.Mirror{HttpURL: ts.URL + "/repo/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if trace.Unix() != 1420211045 {
+		t.Fatalf("Unexpected trace %s", trace)
+	}
+
+	if _, err := m.mirrorTrace(mirrors.Mirror{HttpURL: ts.URL + "/missing/"}); err == nil {
+		t.Fatalf("Error expected for a missing trace file")
+	}
+
+	// The request is aborted when the monitor stops
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(m.stop)
+	}()
+
+	done := make(chan error)
+	go func() {
+		_, err := m.mirrorTrace(mirrors.Mirror{HttpURL: ts.URL + "/slow/"})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Error expected for an aborted request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The request wasn't aborted")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+	Tokens granting access to the admin API:
+	APITOKENS							= sha256(token) -> name
+*/
+
+const (
+	apiTokensKey = "APITOKENS"
+)
+
+var (
+	ErrTokenExists   = errors.New("a token with the same name already exists")
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// hashAPIToken returns the digest under which a token is stored. Tokens
+// are never stored in clear so a leak of the database doesn't leak them too.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddAPIToken generates a new random token identified by the given name
+func AddAPIToken(r *Redis, name string) (token string, err error) {
+	tokens, err := ListAPITokens(r)
+	if err != nil {
+		return
+	}
+	for _, n := range tokens {
+		if n == name {
+			err = ErrTokenExists
+			return
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = hex.EncodeToString(b)
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", apiTokensKey, hashAPIToken(token), name)
+	return
+}
+
+// RemoveAPIToken revokes the token identified by the given name
+func RemoveAPIToken(r *Redis, name string) error {
+	tokens, err := ListAPITokens(r)
+	if err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	for hash, n := range tokens {
+		if n == name {
+			_, err = conn.Do("HDEL", apiTokensKey, hash)
+			return err
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// ListAPITokens returns the names of all known tokens indexed by their digest
+func ListAPITokens(r *Redis) (map[string]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("HGETALL", apiTokensKey))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string)
+	for i := 0; i+1 < len(values); i += 2 {
+		tokens[values[i]] = values[i+1]
+	}
+	return tokens, nil
+}
+
+// CheckAPIToken returns the name of the given token if it is valid
+func CheckAPIToken(r *Redis, token string) (name string, err error) {
+	if token == "" {
+		return "", ErrTokenNotFound
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	name, err = redis.String(conn.Do("HGET", apiTokensKey, hashAPIToken(token)))
+	if err == redis.ErrNil {
+		err = ErrTokenNotFound
+	}
+	return
+}
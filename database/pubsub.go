@@ -21,6 +21,8 @@ const (
 	FILE_UPDATE        PubsubEvent = "_mirrorbits_file_update"
 	MIRROR_UPDATE      PubsubEvent = "_mirrorbits_mirror_update"
 	MIRROR_FILE_UPDATE PubsubEvent = "_mirrorbits_mirror_file_update"
+	MIRROR_SCAN_REQ    PubsubEvent = "_mirrorbits_mirror_scan_request"
+	MIRROR_CHECK_REQ   PubsubEvent = "_mirrorbits_mirror_check_request"
 
 	PUBSUB_RECONNECTED PubsubEvent = "_mirrorbits_pubsub_reconnected"
 )
@@ -102,6 +104,8 @@ connect:
 		psc.Subscribe(FILE_UPDATE)
 		psc.Subscribe(MIRROR_UPDATE)
 		psc.Subscribe(MIRROR_FILE_UPDATE)
+		psc.Subscribe(MIRROR_SCAN_REQ)
+		psc.Subscribe(MIRROR_CHECK_REQ)
 
 		if disconnected == true {
 			// This is a way to keep the cache active while disconnected
@@ -4,17 +4,27 @@
 package filesystem
 
 import (
-	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	. "github.com/wsnipex/mirrorbits/config"
+	"golang.org/x/crypto/blake2b"
+	"hash"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
-// Generate a human readable sha1 hash of the given file path
+var (
+	// Shared by all the files being hashed concurrently
+	hashLimiter rateLimiter
+)
+
+// HashFile generates the human readable hashes of the given file path
+// enabled in the configuration, reading the file only once
 func HashFile(path string) (hashes FileInfo, err error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -22,28 +32,91 @@ func HashFile(path string) (hashes FileInfo, err error) {
 	}
 	defer f.Close()
 
-	reader := bufio.NewReader(f)
+	var sha1Hash, sha256Hash, sha512Hash, blake2bHash, md5Hash hash.Hash
+	var writers []io.Writer
 
 	if GetConfig().Hashes.SHA1 {
-		sha1Hash := sha1.New()
-		_, err = io.Copy(sha1Hash, reader)
-		if err == nil {
-			hashes.Sha1 = hex.EncodeToString(sha1Hash.Sum(nil))
-		}
+		sha1Hash = sha1.New()
+		writers = append(writers, sha1Hash)
 	}
 	if GetConfig().Hashes.SHA256 {
-		sha256Hash := sha256.New()
-		_, err = io.Copy(sha256Hash, reader)
-		if err == nil {
-			hashes.Sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
-		}
+		sha256Hash = sha256.New()
+		writers = append(writers, sha256Hash)
+	}
+	if GetConfig().Hashes.SHA512 {
+		sha512Hash = sha512.New()
+		writers = append(writers, sha512Hash)
+	}
+	if GetConfig().Hashes.BLAKE2b {
+		blake2bHash, _ = blake2b.New512(nil)
+		writers = append(writers, blake2bHash)
 	}
 	if GetConfig().Hashes.MD5 {
-		md5Hash := md5.New()
-		_, err = io.Copy(md5Hash, reader)
-		if err == nil {
-			hashes.Md5 = hex.EncodeToString(md5Hash.Sum(nil))
-		}
+		md5Hash = md5.New()
+		writers = append(writers, md5Hash)
+	}
+	if len(writers) == 0 {
+		return
+	}
+
+	_, err = io.Copy(io.MultiWriter(writers...), &limitedReader{r: f, l: &hashLimiter})
+	if err != nil {
+		return
+	}
+
+	if sha1Hash != nil {
+		hashes.Sha1 = hex.EncodeToString(sha1Hash.Sum(nil))
+	}
+	if sha256Hash != nil {
+		hashes.Sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	}
+	if sha512Hash != nil {
+		hashes.Sha512 = hex.EncodeToString(sha512Hash.Sum(nil))
+	}
+	if blake2bHash != nil {
+		hashes.Blake2b = hex.EncodeToString(blake2bHash.Sum(nil))
+	}
+	if md5Hash != nil {
+		hashes.Md5 = hex.EncodeToString(md5Hash.Sum(nil))
+	}
+	return
+}
+
+// rateLimiter limits the throughput of the readers sharing it
+// to the MaxRate configured for the hashes
+type rateLimiter struct {
+	sync.Mutex
+	next time.Time
+}
+
+// wait blocks until n more bytes can be read
+func (l *rateLimiter) wait(n int) {
+	rate := int64(GetConfig().Hashes.MaxRate) << 20
+	if rate <= 0 {
+		return
+	}
+
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	l.Unlock()
+
+	time.Sleep(delay)
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if n > 0 {
+		r.l.wait(n)
 	}
 	return
 }
@@ -0,0 +1,133 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package filesystem
+
+import (
+	. "github.com/wsnipex/mirrorbits/testing"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHashFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mirrorbits-hash-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc")
+	f.Close()
+
+	err = LoadTestConfig(`Hashes:
+    SHA1: true
+    SHA256: true
+    SHA512: true
+    BLAKE2b: true
+    MD5: true
+`)
+	if err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	h, err := HashFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := FileInfo{
+		Sha1:    "a9993e364706816aba3e25717850c26c9cd0d89d",
+		Sha256:  "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		Sha512:  "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f",
+		Blake2b: "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+		Md5:     "900150983cd24fb0d6963f7d28e17f72",
+	}
+	if h.Sha1 != expected.Sha1 {
+		t.Errorf("Wrong SHA1: %s", h.Sha1)
+	}
+	if h.Sha256 != expected.Sha256 {
+		t.Errorf("Wrong SHA256: %s", h.Sha256)
+	}
+	if h.Sha512 != expected.Sha512 {
+		t.Errorf("Wrong SHA512: %s", h.Sha512)
+	}
+	if h.Blake2b != expected.Blake2b {
+		t.Errorf("Wrong BLAKE2b: %s", h.Blake2b)
+	}
+	if h.Md5 != expected.Md5 {
+		t.Errorf("Wrong MD5: %s", h.Md5)
+	}
+
+	// Only the enabled hashes are computed
+	if err := LoadTestConfig("Hashes:\n    SHA1: false\n    SHA256: true\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	h, err = HashFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if h != (FileInfo{Sha256: expected.Sha256}) {
+		t.Fatalf("Expected only the SHA256 hash, got %+v", h)
+	}
+}
+
+func TestHashFile_Missing(t *testing.T) {
+	if err := LoadTestConfig("Hashes:\n    SHA1: true\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	if _, err := HashFile("/nonexistent/file"); err == nil {
+		t.Fatalf("Error expected")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+
+	// No limit
+	if err := LoadTestConfig("Hashes:\n    MaxRate: 0\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+	l.wait(1 << 30)
+	if !l.next.IsZero() {
+		t.Fatalf("No delay expected without a rate limit")
+	}
+
+	// 4 MiB/s
+	if err := LoadTestConfig("Hashes:\n    MaxRate: 4\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	// The first read is not delayed but books 250ms
+	before := time.Now()
+	l.wait(1 << 20)
+	after := time.Now()
+	if l.next.Before(before.Add(250*time.Millisecond)) || l.next.After(after.Add(250*time.Millisecond)) {
+		t.Fatalf("Expected 250ms booked for 1MiB, got %s", l.next.Sub(before))
+	}
+
+	// The second read waits for the first one and books 125ms more
+	booked := l.next
+	before = time.Now()
+	l.wait(1 << 19)
+	after = time.Now()
+	if before.Before(booked) {
+		if after.Before(booked) {
+			t.Fatalf("The read should have waited until the end of the previous one")
+		}
+		if !l.next.Equal(booked.Add(125 * time.Millisecond)) {
+			t.Fatalf("Expected 125ms booked for 512KiB, got %s", l.next.Sub(booked))
+		}
+	}
+
+	// The unused time is not accumulated
+	time.Sleep(l.next.Sub(time.Now()) + 100*time.Millisecond)
+	before = time.Now()
+	l.wait(1 << 20)
+	after = time.Now()
+	if l.next.Before(before.Add(250*time.Millisecond)) || l.next.After(after.Add(250*time.Millisecond)) {
+		t.Fatalf("Expected 250ms booked after the idle period, got %s", l.next.Sub(before))
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/core"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/metrics"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/wsnipex/mirrorbits/network"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Admin API (requires an "Authorization: Bearer <token>" header):
+
+	GET    /api/v1/mirrors				List all mirrors
+	POST   /api/v1/mirrors				Add a new mirror
+	GET    /api/v1/mirrors/{id}			Get a mirror
+	PATCH  /api/v1/mirrors/{id}			Update some fields of a mirror (except Enabled)
+	DELETE /api/v1/mirrors/{id}			Remove a mirror
+	POST   /api/v1/mirrors/{id}/enable	Enable a mirror
+	POST   /api/v1/mirrors/{id}/disable	Disable a mirror
+	POST   /api/v1/mirrors/{id}/rescan	Request a scan of a mirror
+	GET    /api/v1/mirrors/{id}/history	Get the state and latency history of a mirror (?days=30)
+
+	The Prometheus metrics are also exposed, without authentication, on /metrics.
+	They can be served by the public listeners allowing the "metrics" request type.
+*/
+
+const (
+	apiMirrorsPrefix = "/api/v1/mirrors"
+)
+
+// apiMirror is the representation of a mirror within the admin API
+type apiMirror struct {
+	mirrors.Mirror
+	Up bool
+}
+
+type apiError struct {
+	Error string
+}
+
+// RunAdminServer starts the admin API on its own listener if an
+// AdminListenAddress has been configured
+func (h *HTTP) RunAdminServer() error {
+	address := GetConfig().AdminListenAddress
+	if address == "" {
+		return nil
+	}
+
+	// Reuse the listener recovered during a seamless binary upgrade
+	h.stoppedMutex.Lock()
+	listener := h.adminListener
+	h.stoppedMutex.Unlock()
+
+	if listener == nil {
+		var err error
+
+		// The address might still be held by another process for a short
+		// while if it was not part of the recovered listeners
+		for i := 0; i < 10; i++ {
+			listener, err = listen(address)
+			if err == nil {
+				break
+			}
+			time.Sleep(1 * time.Second)
+		}
+		if err != nil {
+			log.Errorf("Admin API: %s", err.Error())
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiMirrorsPrefix, h.apiMirrorsHandler)
+	mux.HandleFunc(apiMirrorsPrefix+"/", h.apiMirrorsHandler)
+	mux.Handle("/metrics", metrics.Handler())
+
+	server := newServer(mux)
+
+	h.stoppedMutex.Lock()
+	if h.stopped {
+		h.stoppedMutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	h.adminServer = server
+	h.adminListener = listener
+	h.stoppedMutex.Unlock()
+
+	log.Infof("Admin API listening on %s", address)
+
+	return server.Serve(listener)
+}
+
+func (h *HTTP) apiMirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "Mirrorbits/"+core.VERSION)
+
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	name, err := database.CheckAPIToken(h.redis, token)
+	if err == database.ErrTokenNotFound {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "Invalid or missing API token")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	log.Debugf("Admin API: %s %s (token %s)", r.Method, r.URL.Path, name)
+
+	// Split /api/v1/mirrors/{id}/{action}
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, apiMirrorsPrefix), "/"), "/", 2)
+
+	switch {
+	case parts[0] == "":
+		switch r.Method {
+		case "GET":
+			h.apiListMirrors(w, r)
+		case "POST":
+			h.apiAddMirror(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case len(parts) == 1:
+		switch r.Method {
+		case "GET":
+			h.apiGetMirror(w, r, parts[0])
+		case "PATCH":
+			h.apiUpdateMirror(w, r, parts[0])
+		case "DELETE":
+			h.apiRemoveMirror(w, r, parts[0])
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case parts[1] == "history":
+		if r.Method != "GET" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h.apiMirrorHistory(w, r, parts[0])
+	default:
+		if r.Method != "POST" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h.apiMirrorAction(w, r, parts[0], parts[1])
+	}
+}
+
+func (h *HTTP) apiListMirrors(w http.ResponseWriter, r *http.Request) {
+	rconn := h.redis.Get()
+	defer rconn.Close()
+
+	mirrorsIDs, err := redis.Strings(rconn.Do("LRANGE", "MIRRORS", "0", "-1"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Cannot fetch the list of mirrors")
+		return
+	}
+
+	list := make([]apiMirror, 0, len(mirrorsIDs))
+	for _, id := range mirrorsIDs {
+		mirror, err := h.cache.GetMirror(id)
+		if err != nil {
+			continue
+		}
+		list = append(list, apiMirror{Mirror: mirror, Up: mirror.Up})
+	}
+
+	writeAPIResponse(w, http.StatusOK, list)
+}
+
+func (h *HTTP) apiGetMirror(w http.ResponseWriter, r *http.Request, id string) {
+	mirror, err := h.cache.GetMirror(id)
+	if err == redis.ErrNil {
+		writeAPIError(w, http.StatusNotFound, "No such mirror")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, apiMirror{Mirror: mirror, Up: mirror.Up})
+}
+
+func (h *HTTP) apiAddMirror(w http.ResponseWriter, r *http.Request) {
+	var m apiMirror
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid document: %s", err.Error()))
+		return
+	}
+	mirror := m.Mirror
+
+	if mirror.ID == "" || strings.Contains(mirror.ID, " ") || strings.Contains(mirror.ID, "/") {
+		writeAPIError(w, http.StatusBadRequest, "The identifier must be set and cannot contain a space or a slash")
+		return
+	}
+
+	if err := checkMirrorURLs(&mirror); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Guess the location of the mirror unless it was provided
+	if mirror.Latitude == 0 && mirror.Longitude == 0 && mirror.CountryCodes == "" {
+		if err := h.locateMirror(&mirror); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	mirror.Normalize()
+
+	if err := mirror.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := mirrors.AddMirror(h.redis, mirror)
+	if err == mirrors.ErrMirrorExists {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// New mirrors are always added disabled
+	mirror.Enabled = false
+
+	log.Noticef("Admin API: mirror %s added", mirror.ID)
+
+	writeAPIResponse(w, http.StatusCreated, apiMirror{Mirror: mirror})
+}
+
+func (h *HTTP) apiUpdateMirror(w http.ResponseWriter, r *http.Request, id string) {
+	mirror, err := h.cache.GetMirror(id)
+	if err == redis.ErrNil {
+		writeAPIError(w, http.StatusNotFound, "No such mirror")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	previous := mirror
+
+	// Only the fields present in the document will be overwritten
+	m := apiMirror{Mirror: mirror, Up: mirror.Up}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid document: %s", err.Error()))
+		return
+	}
+	mirror = m.Mirror
+
+	// The identifier cannot be changed
+	mirror.ID = id
+
+	if mirror.Enabled != previous.Enabled {
+		writeAPIError(w, http.StatusBadRequest, "Use the enable and disable actions to change the state of the mirror")
+		return
+	}
+
+	if err := checkMirrorURLs(&mirror); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Locate the mirror again if it moved to another host,
+	// unless its new location is part of the document
+	if mirrorHost(mirror) != mirrorHost(previous) &&
+		mirror.Latitude == previous.Latitude && mirror.Longitude == previous.Longitude &&
+		mirror.CountryCodes == previous.CountryCodes {
+		if err := h.locateMirror(&mirror); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	mirror.Normalize()
+
+	if err = mirror.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err = mirrors.UpdateMirror(h.redis, mirror); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Noticef("Admin API: mirror %s updated", id)
+
+	writeAPIResponse(w, http.StatusOK, apiMirror{Mirror: mirror, Up: mirror.Up})
+}
+
+func (h *HTTP) apiRemoveMirror(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.cache.GetMirror(id); err == redis.ErrNil {
+		writeAPIError(w, http.StatusNotFound, "No such mirror")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := mirrors.RemoveMirror(h.redis, id); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Noticef("Admin API: mirror %s removed", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTP) apiMirrorAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	if _, err := h.cache.GetMirror(id); err == redis.ErrNil {
+		writeAPIError(w, http.StatusNotFound, "No such mirror")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var err error
+	status := http.StatusNoContent
+
+	switch action {
+	case "enable":
+		err = mirrors.EnableMirror(h.redis, id)
+	case "disable":
+		err = mirrors.DisableMirror(h.redis, id)
+	case "rescan":
+		// The scan itself is done asynchronously by the monitor
+		err = mirrors.RequestScan(h.redis, id)
+		status = http.StatusAccepted
+	default:
+		writeAPIError(w, http.StatusNotFound, "Unknown action")
+		return
+	}
+
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Noticef("Admin API: %s requested on mirror %s", action, id)
+
+	w.WriteHeader(status)
+}
+
+func (h *HTTP) apiMirrorHistory(w http.ResponseWriter, r *http.Request, id string) {
+	mirror, err := h.cache.GetMirror(id)
+	if err == redis.ErrNil {
+		writeAPIError(w, http.StatusNotFound, "No such mirror")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	days := 30
+	if d := r.URL.Query().Get("days"); d != "" {
+		days, err = strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "Invalid number of days")
+			return
+		}
+	}
+
+	now := time.Now()
+	since := now.AddDate(0, 0, -days)
+
+	history, err := mirrors.GetHistory(h.redis, id, since)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, mirrors.NewHistoryReport(history, since, now, mirror.Up))
+}
+
+// checkMirrorURLs ensures that the mirror can be reached over HTTP or HTTPS
+// and adds the missing scheme to its URLs
+func checkMirrorURLs(mirror *mirrors.Mirror) error {
+	if mirror.HttpURL == "" && mirror.HttpsURL == "" {
+		return errors.New("HttpURL or HttpsURL is mandatory")
+	}
+
+	if mirror.HttpURL != "" && !strings.HasPrefix(mirror.HttpURL, "http://") && !strings.HasPrefix(mirror.HttpURL, "https://") {
+		mirror.HttpURL = "http://" + mirror.HttpURL
+	}
+
+	if mirror.HttpsURL != "" && !strings.HasPrefix(mirror.HttpsURL, "https://") {
+		mirror.HttpsURL = "https://" + strings.TrimPrefix(mirror.HttpsURL, "http://")
+	}
+
+	if u, err := url.Parse(mirror.MainURL()); err != nil || u.Host == "" {
+		return errors.New("Can't parse HTTP url")
+	}
+	return nil
+}
+
+// mirrorHost returns the host of the main URL of the mirror
+func mirrorHost(mirror mirrors.Mirror) string {
+	u, err := url.Parse(mirror.MainURL())
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// locateMirror sets the location of the mirror from the
+// GeoIP record of the host of its main URL
+func (h *HTTP) locateMirror(mirror *mirrors.Mirror) error {
+	ip, err := network.LookupMirrorIP(mirrorHost(*mirror))
+	if err != nil && err != network.ErrMultipleAddresses {
+		return fmt.Errorf("IP lookup failed: %s", err.Error())
+	}
+
+	geoRec := h.geoip.GetRecord(ip)
+	if geoRec.GeoIPRecord != nil {
+		mirror.Latitude = geoRec.GeoIPRecord.Latitude
+		mirror.Longitude = geoRec.GeoIPRecord.Longitude
+		mirror.ContinentCode = geoRec.GeoIPRecord.ContinentCode
+		mirror.CountryCodes = geoRec.GeoIPRecord.CountryCode
+	}
+	mirror.Asnum = geoRec.ASNum
+	return nil
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	output, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIResponse(w, status, apiError{Error: message})
+}
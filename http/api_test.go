@@ -0,0 +1,259 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"github.com/rafaeljusto/redigomock"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIToken = "s3cr3t"
+
+func prepareAPITest(t *testing.T) (*redigomock.Conn, *HTTP) {
+	if err := LoadTestConfig(""); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err)
+	}
+
+	mock, conn := PrepareRedisTest()
+	conn.ConnectPubsub()
+
+	sum := sha256.Sum256([]byte(testAPIToken))
+	mock.Command("HGET", "APITOKENS", hex.EncodeToString(sum[:])).Expect([]byte("admin"))
+
+	// The mirror m1 exists, any other is unknown
+	mock.Command("HGETALL", "MIRROR_m1").Expect([]interface{}{
+		[]byte("ID"), []byte("m1"),
+		[]byte("http"), []byte("http://m1.example.org/"),
+		[]byte("latitude"), []byte("1.000000"),
+		[]byte("longitude"), []byte("2.000000"),
+		[]byte("enabled"), []byte("0"),
+		[]byte("up"), []byte("0"),
+	})
+	mock.Command("HGETALL", "MIRROR_unknown").Expect([]interface{}{})
+
+	return mock, &HTTP{
+		redis: conn,
+		cache: mirrors.NewCache(conn),
+	}
+}
+
+// apiRequest sends a request to the admin API with the given token
+func apiRequest(h *HTTP, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.apiMirrorsHandler(w, r)
+	return w
+}
+
+// anyArgs returns n arguments matching any value
+func anyArgs(key string, n int) []interface{} {
+	args := []interface{}{key}
+	for i := 0; i < n; i++ {
+		args = append(args, redigomock.NewAnyData())
+	}
+	return args
+}
+
+func TestAPI_Authentication(t *testing.T) {
+	mock, h := prepareAPITest(t)
+
+	sum := sha256.Sum256([]byte("wrong"))
+	mock.Command("HGET", "APITOKENS", hex.EncodeToString(sum[:]))
+
+	for _, token := range []string{"", "wrong"} {
+		w := apiRequest(h, "GET", "/api/v1/mirrors/m1", token, "")
+		if w.Code != 401 {
+			t.Fatalf("Token %q: expected 401, got %d", token, w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("Token %q: the authentication scheme is missing", token)
+		}
+	}
+
+	w := apiRequest(h, "GET", "/api/v1/mirrors/m1", testAPIToken, "")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var m apiMirror
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || m.ID != "m1" || m.HttpURL != "http://m1.example.org/" {
+		t.Fatalf("Unexpected mirror: %s", w.Body.String())
+	}
+
+	if w := apiRequest(h, "PUT", "/api/v1/mirrors", testAPIToken, ""); w.Code != 405 {
+		t.Fatalf("Expected 405, got %d", w.Code)
+	}
+}
+
+func TestAPI_AddMirror(t *testing.T) {
+	mock, h := prepareAPITest(t)
+
+	mock.Command("HSETNX", "MIRROR_m2", "ID", "m2").Expect(int64(1))
+	hmset := mock.Command("HMSET", anyArgs("MIRROR_m2", 62)...).Expect("OK")
+	lpush := mock.Command("LPUSH", "MIRRORS", "m2").Expect(int64(2))
+	mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m2")
+
+	w := apiRequest(h, "POST", "/api/v1/mirrors", testAPIToken,
+		`{"ID": "m2", "HttpURL": "m2.example.org/", "Latitude": 1, "Longitude": 2, "Enabled": true}`)
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if mock.Stats(hmset) != 1 || mock.Stats(lpush) != 1 {
+		t.Fatalf("The mirror should have been saved")
+	}
+
+	var m apiMirror
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("Invalid response: %s", err.Error())
+	}
+	if m.HttpURL != "http://m2.example.org/" {
+		t.Fatalf("The scheme should have been added, got %s", m.HttpURL)
+	}
+	if m.Enabled {
+		t.Fatalf("New mirrors are added disabled")
+	}
+
+	// Duplicate identifier
+	mock.Command("HSETNX", "MIRROR_m2", "ID", "m2").Expect(int64(0))
+	w = apiRequest(h, "POST", "/api/v1/mirrors", testAPIToken, `{"ID": "m2", "HttpURL": "http://m2.example.org/", "Latitude": 1}`)
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, got %d", w.Code)
+	}
+
+	// Invalid documents
+	for _, body := range []string{
+		`{"ID": "m 3", "HttpURL": "http://m3.example.org/"}`,
+		`{"ID": "m3"}`,
+		`{"ID": "m3", "HttpURL": "http://m3.example.org/", "Latitude": 1, "CheckMethod": "POST"}`,
+		`not json`,
+	} {
+		if w := apiRequest(h, "POST", "/api/v1/mirrors", testAPIToken, body); w.Code != 400 {
+			t.Fatalf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestAPI_UpdateMirror(t *testing.T) {
+	mock, h := prepareAPITest(t)
+
+	if w := apiRequest(h, "PATCH", "/api/v1/mirrors/unknown", testAPIToken, `{"Comment": "hello"}`); w.Code != 404 {
+		t.Fatalf("Expected 404, got %d", w.Code)
+	}
+
+	// The state is changed with the enable and disable actions only
+	if w := apiRequest(h, "PATCH", "/api/v1/mirrors/m1", testAPIToken, `{"Enabled": true}`); w.Code != 400 {
+		t.Fatalf("Expected 400, got %d", w.Code)
+	}
+
+	hmset := mock.Command("HMSET", anyArgs("MIRROR_m1", 58)...).Expect("OK")
+	mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m1")
+
+	w := apiRequest(h, "PATCH", "/api/v1/mirrors/m1", testAPIToken, `{"ID": "other", "Comment": "hello", "Enabled": false}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if mock.Stats(hmset) != 1 {
+		t.Fatalf("The mirror should have been saved")
+	}
+
+	var m apiMirror
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("Invalid response: %s", err.Error())
+	}
+	if m.ID != "m1" || m.Comment != "hello" || m.HttpURL != "http://m1.example.org/" {
+		t.Fatalf("Only the given fields should have been changed, got %+v", m.Mirror)
+	}
+}
+
+func TestAPI_MirrorActions(t *testing.T) {
+	mock, h := prepareAPITest(t)
+
+	enable := mock.Command("HMSET", "MIRROR_m1", "enabled", true)
+	disable := mock.Command("HMSET", "MIRROR_m1", "enabled", false)
+	mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m1")
+	rescan := mock.Command("PUBLISH", string(database.MIRROR_SCAN_REQ), "m1")
+
+	tests := []struct {
+		action string
+		status int
+		cmd    *redigomock.Cmd
+	}{
+		{"enable", 204, enable},
+		{"disable", 204, disable},
+		{"rescan", 202, rescan},
+	}
+	for _, test := range tests {
+		w := apiRequest(h, "POST", "/api/v1/mirrors/m1/"+test.action, testAPIToken, "")
+		if w.Code != test.status {
+			t.Fatalf("%s: expected %d, got %d", test.action, test.status, w.Code)
+		}
+		if mock.Stats(test.cmd) != 1 {
+			t.Fatalf("%s: the action has not been done", test.action)
+		}
+	}
+
+	if w := apiRequest(h, "POST", "/api/v1/mirrors/m1/explode", testAPIToken, ""); w.Code != 404 {
+		t.Fatalf("Expected 404 for an unknown action, got %d", w.Code)
+	}
+	if w := apiRequest(h, "POST", "/api/v1/mirrors/unknown/enable", testAPIToken, ""); w.Code != 404 {
+		t.Fatalf("Expected 404 for an unknown mirror, got %d", w.Code)
+	}
+	if w := apiRequest(h, "GET", "/api/v1/mirrors/m1/enable", testAPIToken, ""); w.Code != 405 {
+		t.Fatalf("Expected 405, got %d", w.Code)
+	}
+}
+
+func TestAPI_MirrorHistory(t *testing.T) {
+	mock, h := prepareAPITest(t)
+
+	now := time.Now().Unix()
+	mock.Command("LRANGE", "HISTORY_STATE_m1", 0, -1).Expect([]interface{}{
+		[]byte(fmt.Sprintf(`{"Time":%d,"Up":false,"Reason":"timeout"}`, now-3600)),
+		[]byte(fmt.Sprintf(`{"Time":%d,"Up":true}`, now-7200)),
+	})
+	mock.Command("LRANGE", "HISTORY_LATENCY_m1", 0, -1).Expect([]interface{}{
+		[]byte(fmt.Sprintf("%d 40", now-60)),
+		[]byte(fmt.Sprintf("%d 60", now-120)),
+	})
+
+	w := apiRequest(h, "GET", "/api/v1/mirrors/m1/history?days=1", testAPIToken, "")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var report mirrors.HistoryReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid response: %s", err.Error())
+	}
+	if report.To-report.From != 86400 {
+		t.Fatalf("Expected a report over a day, got %d seconds", report.To-report.From)
+	}
+	if len(report.States) != 2 || report.States[0].Reason != "timeout" {
+		t.Fatalf("Wrong states: %+v", report.States)
+	}
+	if len(report.Latencies) != 2 || report.AverageLatency != 50 {
+		t.Fatalf("Wrong latencies: %+v (average %d)", report.Latencies, report.AverageLatency)
+	}
+
+	for _, days := range []string{"0", "-1", "abc"} {
+		if w := apiRequest(h, "GET", "/api/v1/mirrors/m1/history?days="+days, testAPIToken, ""); w.Code != 400 {
+			t.Fatalf("days=%s: expected 400, got %d", days, w.Code)
+		}
+	}
+	if w := apiRequest(h, "GET", "/api/v1/mirrors/unknown/history", testAPIToken, ""); w.Code != 404 {
+		t.Fatalf("Expected 404, got %d", w.Code)
+	}
+}
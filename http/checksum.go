@@ -0,0 +1,290 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/filesystem"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// Hashes of a single file requested with /file?<name>
+	checksumNames = []string{"md5", "sha1", "sha256", "sha512", "blake2b"}
+
+	// Checksum files of a directory requested with /dir/?<name>
+	// in the format of the coreutils (md5sum, sha256sum, b2sum...)
+	checksumLists = map[string]string{
+		"MD5SUMS":    "md5",
+		"SHA1SUMS":   "sha1",
+		"SHA256SUMS": "sha256",
+		"SHA512SUMS": "sha512",
+		"B2SUMS":     "blake2b",
+	}
+
+	// Maximum number of files listed in a checksum file
+	checksumListMaxFiles = 10000
+
+	// Number of files requested at once while building a checksum file
+	checksumListBatch = 1000
+
+	// Maximum size of the checksum files kept in memory
+	checksumListCacheSize uint64 = 64 << 20
+
+	errTooManyFiles = errors.New("too many files")
+)
+
+// checksumListCache keeps the generated checksum files until the index
+// of the repository changes, building them requires iterating the whole
+// index. A nil cache doesn't keep anything.
+type checksumListCache struct {
+	sync.Mutex
+	lists      *mirrors.LRUCache
+	generation uint64
+	events     chan string
+}
+
+type checksumListValue struct {
+	list []byte
+	err  error
+}
+
+func (v *checksumListValue) Size() int {
+	return len(v.list) + 1
+}
+
+// newChecksumListCache returns a cache emptied each time a file of the
+// repository is updated or nil if the updates cannot be followed
+func newChecksumListCache(r *database.Redis) *checksumListCache {
+	if r == nil || r.Pubsub == nil {
+		return nil
+	}
+
+	c := &checksumListCache{
+		lists:  mirrors.NewLRUCache(checksumListCacheSize),
+		events: make(chan string, 10),
+	}
+	r.Pubsub.SubscribeEvent(database.FILE_UPDATE, c.events)
+	r.Pubsub.SubscribeEvent(database.PUBSUB_RECONNECTED, c.events)
+
+	go func() {
+		for range c.events {
+			c.invalidate()
+		}
+	}()
+	return c
+}
+
+// get returns the cached checksum file for the given key along with the
+// generation of the cache to pass to set once the file is generated
+func (c *checksumListCache) get(key string) (value *checksumListValue, generation uint64, ok bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.lists.Get(key)
+	if !ok {
+		return nil, c.generation, false
+	}
+	return v.(*checksumListValue), c.generation, true
+}
+
+// set stores the checksum file unless the index changed since get was called
+func (c *checksumListCache) set(key string, value *checksumListValue, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if generation == c.generation {
+		c.lists.Set(key, value)
+	}
+}
+
+// invalidate forgets all the checksum files
+func (c *checksumListCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.lists.Clear()
+}
+
+// fileHash returns the hash of the given type of a file
+func fileHash(f filesystem.FileInfo, name string) string {
+	switch name {
+	case "md5":
+		return f.Md5
+	case "sha1":
+		return f.Sha1
+	case "sha256":
+		return f.Sha256
+	case "sha512":
+		return f.Sha512
+	case "blake2b":
+		return f.Blake2b
+	}
+	return ""
+}
+
+// hashEnabled returns true if the hashes of the given type are computed
+func hashEnabled(name string) bool {
+	conf := GetConfig().Hashes
+	switch name {
+	case "md5":
+		return conf.MD5
+	case "sha1":
+		return conf.SHA1
+	case "sha256":
+		return conf.SHA256
+	case "sha512":
+		return conf.SHA512
+	case "blake2b":
+		return conf.BLAKE2b
+	}
+	return false
+}
+
+// checksumListHandler generates the checksums of all the files found below
+// the requested directory from the hashes computed while scanning the
+// local repository
+func (h *HTTP) checksumListHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if !hashEnabled(ctx.Checksum()) {
+		http.Error(w, "Hash type not supported", http.StatusNotFound)
+		return
+	}
+
+	dir := path.Clean("/" + r.URL.Path)
+
+	if f, err := os.Stat(GetConfig().Repository + dir); err != nil || !f.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	checksums, err := h.checksumList(dir, ctx.Checksum())
+	if err == errTooManyFiles {
+		http.Error(w, fmt.Sprintf("More than %d files, request a subdirectory", checksumListMaxFiles), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Errorf("Error while fetching the checksums: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	h.writeChecksums(w, ctx, checksums)
+}
+
+// checksumList returns the checksums of the given type of the files
+// indexed below the given directory, sorted by name
+func (h *HTTP) checksumList(dir, name string) ([]byte, error) {
+	key := name + " " + dir
+	v, generation, ok := h.checksumLists.get(key)
+	if ok {
+		return v.list, v.err
+	}
+
+	list, err := h.buildChecksumList(dir, name)
+	if err != nil && err != errTooManyFiles {
+		return nil, err
+	}
+	h.checksumLists.set(key, &checksumListValue{list: list, err: err}, generation)
+	return list, err
+}
+
+// buildChecksumList generates the checksum file from the index
+func (h *HTTP) buildChecksumList(dir, name string) ([]byte, error) {
+	conn := h.redis.Get()
+	defer conn.Close()
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	// Only the files of the directory are returned by the
+	// server but the whole index still has to be iterated
+	var files []string
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", "FILES", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", checksumListBatch))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err = redis.Scan(values, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		files = append(files, batch...)
+		if len(files) > checksumListMaxFiles {
+			return nil, errTooManyFiles
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	sort.Strings(files)
+
+	var buf bytes.Buffer
+	for i := 0; i < len(files); i += checksumListBatch {
+		batch := files[i:]
+		if len(batch) > checksumListBatch {
+			batch = batch[:checksumListBatch]
+		}
+
+		for _, f := range batch {
+			conn.Send("HGET", fmt.Sprintf("FILE_%s", f), name)
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+
+		for _, f := range batch {
+			hash, err := redis.String(conn.Receive())
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			if hash == "" {
+				// Removed in the meantime or not hashed yet
+				continue
+			}
+			buf.WriteString(checksumLine(hash, f[len(prefix):]))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// escapeGlob escapes the characters having a special meaning
+// in the patterns of the redis commands
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// checksumLine formats a line of a checksum file like the coreutils,
+// escaping the names containing a backslash or a new line
+func checksumLine(hash, name string) string {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return fmt.Sprintf("%s  %s\n", hash, name)
+	}
+	name = strings.Replace(name, "\\", "\\\\", -1)
+	name = strings.Replace(name, "\n", "\\n", -1)
+	name = strings.Replace(name, "\r", "\\r", -1)
+	return fmt.Sprintf("\\%s  %s\n", hash, name)
+}
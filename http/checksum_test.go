@@ -0,0 +1,191 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"github.com/wsnipex/mirrorbits/filesystem"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChecksumLine(t *testing.T) {
+	tests := []struct {
+		hash, name, expected string
+	}{
+		{"abc", "file.iso", "abc  file.iso\n"},
+		{"abc", "dir/file with spaces.iso", "abc  dir/file with spaces.iso\n"},
+		{"abc", "back\\slash", "\\abc  back\\\\slash\n"},
+		{"abc", "new\nline\r", "\\abc  new\\nline\\r\n"},
+	}
+
+	for _, test := range tests {
+		if line := checksumLine(test.hash, test.name); line != test.expected {
+			t.Errorf("checksumLine(%q): expected %q, got %q", test.name, test.expected, line)
+		}
+	}
+}
+
+func TestChecksumParam(t *testing.T) {
+	tests := []struct {
+		query string
+		name  string
+		list  bool
+	}{
+		{"", "", false},
+		{"mirrorlist", "", false},
+		{"md5", "md5", false},
+		{"sha256", "sha256", false},
+		{"blake2b", "blake2b", false},
+		{"SHA1SUMS", "sha1", true},
+		{"SHA512SUMS", "sha512", true},
+		{"B2SUMS", "blake2b", true},
+		{"sha256sums", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/dir/?"+test.query, nil)
+		ctx := &Context{r: r, v: r.URL.Query()}
+		name, list := ctx.checksumParam()
+		if name != test.name || list != test.list {
+			t.Errorf("%q: expected (%q, %t), got (%q, %t)", test.query, test.name, test.list, name, list)
+		}
+	}
+}
+
+func TestFileHash(t *testing.T) {
+	f := filesystem.FileInfo{
+		Md5:     "md5",
+		Sha1:    "sha1",
+		Sha256:  "sha256",
+		Sha512:  "sha512",
+		Blake2b: "blake2b",
+	}
+
+	for _, name := range checksumNames {
+		if h := fileHash(f, name); h != name {
+			t.Errorf("fileHash(%q): got %q", name, h)
+		}
+	}
+	for _, name := range checksumLists {
+		if h := fileHash(f, name); h != name {
+			t.Errorf("fileHash(%q): got %q", name, h)
+		}
+	}
+	if h := fileHash(f, "crc32"); h != "" {
+		t.Errorf("No hash expected for an unknown type, got %q", h)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if s := escapeGlob(`/a*b?c[d]e\f/`); s != `/a\*b\?c\[d\]e\\f/` {
+		t.Fatalf("Unexpected pattern %s", s)
+	}
+}
+
+func TestChecksumList(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	h := &HTTP{redis: conn}
+
+	checksumListBatch = 2
+	defer func() { checksumListBatch = 1000 }()
+
+	mock.Command("SSCAN", "FILES", 0, "MATCH", "/dir/*", "COUNT", 2).Expect([]interface{}{
+		[]byte("5"),
+		[]interface{}{[]byte("/dir/sub/c"), []byte("/dir/b")},
+	})
+	mock.Command("SSCAN", "FILES", 5, "MATCH", "/dir/*", "COUNT", 2).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("/dir/a"), []byte("/dir/new")},
+	})
+	mock.Command("HGET", "FILE_/dir/a", "sha256").Expect([]byte("aaa"))
+	mock.Command("HGET", "FILE_/dir/b", "sha256").Expect([]byte("bbb"))
+	mock.Command("HGET", "FILE_/dir/sub/c", "sha256").Expect([]byte("ccc"))
+	// Not hashed yet
+	mock.Command("HGET", "FILE_/dir/new", "sha256").Expect([]byte(""))
+
+	list, err := h.checksumList("/dir", "sha256")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if expected := "aaa  a\nbbb  b\nccc  sub/c\n"; string(list) != expected {
+		t.Fatalf("Expected %q, got %q", expected, list)
+	}
+
+	// Root of the repository
+	mock.Command("SSCAN", "FILES", 0, "MATCH", "/*", "COUNT", 2).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("/dir/a")},
+	})
+	list, err = h.checksumList("/", "sha256")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if expected := "aaa  dir/a\n"; string(list) != expected {
+		t.Fatalf("Expected %q, got %q", expected, list)
+	}
+}
+
+func TestChecksumList_TooManyFiles(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	h := &HTTP{redis: conn}
+
+	checksumListMaxFiles = 2
+	defer func() { checksumListMaxFiles = 10000 }()
+
+	mock.Command("SSCAN", "FILES", 0, "MATCH", "/dir/*", "COUNT", checksumListBatch).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("/dir/a"), []byte("/dir/b"), []byte("/dir/c")},
+	})
+
+	if _, err := h.checksumList("/dir", "sha256"); err != errTooManyFiles {
+		t.Fatalf("Expected errTooManyFiles, got %v", err)
+	}
+}
+
+func TestChecksumList_Cache(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	conn.ConnectPubsub()
+	h := &HTTP{redis: conn, checksumLists: newChecksumListCache(conn)}
+
+	sscan := mock.Command("SSCAN", "FILES", 0, "MATCH", "/dir/*", "COUNT", checksumListBatch).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("/dir/a")},
+	})
+	mock.Command("HGET", "FILE_/dir/a", "sha256").Expect([]byte("aaa"))
+
+	for i := 0; i < 2; i++ {
+		list, err := h.checksumList("/dir", "sha256")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if string(list) != "aaa  a\n" {
+			t.Fatalf("Unexpected list %q", list)
+		}
+	}
+	if mock.Stats(sscan) != 1 {
+		t.Fatalf("The list should have been generated once, got %d", mock.Stats(sscan))
+	}
+
+	// Each type of hash has its own list
+	mock.Command("HGET", "FILE_/dir/a", "md5").Expect([]byte("bbb"))
+	if list, _ := h.checksumList("/dir", "md5"); string(list) != "bbb  a\n" {
+		t.Fatalf("Unexpected list %q", list)
+	}
+
+	// Regenerated once the index changes
+	h.checksumLists.invalidate()
+	mock.Command("HGET", "FILE_/dir/a", "sha256").Expect([]byte("ccc"))
+	if list, _ := h.checksumList("/dir", "sha256"); string(list) != "ccc  a\n" {
+		t.Fatalf("Unexpected list %q", list)
+	}
+
+	// A list generated while the index changed is not kept
+	_, generation, _ := h.checksumLists.get("sha1 /dir")
+	h.checksumLists.invalidate()
+	h.checksumLists.set("sha1 /dir", &checksumListValue{list: []byte("outdated")}, generation)
+	if _, _, ok := h.checksumLists.get("sha1 /dir"); ok {
+		t.Fatalf("The outdated list should have been dropped")
+	}
+}
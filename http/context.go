@@ -4,14 +4,19 @@
 package http
 
 import (
+	"fmt"
 	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/network"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // RequestType defines the type of the request
 type RequestType int
 
+// The names of the request types are listed in the same order in
+// config.RequestTypes
 const (
 	STANDARD RequestType = iota
 	MIRRORLIST
@@ -20,8 +25,21 @@ const (
 	DOWNLOADSTATS
 	USERAGENTSTATS
 	CHECKSUM
+	FEEDBACK
+	METRICS
 )
 
+// ParseRequestType returns the RequestType matching the given name
+// as used in the configuration (e.g. "mirrorlist")
+func ParseRequestType(name string) (RequestType, error) {
+	for i, n := range RequestTypes {
+		if strings.EqualFold(n, name) {
+			return RequestType(i), nil
+		}
+	}
+	return STANDARD, fmt.Errorf("unknown request type %s", name)
+}
+
 // Context represents the context of a request
 type Context struct {
 	r             *http.Request
@@ -35,6 +53,10 @@ type Context struct {
 	isDlStats     bool
 	isUaStats     bool
 	isChecksum    bool
+	isSumsList    bool
+	checksum      string
+	isSignature   bool
+	isMetalink    bool
 	isPretty      bool
 }
 
@@ -53,7 +75,11 @@ func NewContext(w http.ResponseWriter, r *http.Request, t Templates) *Context {
 			return c
 		}
 	}
-	if c.paramBool("mirrorlist") {
+	if r.URL.Path == "/metrics" && len(c.v) == 0 {
+		c.typ = METRICS
+	} else if c.paramBool("feedback") {
+		c.typ = FEEDBACK
+	} else if c.paramBool("mirrorlist") {
 		c.typ = MIRRORLIST
 		c.isMirrorList = true
 	} else if c.paramBool("stats") {
@@ -62,11 +88,17 @@ func NewContext(w http.ResponseWriter, r *http.Request, t Templates) *Context {
 	} else if c.paramBool("mirrorstats") {
 		c.typ = MIRRORSTATS
 		c.isMirrorStats = true
-	} else if c.paramBool("md5") || c.paramBool("sha1") || c.paramBool("sha256") {
+	} else if name, list := c.checksumParam(); name != "" {
 		c.typ = CHECKSUM
 		c.isChecksum = true
+		c.isSumsList = list
+		c.checksum = name
+		c.isSignature = c.paramBool("sig")
 	} else {
 		c.typ = STANDARD
+		if c.paramBool("metalink") || strings.Contains(r.Header.Get("Accept"), "application/metalink4+xml") {
+			c.isMetalink = true
+		}
 	}
 
 	if c.paramBool("pretty") {
@@ -96,6 +128,23 @@ func (c *Context) Type() RequestType {
 	return c.typ
 }
 
+// IsSecure returns true if the client is connected over HTTPS, either
+// directly or through one of the trusted reverse proxies
+func (c *Context) IsSecure() bool {
+	if c.r.TLS != nil {
+		return true
+	}
+	if !strings.EqualFold(c.r.Header.Get("X-Forwarded-Proto"), "https") {
+		return false
+	}
+	// Anyone else could pretend to be connected over HTTPS
+	trusted, err := network.ParseNetworks(GetConfig().Feedback.TrustedProxies)
+	if err != nil {
+		return false
+	}
+	return network.IsTrustedProxy(c.r.RemoteAddr, trusted)
+}
+
 // IsMirrorlist returns true if the mirror list has been requested
 func (c *Context) IsMirrorlist() bool {
 	return c.isMirrorList
@@ -126,6 +175,28 @@ func (c *Context) IsChecksum() bool {
 	return c.isChecksum
 }
 
+// IsChecksumList returns true if the list of the checksums
+// of all the files inside a directory has been requested
+func (c *Context) IsChecksumList() bool {
+	return c.isSumsList
+}
+
+// Checksum returns the type of hash requested (e.g. "sha256")
+func (c *Context) Checksum() string {
+	return c.checksum
+}
+
+// IsSignature returns true if the detached signature
+// of the checksums has been requested
+func (c *Context) IsSignature() bool {
+	return c.isSignature
+}
+
+// IsMetalink returns true if a metalink document has been requested
+func (c *Context) IsMetalink() bool {
+	return c.isMetalink
+}
+
 // IsPretty returns true if the pretty json has been requested
 func (c *Context) IsPretty() bool {
 	return c.isPretty
@@ -136,6 +207,22 @@ func (c *Context) QueryParam(key string) string {
 	return c.v.Get(key)
 }
 
+// checksumParam returns the type of hash requested, if any, and
+// whether it is for a single file or a list of checksums
+func (c *Context) checksumParam() (string, bool) {
+	for _, name := range checksumNames {
+		if c.paramBool(name) {
+			return name, false
+		}
+	}
+	for list, name := range checksumLists {
+		if c.paramBool(list) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
 func (c *Context) paramBool(key string) bool {
 	_, ok := c.v[key]
 	return ok
@@ -0,0 +1,50 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"crypto/tls"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContext_IsSecure(t *testing.T) {
+	if err := LoadTestConfig("Feedback:\n    TrustedProxies: [10.0.0.0/8]\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	tests := []struct {
+		remoteAddr string
+		proto      string
+		tls        bool
+		expected   bool
+	}{
+		{"192.168.0.1:1234", "", false, false},
+		{"192.168.0.1:1234", "", true, true},
+		// The header is only honoured when set by a trusted proxy
+		{"192.168.0.1:1234", "https", false, false},
+		{"10.0.0.1:1234", "https", false, true},
+		{"10.0.0.1:1234", "HTTPS", false, true},
+		{"10.0.0.1:1234", "http", false, false},
+		{"10.0.0.1:1234", "", false, false},
+		// Unix sockets
+		{"@", "https", false, true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/file.iso", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		ctx := NewContext(httptest.NewRecorder(), r, Templates{})
+		if s := ctx.IsSecure(); s != test.expected {
+			t.Errorf("%s with %q (TLS %t): expected %t, got %t", test.remoteAddr, test.proto, test.tls, test.expected, s)
+		}
+	}
+}
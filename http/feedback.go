@@ -0,0 +1,129 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/wsnipex/mirrorbits/network"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Maximum size of a feedback request body
+	maxFeedbackSize = 4096
+)
+
+// feedbackHandler collects the failed or slow downloads reported by the
+// clients with POST /path/to/file?feedback and the form values "mirror"
+// and either "error" or "speed" (in KB/s).
+func (h *HTTP) feedbackHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	conf := GetConfig().Feedback
+
+	if conf.Threshold <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Only the proxies in front of mirrorbits can tell who the client is,
+	// otherwise a single client could pretend to be many
+	trusted, err := network.ParseNetworks(conf.TrustedProxies)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	remoteIP := network.ClientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), trusted)
+
+	window := time.Duration(conf.Window) * time.Minute
+	if conf.MaxReports > 0 {
+		reports, err := mirrors.AddClientReport(h.redis, remoteIP, window)
+		if err != nil {
+			log.Errorf("Cannot record the feedback: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if reports > conf.MaxReports {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFeedbackSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	id := r.PostFormValue("mirror")
+	reason := r.PostFormValue("error")
+
+	if _, err := h.cache.GetFileInfo(r.URL.Path); err == redis.ErrNil {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if id == "" {
+		http.Error(w, "Missing mirror", http.StatusBadRequest)
+		return
+	} else if _, err := h.cache.GetMirror(id); err == redis.ErrNil {
+		http.Error(w, "Unknown mirror", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if reason == "" {
+		speed, err := strconv.Atoi(r.PostFormValue("speed"))
+		if err != nil || speed < 0 {
+			http.Error(w, "Missing error or speed", http.StatusBadRequest)
+			return
+		}
+		if speed >= conf.MinSpeed {
+			// Nothing to complain about
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		reason = strconv.Itoa(speed) + "KB/s"
+	}
+
+	log.Infof("Feedback from %s about %s on %s: %s", remoteIP, r.URL.Path, id, reason)
+	feedbackTotal.Inc(id)
+
+	count, err := mirrors.AddFeedback(h.redis, id, remoteIP, window)
+	if err != nil {
+		log.Errorf("Cannot record the feedback: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if count >= conf.Threshold {
+		log.Warningf("%d clients reported a problem with %s within %d minutes", count, id, conf.Window)
+
+		if err := mirrors.RequestCheck(h.redis, id); err != nil {
+			log.Errorf("Cannot request a check of %s: %s", id, err.Error())
+		}
+		if conf.Penalty > 0 {
+			until := time.Now().Add(time.Duration(conf.Penalty) * time.Minute)
+			if err := mirrors.PenalizeMirror(h.redis, id, until); err != nil {
+				log.Errorf("Cannot penalize %s: %s", id, err.Error())
+			}
+		}
+		// Start over to avoid requesting a check on each new report
+		mirrors.ClearFeedback(h.redis, id)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
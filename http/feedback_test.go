@@ -0,0 +1,201 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"github.com/rafaeljusto/redigomock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const feedbackConfig = `Feedback:
+    Threshold: 3
+    Window: 10
+    MinSpeed: 50
+    Penalty: 30
+    MaxReports: 2
+    TrustedProxies: [10.0.0.0/8]
+`
+
+func prepareFeedbackTest(t *testing.T, config string) (*redigomock.Conn, *HTTP) {
+	if err := LoadTestConfig(config); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err)
+	}
+
+	mock, conn := PrepareRedisTest()
+	conn.ConnectPubsub()
+
+	return mock, &HTTP{
+		redis: conn,
+		cache: mirrors.NewCache(conn),
+	}
+}
+
+// expectFeedback registers the commands needed to accept a report sent by
+// the given client and returns the command recording it
+func expectFeedback(mock *redigomock.Conn, client string, reports, clients int64) *redigomock.Cmd {
+	mock.Command("HMGET", "FILE_/file.iso", "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b").
+		Expect([]interface{}{[]byte("1024"), nil, nil, nil, nil, nil, nil})
+	mock.Command("HGETALL", "MIRROR_m1").Expect([]interface{}{[]byte("ID"), []byte("m1")})
+	mock.Command("MULTI").Expect("OK")
+	mock.Command("SET", "FEEDBACK_CLIENT_"+client, 0, "EX", int64(600), "NX").Expect("QUEUED")
+	mock.Command("INCR", "FEEDBACK_CLIENT_"+client).Expect("QUEUED")
+	cmd := mock.Command("ZADD", "FEEDBACK_m1", redigomock.NewAnyInt(), client).Expect("QUEUED")
+	mock.Command("ZREMRANGEBYSCORE", "FEEDBACK_m1", "-inf", redigomock.NewAnyInt()).Expect("QUEUED")
+	mock.Command("ZCARD", "FEEDBACK_m1").Expect("QUEUED")
+	mock.Command("EXPIRE", "FEEDBACK_m1", int64(600)).Expect("QUEUED")
+	mock.Command("EXEC").
+		Expect([]interface{}{nil, reports}).
+		Expect([]interface{}{int64(1), int64(0), clients, int64(1)})
+	return cmd
+}
+
+func postFeedback(h *HTTP, remoteAddr, xff string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/file.iso?feedback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = remoteAddr
+	if xff != "" {
+		r.Header.Set("X-Forwarded-For", xff)
+	}
+	w := httptest.NewRecorder()
+	h.feedbackHandler(w, r, nil)
+	return w
+}
+
+func TestFeedbackHandler_Disabled(t *testing.T) {
+	_, h := prepareFeedbackTest(t, "Feedback:\n    Threshold: 0\n")
+
+	w := postFeedback(h, "192.168.0.1:1234", "", url.Values{"mirror": {"m1"}, "error": {"timeout"}})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", w.Code)
+	}
+}
+
+func TestFeedbackHandler_Method(t *testing.T) {
+	_, h := prepareFeedbackTest(t, feedbackConfig)
+
+	r := httptest.NewRequest("GET", "/file.iso?feedback", nil)
+	w := httptest.NewRecorder()
+	h.feedbackHandler(w, r, nil)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Fatalf("Expected 405, got %d", w.Code)
+	}
+}
+
+func TestFeedbackHandler_Invalid(t *testing.T) {
+	mock, h := prepareFeedbackTest(t, feedbackConfig)
+	expectFeedback(mock, "192.168.0.1", 1, 1)
+	mock.Command("HGETALL", "MIRROR_m2").Expect([]interface{}{})
+
+	tests := []struct {
+		form url.Values
+		code int
+	}{
+		{url.Values{"error": {"timeout"}}, http.StatusBadRequest},
+		{url.Values{"mirror": {"m2"}, "error": {"timeout"}}, http.StatusBadRequest},
+		{url.Values{"mirror": {"m1"}}, http.StatusBadRequest},
+		{url.Values{"mirror": {"m1"}, "speed": {"-1"}}, http.StatusBadRequest},
+		// Fast enough
+		{url.Values{"mirror": {"m1"}, "speed": {"50"}}, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		mock.Command("EXEC").Expect([]interface{}{nil, int64(1)})
+		if w := postFeedback(h, "192.168.0.1:1234", "", test.form); w.Code != test.code {
+			t.Errorf("%v: expected %d, got %d", test.form, test.code, w.Code)
+		}
+	}
+}
+
+func TestFeedbackHandler_Report(t *testing.T) {
+	mock, h := prepareFeedbackTest(t, feedbackConfig)
+
+	// The header set by the client itself is ignored
+	cmd := expectFeedback(mock, "192.168.0.1", 1, 1)
+	w := postFeedback(h, "192.168.0.1:1234", "1.2.3.4", url.Values{"mirror": {"m1"}, "speed": {"10"}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	if mock.Stats(cmd) != 1 {
+		t.Fatalf("The report wasn't recorded for the remote address")
+	}
+
+	// The header set by a trusted proxy is followed
+	cmd = expectFeedback(mock, "1.2.3.4", 1, 2)
+	w = postFeedback(h, "10.0.0.1:1234", "1.2.3.4", url.Values{"mirror": {"m1"}, "error": {"timeout"}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	if mock.Stats(cmd) != 1 {
+		t.Fatalf("The report wasn't recorded for the forwarded address")
+	}
+}
+
+func TestFeedbackHandler_RateLimit(t *testing.T) {
+	mock, h := prepareFeedbackTest(t, feedbackConfig)
+
+	cmd := expectFeedback(mock, "192.168.0.1", 3, 1)
+	w := postFeedback(h, "192.168.0.1:1234", "", url.Values{"mirror": {"m1"}, "error": {"timeout"}})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if mock.Stats(cmd) != 0 {
+		t.Fatalf("The report wasn't supposed to be recorded")
+	}
+}
+
+func TestFeedbackHandler_Threshold(t *testing.T) {
+	mock, h := prepareFeedbackTest(t, feedbackConfig)
+
+	expectFeedback(mock, "192.168.0.1", 1, 3)
+	cmd_check := mock.Command("PUBLISH", string(database.MIRROR_CHECK_REQ), "m1").Expect(int64(1))
+	cmd_penalty := mock.Command("HSET", "MIRROR_m1", "penalizedUntil", redigomock.NewAnyInt()).Expect(int64(1))
+	mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m1").Expect(int64(1))
+	cmd_clear := mock.Command("DEL", "FEEDBACK_m1").Expect(int64(1))
+
+	w := postFeedback(h, "192.168.0.1:1234", "", url.Values{"mirror": {"m1"}, "error": {"timeout"}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", w.Code)
+	}
+	if mock.Stats(cmd_check) != 1 {
+		t.Fatalf("No check requested")
+	}
+	if mock.Stats(cmd_penalty) != 1 {
+		t.Fatalf("The mirror wasn't penalized")
+	}
+	if mock.Stats(cmd_clear) != 1 {
+		t.Fatalf("The reports weren't cleared")
+	}
+}
+
+func TestFinalizeSelection_Penalty(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	mlist := mirrors.Mirrors{
+		{ID: "m1", PenalizedUntil: future},
+		{ID: "m2"},
+		{ID: "m3", PenalizedUntil: 1},
+		{ID: "m4", PenalizedUntil: future},
+		{ID: "m5"},
+	}
+
+	mlist = finalizeSelection(&Context{isMirrorList: true}, mlist)
+
+	var ids []string
+	for _, m := range mlist {
+		ids = append(ids, m.ID)
+	}
+	if strings.Join(ids, " ") != "m2 m3 m5 m1 m4" {
+		t.Fatalf("Expected the penalized mirrors last, got %v", ids)
+	}
+	if mlist[0].Weight != 100 {
+		t.Fatalf("Expected the first mirror to get all the weight")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/wsnipex/mirrorbits/database"
 	"github.com/wsnipex/mirrorbits/filesystem"
 	"github.com/wsnipex/mirrorbits/logs"
+	"github.com/wsnipex/mirrorbits/metrics"
 	"github.com/wsnipex/mirrorbits/mirrors"
 	"github.com/wsnipex/mirrorbits/network"
 	"github.com/wsnipex/mirrorbits/utils"
@@ -40,12 +41,17 @@ type HTTP struct {
 	geoip          *network.GeoIP
 	redis          *database.Redis
 	templates      Templates
-	Listener       *net.Listener
-	server         *graceful.Server
-	serverStopChan <-chan struct{}
+	listeners      []*listener
+	recovered      []net.Listener
+	certificates   certificateStore
+	signingKey     signingKeyStore
+	checksumLists  *checksumListCache
+	adminServer    *graceful.Server
+	adminListener  net.Listener
 	stats          *Stats
 	cache          *mirrors.Cache
 	engine         MirrorSelection
+	engineMutex    sync.RWMutex
 	Restarting     bool
 	stopped        bool
 	stoppedMutex   sync.Mutex
@@ -75,13 +81,19 @@ func HTTPServer(redis *database.Redis, cache *mirrors.Cache) *HTTP {
 	h.templates.downloadstats = template.Must(h.LoadTemplates("downloadstats"))
 	h.templates.useragentstats = template.Must(h.LoadTemplates("useragentstats"))
 	h.cache = cache
+	h.checksumLists = newChecksumListCache(redis)
 	h.stats = NewStats(redis)
-	h.engine = DefaultEngine{}
+	h.loadSelectionEngine()
 	h.blockedUAs = GetConfig().UserAgentStatsConf.BlockedUserAgents
 	h.uACountOnlyS = GetConfig().UserAgentStatsConf.CountOnlySpecialPath
 	h.uACountSpecial = GetConfig().UserAgentStatsConf.CountSpecialPath
 	h.parseUA = h.uACountOnlyS == false || len(h.blockedUAs) > 0
-	http.Handle("/", NewGzipHandler(h.requestDispatcher))
+	metrics.RegisterCollector(h.collectMetrics)
+
+	// Load the key used to sign the checksums
+	if err := h.signingKey.Load(); err != nil {
+		log.Fatal("Checksum signing key: ", err)
+	}
 
 	// Load the GeoIP databases
 	if err := h.geoip.LoadGeoIP(); err != nil {
@@ -106,35 +118,119 @@ func HTTPServer(redis *database.Redis, cache *mirrors.Cache) *HTTP {
 	return h
 }
 
-// SetListener can be used to set a different listener that should be used by the
-// HTTP server. This is primarily used during seamless binary upgrade.
-func (h *HTTP) SetListener(l net.Listener) {
-	h.Listener = &l
+// SetListeners can be used to set already running listeners that should be
+// used by the HTTP server. This is primarily used during seamless binary upgrade.
+func (h *HTTP) SetListeners(listeners []net.Listener) {
+	admin := &listener{address: GetConfig().AdminListenAddress}
+	for _, nl := range listeners {
+		if admin.address != "" && h.adminListener == nil && admin.matches(nl) {
+			h.adminListener = nl
+			continue
+		}
+		h.recovered = append(h.recovered, nl)
+	}
+}
+
+// Listeners returns the listeners currently used by the HTTP server
+func (h *HTTP) Listeners() []net.Listener {
+	h.stoppedMutex.Lock()
+	defer h.stoppedMutex.Unlock()
+	listeners := make([]net.Listener, 0, len(h.listeners))
+	for _, l := range h.listeners {
+		listeners = append(listeners, l.listener)
+	}
+	if h.adminListener != nil {
+		listeners = append(listeners, h.adminListener)
+	}
+	return listeners
+}
+
+// ListenersChanged returns true if the listeners set in the configuration
+// differ from the running ones, in which case the server must be restarted
+func (h *HTTP) ListenersChanged() bool {
+	h.stoppedMutex.Lock()
+	defer h.stoppedMutex.Unlock()
+	addresses := listenAddresses()
+	if len(addresses) != len(h.listeners) {
+		return true
+	}
+	for i, l := range addresses {
+		if l.key() != h.listeners[i].key() {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *HTTP) Stop(timeout time.Duration) {
+	h.stop(timeout, true)
+}
+
+// Restart stops the listeners so that RunServer returns and binds the
+// addresses of the new configuration. The admin server is kept running.
+func (h *HTTP) Restart(timeout time.Duration) {
+	h.stoppedMutex.Lock()
+	h.Restarting = true
+	h.stoppedMutex.Unlock()
+	h.stop(timeout, false)
+}
+
+func (h *HTTP) stop(timeout time.Duration, admin bool) {
 	/* Close the server and process remaining connections */
 	h.stoppedMutex.Lock()
 	defer h.stoppedMutex.Unlock()
+	if admin && h.adminServer != nil {
+		// Even while restarting, the address must be released
+		// for the new process of a seamless binary upgrade
+		h.adminServer.Stop(timeout)
+		h.adminServer = nil
+		h.adminListener = nil
+	}
 	if h.stopped {
 		return
 	}
 	h.stopped = true
-	h.server.Stop(timeout)
+	for _, l := range h.listeners {
+		l.server.Stop(timeout)
+	}
 }
 
 // Terminate terminates the current HTTP server gracefully
 func (h *HTTP) Terminate() {
-	/* Wait for the server to stop */
-	select {
-	case <-h.serverStopChan:
+	/* Wait for the servers to stop */
+	h.stoppedMutex.Lock()
+	listeners := h.listeners
+	h.stoppedMutex.Unlock()
+	for _, l := range listeners {
+		<-l.server.StopChan()
 	}
 	/* Commit the latest recorded stats to the database */
 	h.stats.Terminate()
 }
 
-func (h *HTTP) StopChan() <-chan struct{} {
-	return h.serverStopChan
+// loadSelectionEngine instantiates the selection engine set in the
+// configuration. The current engine is kept if the name is unknown.
+func (h *HTTP) loadSelectionEngine() {
+	name := GetConfig().SelectionEngine
+	engine, err := NewSelectionEngine(name, h.redis)
+	if err != nil {
+		log.Errorf("%s, keeping the current one", err.Error())
+		if h.selectionEngine() != nil {
+			return
+		}
+		engine = DefaultEngine{}
+	}
+
+	h.engineMutex.Lock()
+	h.engine = engine
+	h.engineMutex.Unlock()
+}
+
+// selectionEngine returns the selection engine currently in use
+func (h *HTTP) selectionEngine() MirrorSelection {
+	h.engineMutex.RLock()
+	defer h.engineMutex.RUnlock()
+	return h.engine
 }
 
 // Reload the configuration
@@ -142,6 +238,23 @@ func (h *HTTP) Reload() {
 	// Reload the GeoIP database
 	h.geoip.LoadGeoIP()
 
+	// Switch to the selected engine
+	h.loadSelectionEngine()
+
+	// Reload the certificate, the established connections are kept
+	if tlsEnabled() && h.certificates.Loaded() {
+		if err := h.certificates.Load(); err != nil {
+			log.Errorf("could not reload the TLS certificate: %s", err.Error())
+		} else {
+			log.Notice("TLS certificate reloaded")
+		}
+	}
+
+	// Reload the key used to sign the checksums
+	if err := h.signingKey.Load(); err != nil {
+		log.Errorf("could not reload the checksum signing key: %s", err.Error())
+	}
+
 	// Reload the templates
 	h.templates.Lock()
 	if t, err := h.LoadTemplates("mirrorlist"); err == nil {
@@ -167,52 +280,94 @@ func (h *HTTP) Reload() {
 	h.templates.Unlock()
 }
 
-// RunServer is the main function used to start the HTTP server
+// RunServer is the main function used to start the HTTP server.
+// It returns once all the listeners have been closed.
 func (h *HTTP) RunServer() (err error) {
-	// If listener isn't nil that means that we're running a seamless
-	// binary upgrade and we have recovered an already running listener
-	if h.Listener == nil {
-		proto := "tcp"
-		address := GetConfig().ListenAddress
-		if strings.HasPrefix(address, "unix:") {
-			proto = "unix"
-			address = strings.TrimPrefix(address, "unix:")
-		}
-		listener, err := net.Listen(proto, address)
-		if err != nil {
-			log.Fatal("Listen: ", err)
-		}
-		h.SetListener(listener)
+	addresses := listenAddresses()
+	if len(addresses) == 0 {
+		log.Fatal("Listen: no address to listen on")
 	}
 
-	h.server = &graceful.Server{
-		// http
-		Server: &http.Server{
-			Handler:        nil,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+	for _, l := range addresses {
+		if l.tls && !h.certificates.Loaded() {
+			if err := h.certificates.Load(); err != nil {
+				log.Fatal("TLS: ", err)
+			}
+		}
 
-		// graceful
-		Timeout:          10 * time.Second,
-		NoSignalHandling: true,
+		// Reuse the listener recovered during a seamless binary upgrade
+		for i, nl := range h.recovered {
+			if l.matches(nl) {
+				l.listener = nl
+				h.recovered = append(h.recovered[:i], h.recovered[i+1:]...)
+				break
+			}
+		}
+		if l.listener == nil {
+			l.listener, err = listen(l.address)
+			if err != nil {
+				log.Fatal("Listen: ", err)
+			}
+		}
+
+		l.server = newServer(NewGzipHandler(h.requestDispatcher(l)))
 	}
-	h.serverStopChan = h.server.StopChan()
 
-	log.Infof("Service listening on %s", GetConfig().ListenAddress)
+	// Close the recovered listeners not part of the configuration anymore
+	for _, nl := range h.recovered {
+		nl.Close()
+	}
+	h.recovered = nil
+
+	h.stoppedMutex.Lock()
+	h.stopped = false
+	h.listeners = addresses
+	h.stoppedMutex.Unlock()
+
+	errs := make(chan error, len(addresses))
+	for _, l := range addresses {
+		go func(l *listener) {
+			errs <- l.serve(&h.certificates)
+		}(l)
+		log.Infof("Service listening on %s", l)
+	}
 
 	/* Serve until we receive a SIGTERM */
-	return h.server.Serve(*h.Listener)
+	for range addresses {
+		if e := <-errs; e != nil {
+			log.Errorf("Serve: %s", e.Error())
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
 }
 
-func (h *HTTP) requestDispatcher(w http.ResponseWriter, r *http.Request) {
-	h.templates.RLock()
-	ctx := NewContext(w, r, h.templates)
-	h.templates.RUnlock()
+// requestDispatcher returns the handler of the requests received on the given listener
+func (h *HTTP) requestDispatcher(l *listener) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.templates.RLock()
+		ctx := NewContext(w, r, h.templates)
+		h.templates.RUnlock()
+
+		w.Header().Set("Server", "Mirrorbits/"+core.VERSION)
+
+		if ctx.Type() == METRICS && !l.Allows(METRICS) {
+			// A file of the repository
+			ctx.typ = STANDARD
+		}
 
-	w.Header().Set("Server", "Mirrorbits/"+core.VERSION)
+		if !l.Allows(ctx.Type()) {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.dispatch(w, r, ctx)
+	}
+}
 
+func (h *HTTP) dispatch(w http.ResponseWriter, r *http.Request, ctx *Context) {
 	switch ctx.Type() {
 	case MIRRORLIST:
 		fallthrough
@@ -228,6 +383,10 @@ func (h *HTTP) requestDispatcher(w http.ResponseWriter, r *http.Request) {
 		h.userAgentStatsHandler(w, r, ctx)
 	case CHECKSUM:
 		h.checksumHandler(w, r, ctx)
+	case FEEDBACK:
+		h.feedbackHandler(w, r, ctx)
+	case METRICS:
+		metrics.Handler().ServeHTTP(w, r)
 	}
 }
 
@@ -332,7 +491,7 @@ func (h *HTTP) mirrorHandler(w http.ResponseWriter, r *http.Request, ctx *Contex
 
 	clientInfo := h.geoip.GetRecord(remoteIP) //TODO return a pointer?
 
-	mlist, excluded, err := h.engine.Selection(ctx, h.cache, &fileInfo, clientInfo)
+	mlist, excluded, err := h.selectionEngine().Selection(ctx, h.cache, &fileInfo, clientInfo)
 
 	/* Handle errors */
 	fallback := false
@@ -374,6 +533,8 @@ func (h *HTTP) mirrorHandler(w http.ResponseWriter, r *http.Request, ctx *Contex
 
 	if ctx.IsMirrorlist() {
 		resultRenderer = &MirrorListRenderer{}
+	} else if ctx.IsMetalink() {
+		resultRenderer = &MetalinkRenderer{}
 	} else {
 		switch GetConfig().OutputMode {
 		case "json":
@@ -400,6 +561,11 @@ func (h *HTTP) mirrorHandler(w http.ResponseWriter, r *http.Request, ctx *Contex
 		http.Error(w, err.Error(), status)
 	}
 
+	requestsTotal.Inc(resultRenderer.Type())
+	if fallback {
+		fallbacksTotal.Inc()
+	}
+
 	if !ctx.IsMirrorlist() {
 		logs.LogDownload(resultRenderer.Type(), status, results, err, r.UserAgent())
 		if len(mlist) > 0 {
@@ -779,6 +945,10 @@ func (h *HTTP) userAgentStatsHandler(w http.ResponseWriter, r *http.Request, ctx
 }
 
 func (h *HTTP) checksumHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.IsChecksumList() {
+		h.checksumListHandler(w, r, ctx)
+		return
+	}
 
 	fileInfo, err := h.cache.GetFileInfo(r.URL.Path)
 	if err == redis.ErrNil {
@@ -790,25 +960,14 @@ func (h *HTTP) checksumHandler(w http.ResponseWriter, r *http.Request, ctx *Cont
 		return
 	}
 
-	var hash string
-
-	if ctx.paramBool("md5") {
-		hash = fileInfo.Md5
-	} else if ctx.paramBool("sha1") {
-		hash = fileInfo.Sha1
-	} else if ctx.paramBool("sha256") {
-		hash = fileInfo.Sha256
-	}
+	hash := fileHash(fileInfo, ctx.Checksum())
 
 	if len(hash) == 0 {
 		http.Error(w, "Hash type not supported", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-	w.Write([]byte(fmt.Sprintf("%s  %s", hash, filepath.Base(fileInfo.Path))))
-
-	return
+	h.writeChecksums(w, ctx, []byte(fmt.Sprintf("%s  %s", hash, filepath.Base(fileInfo.Path))))
 }
 
 type MirrorStats struct {
@@ -0,0 +1,191 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"gopkg.in/tylerb/graceful.v1"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listener is one of the addresses the HTTP server is bound to
+type listener struct {
+	address  string
+	tls      bool
+	allowed  map[RequestType]bool // nil if all the request types are allowed
+	listener net.Listener
+	server   *graceful.Server
+}
+
+// listenAddresses returns the addresses to listen on. The ListenAddresses
+// list takes precedence over ListenAddress and TLSListenAddress.
+func listenAddresses() []*listener {
+	var listeners []*listener
+
+	if len(GetConfig().ListenAddresses) == 0 {
+		listeners = append(listeners, &listener{
+			address: GetConfig().ListenAddress,
+		})
+		if tlsEnabled() {
+			listeners = append(listeners, &listener{
+				address: GetConfig().TLSListenAddress,
+				tls:     true,
+			})
+		}
+		return listeners
+	}
+
+	for _, l := range GetConfig().ListenAddresses {
+		if l.TLS && !tlsEnabled() {
+			log.Errorf("Listen: %s requires TLSCertificate and TLSKey, ignoring", l.Address)
+			continue
+		}
+		nl := &listener{
+			address: l.Address,
+			tls:     l.TLS,
+		}
+		if len(l.RequestTypes) > 0 {
+			nl.allowed = make(map[RequestType]bool)
+			for _, name := range l.RequestTypes {
+				t, err := ParseRequestType(name)
+				if err != nil {
+					log.Errorf("Listen: %s: %s", l.Address, err.Error())
+					continue
+				}
+				nl.allowed[t] = true
+			}
+		}
+		listeners = append(listeners, nl)
+	}
+	return listeners
+}
+
+// Allows returns true if the given type of request can be served
+func (l *listener) Allows(typ RequestType) bool {
+	if typ == METRICS {
+		// Only exposed on the listeners explicitly allowing them
+		return l.allowed[METRICS]
+	}
+	return l.allowed == nil || l.allowed[typ]
+}
+
+// String returns a description of the listener for the logs
+func (l *listener) String() string {
+	if l.tls {
+		return fmt.Sprintf("%s (TLS)", l.address)
+	}
+	return l.address
+}
+
+// key returns a string identifying the configuration of the listener
+func (l *listener) key() string {
+	types := make([]string, 0, len(l.allowed))
+	for t := range l.allowed {
+		types = append(types, strconv.Itoa(int(t)))
+	}
+	sort.Strings(types)
+	return fmt.Sprintf("%s %t %s", l.address, l.tls, strings.Join(types, ","))
+}
+
+// matches returns true if the given network listener is bound on the
+// address of the listener
+func (l *listener) matches(nl net.Listener) bool {
+	if strings.HasPrefix(l.address, "unix:") {
+		return nl.Addr().Network() == "unix" && nl.Addr().String() == strings.TrimPrefix(l.address, "unix:")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", l.address)
+	if err != nil {
+		return false
+	}
+	taddr, ok := nl.Addr().(*net.TCPAddr)
+	if !ok || taddr.Port != addr.Port {
+		return false
+	}
+	return taddr.IP.Equal(addr.IP) || (addr.IP == nil && taddr.IP.IsUnspecified())
+}
+
+// serve accepts the connections until the listener is closed
+func (l *listener) serve(certificates *certificateStore) error {
+	nl := l.listener
+	if l.tls {
+		nl = tls.NewListener(nl, certificates.tlsConfig())
+	}
+	err := l.server.Serve(nl)
+	// This check is ugly but there's still no way to detect this error by type
+	if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+		// This error is expected during a graceful shutdown
+		err = nil
+	}
+	return err
+}
+
+func newServer(handler http.Handler) *graceful.Server {
+	return &graceful.Server{
+		// http
+		Server: &http.Server{
+			Handler:        handler,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		},
+
+		// graceful
+		Timeout:          10 * time.Second,
+		NoSignalHandling: true,
+	}
+}
+
+// listen announces on the given address, which can either be
+// a tcp address or a unix socket path prefixed by "unix:"
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(address, "unix:"))
+	}
+
+	lc := net.ListenConfig{}
+	network := tcpNetwork(address)
+	if network == "tcp6" {
+		// Don't accept IPv4 connections on the IPv6 sockets, otherwise
+		// listening on both 0.0.0.0:80 and [::]:80 would fail
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// tcpNetwork returns the network matching the host of the given address:
+// tcp4 or tcp6 for the IP literals (0.0.0.0 would otherwise be bound
+// in dual-stack mode) and tcp for the host names and the empty host
+func tcpNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
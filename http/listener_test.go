@@ -0,0 +1,242 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRequestType(t *testing.T) {
+	if len(RequestTypes) != int(METRICS)+1 {
+		t.Fatalf("The names of the request types are out of sync")
+	}
+
+	tests := []struct {
+		name     string
+		expected RequestType
+	}{
+		{"standard", STANDARD},
+		{"mirrorlist", MIRRORLIST},
+		{"MirrorList", MIRRORLIST},
+		{"stats", FILESTATS},
+		{"mirrorstats", MIRRORSTATS},
+		{"downloadstats", DOWNLOADSTATS},
+		{"useragentstats", USERAGENTSTATS},
+		{"checksum", CHECKSUM},
+		{"feedback", FEEDBACK},
+		{"metrics", METRICS},
+	}
+
+	for _, test := range tests {
+		typ, err := ParseRequestType(test.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		} else if typ != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, typ)
+		}
+	}
+
+	if _, err := ParseRequestType("filestats"); err == nil {
+		t.Fatalf("Error expected for an unknown request type")
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected []string
+	}{
+		{"ListenAddress: :8080\n", []string{":8080 false "}},
+		{"ListenAddress: :8080\nTLSListenAddress: :8443\nTLSCertificate: cert.pem\nTLSKey: key.pem\n",
+			[]string{":8080 false ", ":8443 true "}},
+		// ListenAddresses takes precedence
+		{`ListenAddress: :8080
+ListenAddresses:
+    - Address: 127.0.0.1:80
+    - Address: unix:/run/mirrorbits.sock
+      RequestTypes: [Metrics, mirrorlist]
+    - Address: :443
+      TLS: true
+`, []string{"127.0.0.1:80 false ", "unix:/run/mirrorbits.sock false 1,8"}},
+	}
+
+	for _, test := range tests {
+		if err := LoadTestConfig(test.config); err != nil {
+			t.Fatalf("Cannot load the configuration: %s", err.Error())
+		}
+
+		var keys []string
+		for _, l := range listenAddresses() {
+			keys = append(keys, l.key())
+		}
+		if strings.Join(keys, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("%s: expected %q, got %q", test.config, test.expected, keys)
+		}
+	}
+}
+
+func TestListener_Allows(t *testing.T) {
+	all := &listener{}
+	restricted := &listener{allowed: map[RequestType]bool{STANDARD: true, CHECKSUM: true}}
+	metrics := &listener{allowed: map[RequestType]bool{METRICS: true}}
+
+	tests := []struct {
+		l        *listener
+		typ      RequestType
+		expected bool
+	}{
+		{all, STANDARD, true},
+		{all, FEEDBACK, true},
+		// The metrics must be explicitly allowed
+		{all, METRICS, false},
+		{restricted, STANDARD, true},
+		{restricted, CHECKSUM, true},
+		{restricted, MIRRORLIST, false},
+		{restricted, METRICS, false},
+		{metrics, METRICS, true},
+		{metrics, STANDARD, false},
+	}
+
+	for i, test := range tests {
+		if a := test.l.Allows(test.typ); a != test.expected {
+			t.Errorf("%d: expected %t for type %d, got %t", i, test.expected, test.typ, a)
+		}
+	}
+}
+
+func TestListener_Key(t *testing.T) {
+	a := &listener{address: ":80", allowed: map[RequestType]bool{METRICS: true, STANDARD: true, CHECKSUM: true}}
+	b := &listener{address: ":80", allowed: map[RequestType]bool{CHECKSUM: true, STANDARD: true, METRICS: true}}
+
+	if a.key() != ":80 false 0,6,8" || a.key() != b.key() {
+		t.Fatalf("The key should not depend on the order of the types, got %q and %q", a.key(), b.key())
+	}
+	for _, l := range []*listener{
+		{address: ":80"},
+		{address: ":80", tls: true, allowed: a.allowed},
+		{address: ":81", allowed: a.allowed},
+		{address: ":80", allowed: map[RequestType]bool{STANDARD: true}},
+	} {
+		if l.key() == a.key() {
+			t.Errorf("%q should differ from %q", l.key(), a.key())
+		}
+	}
+}
+
+func TestListener_Matches(t *testing.T) {
+	tcp, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	port := tcp.Addr().(*net.TCPAddr).Port
+
+	wildcard, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcard.Close()
+	anyPort := wildcard.Addr().(*net.TCPAddr).Port
+
+	dir, err := ioutil.TempDir("", "mirrorbits-listener-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "http.sock")
+	unix, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	tests := []struct {
+		address  string
+		nl       net.Listener
+		expected bool
+	}{
+		{fmt.Sprintf("127.0.0.1:%d", port), tcp, true},
+		{fmt.Sprintf("127.0.0.1:%d", port+1), tcp, false},
+		{fmt.Sprintf("127.0.0.2:%d", port), tcp, false},
+		{fmt.Sprintf(":%d", port), tcp, false},
+		{fmt.Sprintf(":%d", anyPort), wildcard, true},
+		{fmt.Sprintf("0.0.0.0:%d", anyPort), wildcard, true},
+		{"unix:" + socket, unix, true},
+		{"unix:" + socket + ".old", unix, false},
+		{"unix:" + socket, tcp, false},
+		{socket, unix, false},
+	}
+
+	for _, test := range tests {
+		l := &listener{address: test.address}
+		if m := l.matches(test.nl); m != test.expected {
+			t.Errorf("%s on %s: expected %t, got %t", test.address, test.nl.Addr(), test.expected, m)
+		}
+	}
+}
+
+func TestTcpNetwork(t *testing.T) {
+	tests := map[string]string{
+		":80":                 "tcp",
+		"localhost:80":        "tcp",
+		"0.0.0.0:80":          "tcp4",
+		"127.0.0.1:80":        "tcp4",
+		"[::]:80":             "tcp6",
+		"[2001:db8::1]:80":    "tcp6",
+		"[::ffff:1.2.3.4]:80": "tcp4",
+		"no port":             "tcp",
+	}
+
+	for address, expected := range tests {
+		if n := tcpNetwork(address); n != expected {
+			t.Errorf("tcpNetwork(%q): expected %s, got %s", address, expected, n)
+		}
+	}
+}
+
+func TestRequestDispatcher_Metrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorbits-repo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := LoadTestConfig("Repository: " + dir + "\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	h := &HTTP{}
+
+	tests := []struct {
+		l      *listener
+		target string
+		status int
+	}{
+		// /metrics is a file of the repository unless the listener exposes the metrics
+		{&listener{}, "/metrics", 404},
+		{&listener{allowed: map[RequestType]bool{STANDARD: true}}, "/metrics", 404},
+		{&listener{allowed: map[RequestType]bool{METRICS: true}}, "/metrics", 200},
+		{&listener{allowed: map[RequestType]bool{METRICS: true}}, "/file.iso", 404},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.requestDispatcher(test.l)(w, httptest.NewRequest("GET", test.target, nil))
+		if w.Code != test.status {
+			t.Errorf("%s on %s: expected %d, got %d", test.target, test.l.key(), test.status, w.Code)
+		}
+		if test.status == 200 && !strings.Contains(w.Body.String(), "# TYPE") {
+			t.Errorf("%s on %s: the metrics should have been served", test.target, test.l.key())
+		}
+	}
+}
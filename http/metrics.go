@@ -0,0 +1,76 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"github.com/wsnipex/mirrorbits/metrics"
+	"github.com/wsnipex/mirrorbits/utils"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	requestsTotal = metrics.NewCounter("mirrorbits_requests_total",
+		"Number of requests answered, by renderer type", "renderer")
+	fallbacksTotal = metrics.NewCounter("mirrorbits_fallbacks_total",
+		"Number of requests served by the fallback mirrors")
+	feedbackTotal = metrics.NewCounter("mirrorbits_feedback_total",
+		"Number of problems reported by the clients", "mirror")
+
+	mirrorUp = metrics.NewGauge("mirrorbits_mirror_up",
+		"Whether the mirror is up (1) or down (0)", "mirror")
+	mirrorEnabled = metrics.NewGauge("mirrorbits_mirror_enabled",
+		"Whether the mirror is enabled (1) or disabled (0)", "mirror")
+	mirrorStateSince = metrics.NewGauge("mirrorbits_mirror_state_since_seconds",
+		"Unix time of the last state change of the mirror", "mirror")
+
+	cacheHits = metrics.NewCounter("mirrorbits_cache_hits_total",
+		"Number of successful lookups in the local cache", "cache")
+	cacheMisses = metrics.NewCounter("mirrorbits_cache_misses_total",
+		"Number of unsuccessful lookups in the local cache", "cache")
+	cacheEntries = metrics.NewGauge("mirrorbits_cache_entries",
+		"Number of entries in the local cache", "cache")
+	cacheSize = metrics.NewGauge("mirrorbits_cache_size",
+		"Approximated size of the local cache", "cache")
+
+	statsBacklog = metrics.NewGauge("mirrorbits_stats_backlog",
+		"Number of downloads waiting to be counted")
+)
+
+// collectMetrics refreshes the metrics reflecting the current state of the server
+func (h *HTTP) collectMetrics() {
+	statsBacklog.Set(float64(len(h.stats.countChan)))
+
+	for name, lru := range h.cache.LRUCaches() {
+		hits, misses := lru.HitStats()
+		length, size, _, _ := lru.Stats()
+		cacheHits.Set(float64(hits), name)
+		cacheMisses.Set(float64(misses), name)
+		cacheEntries.Set(float64(length), name)
+		cacheSize.Set(float64(size), name)
+	}
+
+	rconn := h.redis.Get()
+	defer rconn.Close()
+
+	mirrorsIDs, err := redis.Strings(rconn.Do("LRANGE", "MIRRORS", "0", "-1"))
+	if err != nil {
+		log.Warningf("Metrics: cannot fetch the list of mirrors: %s", err.Error())
+		return
+	}
+
+	// Drop the mirrors that have been removed since the last scrape
+	mirrorUp.Reset()
+	mirrorEnabled.Reset()
+	mirrorStateSince.Reset()
+
+	for _, id := range mirrorsIDs {
+		mirror, err := h.cache.GetMirror(id)
+		if err != nil {
+			continue
+		}
+		mirrorUp.Set(utils.BoolToFloat(mirror.Up), id)
+		mirrorEnabled.Set(utils.BoolToFloat(mirror.Enabled), id)
+		mirrorStateSince.Set(float64(mirror.StateSince), id)
+	}
+}
@@ -5,12 +5,18 @@ package http
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/core"
 	"github.com/wsnipex/mirrorbits/mirrors"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -73,16 +79,33 @@ func (w *RedirectRenderer) Write(ctx *Context, results *mirrors.Results) (status
 		}
 
 		if mh >= 1 {
-			// Generate the header alternative links
+			// Generate the header alternative links (RFC 6249)
 			for i, m := range results.MirrorList[1:mh] {
-				var countryCode string
+				link := fmt.Sprintf("<%s>; rel=duplicate; pri=%d", m.HttpURL+path, i+1)
 				if len(m.CountryFields) > 0 {
-					countryCode = strings.ToLower(m.CountryFields[0])
+					link += "; geo=" + strings.ToLower(m.CountryFields[0])
 				}
-				ctx.ResponseWriter().Header().Add("Link", fmt.Sprintf("<%s>; rel=duplicate; pri=%d; geo=%s", m.HttpURL+path, i+1, countryCode))
+				ctx.ResponseWriter().Header().Add("Link", link)
 			}
 		}
 
+		// Link to the metalink describing the same file
+		ctx.ResponseWriter().Header().Add("Link", fmt.Sprintf("<%s>; rel=describedby; type=\"application/metalink4+xml\"", metalinkURLFor(ctx.Request())))
+
+		// Add the instance digests of the file (RFC 3230, RFC 5843)
+		if digest := hexToBase64(results.FileInfo.Sha512); digest != "" {
+			ctx.ResponseWriter().Header().Add("Digest", "SHA-512="+digest)
+		}
+		if digest := hexToBase64(results.FileInfo.Sha256); digest != "" {
+			ctx.ResponseWriter().Header().Add("Digest", "SHA-256="+digest)
+		}
+		if digest := hexToBase64(results.FileInfo.Sha1); digest != "" {
+			ctx.ResponseWriter().Header().Add("Digest", "SHA="+digest)
+		}
+		if digest := hexToBase64(results.FileInfo.Md5); digest != "" {
+			ctx.ResponseWriter().Header().Add("Digest", "MD5="+digest)
+		}
+
 		// Finally issue the redirect
 		http.Redirect(ctx.ResponseWriter(), ctx.Request(), results.MirrorList[0].HttpURL+path, http.StatusFound)
 		return http.StatusFound, nil
@@ -92,6 +115,122 @@ func (w *RedirectRenderer) Write(ctx *Context, results *mirrors.Results) (status
 	return http.StatusNotFound, nil
 }
 
+// MetalinkRenderer is used to render a metalink (RFC 5854) document listing
+// all the selected mirrors and the hashes of the requested file
+type MetalinkRenderer struct{}
+
+type metalink struct {
+	XMLName   xml.Name     `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	Generator string       `xml:"generator"`
+	File      metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string         `xml:"name,attr"`
+	Size   int64          `xml:"size,omitempty"`
+	Hashes []metalinkHash `xml:"hash"`
+	URLs   []metalinkURL  `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkURL struct {
+	Location string `xml:"location,attr,omitempty"`
+	Priority int    `xml:"priority,attr"`
+	URL      string `xml:",chardata"`
+}
+
+func (w *MetalinkRenderer) Type() string {
+	return "METALINK"
+}
+
+func (w *MetalinkRenderer) Write(ctx *Context, results *mirrors.Results) (statusCode int, err error) {
+	if len(results.MirrorList) == 0 {
+		// No mirror returned for this request
+		http.NotFound(ctx.ResponseWriter(), ctx.Request())
+		return http.StatusNotFound, nil
+	}
+
+	path := strings.TrimPrefix(results.FileInfo.Path, "/")
+	filename := filepath.Base(results.FileInfo.Path)
+
+	m := metalink{
+		Generator: "Mirrorbits/" + core.VERSION,
+		File: metalinkFile{
+			Name: filename,
+			Size: results.FileInfo.Size,
+		},
+	}
+
+	// Hash types are named according to the IANA "Hash Function Textual Names" registry
+	if results.FileInfo.Sha512 != "" {
+		m.File.Hashes = append(m.File.Hashes, metalinkHash{"sha-512", results.FileInfo.Sha512})
+	}
+	if results.FileInfo.Sha256 != "" {
+		m.File.Hashes = append(m.File.Hashes, metalinkHash{"sha-256", results.FileInfo.Sha256})
+	}
+	if results.FileInfo.Sha1 != "" {
+		m.File.Hashes = append(m.File.Hashes, metalinkHash{"sha-1", results.FileInfo.Sha1})
+	}
+	if results.FileInfo.Md5 != "" {
+		m.File.Hashes = append(m.File.Hashes, metalinkHash{"md5", results.FileInfo.Md5})
+	}
+
+	for i, mirror := range results.MirrorList {
+		var countryCode string
+		if len(mirror.CountryFields) > 0 {
+			countryCode = strings.ToLower(mirror.CountryFields[0])
+		}
+		m.File.URLs = append(m.File.URLs, metalinkURL{
+			Location: countryCode,
+			Priority: i + 1,
+			URL:      mirror.HttpURL + path,
+		})
+	}
+
+	output, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	ctx.ResponseWriter().Header().Set("Content-Type", "application/metalink4+xml; charset=utf-8")
+	ctx.ResponseWriter().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.meta4\"", filename))
+	ctx.ResponseWriter().Write([]byte(xml.Header))
+	ctx.ResponseWriter().Write(output)
+	return http.StatusOK, nil
+}
+
+// metalinkURLFor returns the absolute URL to the metalink form of the given request
+func metalinkURLFor(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: "metalink",
+	}
+	return u.String()
+}
+
+// hexToBase64 converts an hexadecimal digest to its base64 representation as
+// expected by the Digest header. An empty string is returned on failure.
+func hexToBase64(h string) string {
+	if h == "" {
+		return ""
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
 // MirrorListRenderer is used to render the mirrorlist page using the HTML templates
 type MirrorListRenderer struct{}
 
@@ -104,6 +243,17 @@ func (w *MirrorListRenderer) Write(ctx *Context, results *mirrors.Results) (stat
 		// No templates found for the mirrorlist
 		return http.StatusInternalServerError, TemplatesNotFound
 	}
+	// Move the sync sources to their own list
+	excluded := make(mirrors.Mirrors, 0, len(results.ExcludedList))
+	for _, m := range results.ExcludedList {
+		if isExcludedTier(m.Tier) {
+			results.SyncSources = append(results.SyncSources, m)
+		} else {
+			excluded = append(excluded, m)
+		}
+	}
+	results.ExcludedList = excluded
+
 	// Sort the exclude reasons by message so they appear grouped
 	sort.Sort(mirrors.ByExcludeReason{results.ExcludedList})
 
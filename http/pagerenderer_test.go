@@ -0,0 +1,242 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"encoding/xml"
+	"html/template"
+	"github.com/wsnipex/mirrorbits/filesystem"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testResults returns a fixed set of results for the file /dir/file.iso
+func testResults() *mirrors.Results {
+	return &mirrors.Results{
+		FileInfo: filesystem.FileInfo{
+			Path:   "/dir/file.iso",
+			Size:   1024,
+			Sha1:   "a9993e364706816aba3e25717850c26c9cd0d89d",
+			Sha256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+			Md5:    "900150983cd24fb0d6963f7d28e17f72",
+		},
+		MirrorList: mirrors.Mirrors{
+			{ID: "m1", HttpURL: "http://m1.example.org/", CountryFields: []string{"FR", "BE"}},
+			{ID: "m2", HttpURL: "https://m2.example.org/pub/", CountryFields: []string{"DE"}},
+			{ID: "m3", HttpURL: "http://m3.example.org/"},
+		},
+	}
+}
+
+// testContext returns the context of a request made with the default configuration
+func testContext(t *testing.T, target string) (*Context, *httptest.ResponseRecorder) {
+	if err := LoadTestConfig(""); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+	w := httptest.NewRecorder()
+	return NewContext(w, httptest.NewRequest("GET", target, nil), Templates{}), w
+}
+
+func TestMetalinkRenderer(t *testing.T) {
+	ctx, w := testContext(t, "/dir/file.iso?metalink")
+
+	status, err := (&MetalinkRenderer{}).Write(ctx, testResults())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if status != 200 {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/metalink4+xml; charset=utf-8" {
+		t.Fatalf("Wrong content type: %s", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="file.iso.meta4"` {
+		t.Fatalf("Wrong content disposition: %s", cd)
+	}
+	if !strings.HasPrefix(w.Body.String(), xml.Header) {
+		t.Fatalf("The XML declaration is missing")
+	}
+
+	var m metalink
+	if err := xml.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("Invalid document: %s", err.Error())
+	}
+	if m.XMLName.Space != "urn:ietf:params:xml:ns:metalink" || m.XMLName.Local != "metalink" {
+		t.Fatalf("Wrong root element: %+v", m.XMLName)
+	}
+	if m.File.Name != "file.iso" || m.File.Size != 1024 {
+		t.Fatalf("Wrong file: %s (%d)", m.File.Name, m.File.Size)
+	}
+
+	// Only the available hashes, strongest first
+	hashes := []metalinkHash{
+		{"sha-256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha-1", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"md5", "900150983cd24fb0d6963f7d28e17f72"},
+	}
+	if !reflect.DeepEqual(m.File.Hashes, hashes) {
+		t.Fatalf("Wrong hashes: %+v", m.File.Hashes)
+	}
+
+	urls := []metalinkURL{
+		{Location: "fr", Priority: 1, URL: "http://m1.example.org/dir/file.iso"},
+		{Location: "de", Priority: 2, URL: "https://m2.example.org/pub/dir/file.iso"},
+		{Location: "", Priority: 3, URL: "http://m3.example.org/dir/file.iso"},
+	}
+	if !reflect.DeepEqual(m.File.URLs, urls) {
+		t.Fatalf("Wrong URLs: %+v", m.File.URLs)
+	}
+
+	// The location is omitted when unknown
+	if strings.Contains(w.Body.String(), `location=""`) {
+		t.Fatalf("Empty location attribute")
+	}
+}
+
+func TestMetalinkRenderer_NoMirror(t *testing.T) {
+	ctx, w := testContext(t, "/dir/file.iso?metalink")
+
+	results := testResults()
+	results.MirrorList = nil
+
+	status, err := (&MetalinkRenderer{}).Write(ctx, results)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if status != 404 || w.Code != 404 {
+		t.Fatalf("Expected 404, got %d", status)
+	}
+}
+
+func TestRedirectRenderer(t *testing.T) {
+	ctx, w := testContext(t, "/dir/file.iso")
+
+	status, err := (&RedirectRenderer{}).Write(ctx, testResults())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if status != 302 || w.Code != 302 {
+		t.Fatalf("Expected 302, got %d", status)
+	}
+	if location := w.Header().Get("Location"); location != "http://m1.example.org/dir/file.iso" {
+		t.Fatalf("Wrong location: %s", location)
+	}
+
+	// The other mirrors are listed as alternatives (RFC 6249)
+	links := []string{
+		"<https://m2.example.org/pub/dir/file.iso>; rel=duplicate; pri=1; geo=de",
+		"<http://m3.example.org/dir/file.iso>; rel=duplicate; pri=2",
+		`<http://example.com/dir/file.iso?metalink>; rel=describedby; type="application/metalink4+xml"`,
+	}
+	if !reflect.DeepEqual(w.Header()["Link"], links) {
+		t.Fatalf("Wrong links:\n%s", strings.Join(w.Header()["Link"], "\n"))
+	}
+
+	// RFC 3230 / RFC 5843 instance digests, in base64
+	digests := []string{
+		"SHA-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=",
+		"SHA=qZk+NkcGgWq6PiVxeFDCbJzQ2J0=",
+		"MD5=kAFQmDzST7DWlj99KOF/cg==",
+	}
+	if !reflect.DeepEqual(w.Header()["Digest"], digests) {
+		t.Fatalf("Wrong digests:\n%s", strings.Join(w.Header()["Digest"], "\n"))
+	}
+}
+
+func TestRedirectRenderer_MaxLinkHeaders(t *testing.T) {
+	ctx, w := testContext(t, "/dir/file.iso")
+	if err := LoadTestConfig("MaxLinkHeaders: 1\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	results := testResults()
+	results.FileInfo.Sha1 = "not hexadecimal"
+
+	if _, err := (&RedirectRenderer{}).Write(ctx, results); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	links := w.Header()["Link"]
+	if len(links) != 2 || !strings.Contains(links[0], "pri=1") || !strings.Contains(links[1], "rel=describedby") {
+		t.Fatalf("Expected a single alternative, got:\n%s", strings.Join(links, "\n"))
+	}
+	for _, d := range w.Header()["Digest"] {
+		if strings.HasPrefix(d, "SHA=") {
+			t.Fatalf("An invalid digest should be omitted, got %s", d)
+		}
+	}
+}
+
+func TestRedirectRenderer_NoMirror(t *testing.T) {
+	ctx, w := testContext(t, "/dir/file.iso")
+
+	results := testResults()
+	results.MirrorList = nil
+
+	status, err := (&RedirectRenderer{}).Write(ctx, results)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if status != 404 || w.Code != 404 || len(w.Header()["Link"]) != 0 {
+		t.Fatalf("Expected 404 without links, got %d", status)
+	}
+}
+
+func TestHexToBase64(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "",
+		"zz":                               "",
+		"900150983cd24fb0d6963f7d28e17f72": "kAFQmDzST7DWlj99KOF/cg==",
+	}
+	for h, expected := range tests {
+		if b := hexToBase64(h); b != expected {
+			t.Errorf("hexToBase64(%q): expected %q, got %q", h, expected, b)
+		}
+	}
+}
+
+func TestMirrorListRenderer_SyncSources(t *testing.T) {
+	if err := LoadTestConfig("ExcludedTiers: [1]\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	tmpl := template.Must(template.New("base").Parse(
+		`{{range .MirrorList}}M:{{.ID}} {{end}}{{range .ExcludedList}}E:{{.ID}} {{end}}{{range .SyncSources}}S:{{.ID}} {{end}}`))
+
+	w := httptest.NewRecorder()
+	ctx := NewContext(w, httptest.NewRequest("GET", "/dir/file.iso?mirrorlist", nil), Templates{mirrorlist: tmpl})
+
+	results := testResults()
+	results.ExcludedList = mirrors.Mirrors{
+		{ID: "x0", Tier: 0, ExcludeReason: "Down"},
+		{ID: "x1", Tier: 1, ExcludeReason: "Excluded tier"},
+		{ID: "x2", Tier: 2, ExcludeReason: "Down"},
+		{ID: "x3", Tier: 1, ExcludeReason: "File not present"},
+	}
+
+	status, err := (&MirrorListRenderer{}).Write(ctx, results)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if status != 200 {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+
+	// The mirrors of the excluded tiers are only listed as sync sources
+	if body := w.Body.String(); body != "M:m1 M:m2 M:m3 E:x0 E:x2 S:x1 S:x3 " {
+		t.Fatalf("Unexpected lists: %s", body)
+	}
+}
+
+func TestMirrorListRenderer_NoTemplate(t *testing.T) {
+	ctx, _ := testContext(t, "/dir/file.iso?mirrorlist")
+
+	if _, err := (&MirrorListRenderer{}).Write(ctx, testResults()); err != TemplatesNotFound {
+		t.Fatalf("Expected TemplatesNotFound, got %v", err)
+	}
+}
@@ -4,15 +4,28 @@
 package http
 
 import (
+	"fmt"
 	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/database"
 	"github.com/wsnipex/mirrorbits/filesystem"
 	"github.com/wsnipex/mirrorbits/mirrors"
 	"github.com/wsnipex/mirrorbits/network"
 	"github.com/wsnipex/mirrorbits/utils"
+	"github.com/garyburd/redigo/redis"
 	"math"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Fraction of the monthly quota from which a mirror gets de-prioritized
+	quotaSoftLimit = 0.8
+	// Weight factor of the mirrors penalized by the feedback of the clients
+	feedbackPenalty = 0.1
 )
 
 type MirrorSelection interface {
@@ -21,10 +34,10 @@ type MirrorSelection interface {
 	Selection(*Context, *mirrors.Cache, *filesystem.FileInfo, network.GeoIPRecord) (mirrors.Mirrors, mirrors.Mirrors, error)
 }
 
-// DefaultEngine is the default algorithm used for mirror selection
-type DefaultEngine struct{}
-
-func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *filesystem.FileInfo, clientInfo network.GeoIPRecord) (mlist mirrors.Mirrors, excluded mirrors.Mirrors, err error) {
+// filterMirrors returns the list of mirrors able to serve the given file
+// and the list of mirrors that have been excluded along with the reason.
+// It's common to all the selection engines.
+func filterMirrors(ctx *Context, cache *mirrors.Cache, fileInfo *filesystem.FileInfo, clientInfo network.GeoIPRecord) (mlist mirrors.Mirrors, excluded mirrors.Mirrors, err error) {
 	// Get details about the requested file
 	*fileInfo, err = cache.GetFileInfo(fileInfo.Path)
 	if err != nil {
@@ -37,14 +50,24 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 		return
 	}
 
+	// Get the traffic of the mirrors having a quota
+	quotaIDs := make([]string, 0)
+	for _, m := range mlist {
+		if m.MonthlyQuota > 0 {
+			quotaIDs = append(quotaIDs, m.ID)
+		}
+	}
+	traffic, terr := cache.GetMonthlyBytes(quotaIDs)
+	if terr != nil {
+		log.Warningf("Cannot get the monthly traffic of the mirrors: %s", terr.Error())
+	}
+
 	// Filter
 	safeIndex := 0
 	excluded = make([]mirrors.Mirror, 0, len(mlist))
-	var closestMirror float32
-	var farthestMirror float32
-	for i, m := range mlist {
+	for _, m := range mlist {
 		// Does it support http? Is it well formated?
-		if !strings.HasPrefix(m.HttpURL, "http://") && !strings.HasPrefix(m.HttpURL, "https://") {
+		if !strings.HasPrefix(m.MainURL(), "http://") && !strings.HasPrefix(m.MainURL(), "https://") {
 			m.ExcludeReason = "Invalid URL"
 			goto delete
 		}
@@ -60,12 +83,49 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 			}
 			goto delete
 		}
+		// Can it serve a client connected over HTTPS?
+		if ctx.IsSecure() {
+			if m.SecureURL() == "" {
+				m.ExcludeReason = "No HTTPS"
+				goto delete
+			}
+			if m.HttpURL != "" && m.HttpsURL != "" && !m.HttpsUp {
+				m.ExcludeReason = m.HttpsExcludeReason
+				if m.ExcludeReason == "" {
+					m.ExcludeReason = "TLS error"
+				}
+				goto delete
+			}
+			m.HttpURL = m.SecureURL()
+		} else {
+			m.HttpURL = m.MainURL()
+		}
 		// Is it the same size as source?
 		if m.FileInfo != nil {
 			if m.FileInfo.Size != fileInfo.Size {
 				m.ExcludeReason = "File size mismatch"
 				goto delete
 			}
+			// Is it older than the source? (scanners only
+			// provide the modification times to the second)
+			if !m.FileInfo.ModTime.IsZero() && !fileInfo.ModTime.IsZero() &&
+				m.FileInfo.ModTime.Before(fileInfo.ModTime.Truncate(time.Second)) {
+				m.ExcludeReason = "Outdated file"
+				goto delete
+			}
+		}
+		// Has it exceeded its monthly quota?
+		if m.MonthlyQuota > 0 && traffic != nil {
+			m.QuotaUsage = float32(float64(traffic[m.ID]) / (float64(m.MonthlyQuota) * 1e9))
+			if m.QuotaUsage >= 1 {
+				m.ExcludeReason = "Quota exceeded"
+				goto delete
+			}
+		}
+		// Is it a sync source that must not be given to the clients?
+		if isExcludedTier(m.Tier) {
+			m.ExcludeReason = fmt.Sprintf("Sync source (tier %d)", m.Tier)
+			goto delete
 		}
 		// Is it configured to serve its continent only?
 		if m.ContinentOnly {
@@ -88,15 +148,7 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 				goto delete
 			}
 		}
-		if safeIndex == 0 {
-			closestMirror = m.Distance
-		} else if closestMirror > m.Distance {
-			closestMirror = m.Distance
-		}
-		if m.Distance > farthestMirror {
-			farthestMirror = m.Distance
-		}
-		mlist[safeIndex] = mlist[i]
+		mlist[safeIndex] = m
 		safeIndex++
 		continue
 	delete:
@@ -105,6 +157,29 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 
 	// Reduce the slice to its new size
 	mlist = mlist[:safeIndex]
+	return
+}
+
+// DefaultEngine is the default algorithm used for mirror selection. It
+// favors the closest mirrors and distributes the load between them.
+type DefaultEngine struct{}
+
+func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *filesystem.FileInfo, clientInfo network.GeoIPRecord) (mlist mirrors.Mirrors, excluded mirrors.Mirrors, err error) {
+	mlist, excluded, err = filterMirrors(ctx, cache, fileInfo, clientInfo)
+	if err != nil {
+		return
+	}
+
+	var closestMirror float32
+	var farthestMirror float32
+	for i, m := range mlist {
+		if i == 0 || closestMirror > m.Distance {
+			closestMirror = m.Distance
+		}
+		if m.Distance > farthestMirror {
+			farthestMirror = m.Distance
+		}
+	}
 
 	if !clientInfo.IsValid() {
 		// Shuffle the list
@@ -129,6 +204,33 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 
 	/* Weight distribution for random selection [Probabilistic weight] */
 
+	// Average bandwidth of the mirrors declaring one, used as the
+	// reference capacity for the others
+	var bandwidthTotal, bandwidthCount int
+	for _, m := range mlist {
+		if m.Bandwidth > 0 {
+			bandwidthTotal += m.Bandwidth
+			bandwidthCount++
+		}
+	}
+	averageBandwidth := 0.0
+	if bandwidthCount > 0 {
+		averageBandwidth = float64(bandwidthTotal) / float64(bandwidthCount)
+	}
+
+	// Average response time of the mirrors, used as the reference latency
+	var latencyTotal, latencyCount int64
+	for _, m := range mlist {
+		if m.Latency > 0 {
+			latencyTotal += m.Latency
+			latencyCount++
+		}
+	}
+	averageLatency := 0.0
+	if latencyCount > 0 {
+		averageLatency = float64(latencyTotal) / float64(latencyCount)
+	}
+
 	// Compute score for each mirror and return the mirrors eligible for weight distribution.
 	// This includes:
 	// - mirrors found in a 1.5x (configurable) range from the closest mirror
@@ -158,15 +260,22 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 			m.ComputedScore += baseScore / 2
 		}
 
-		floatingScore := float64(m.ComputedScore) + (float64(m.ComputedScore) * (float64(m.Score) / 100)) + 0.5
+		floatingScore := float64(m.ComputedScore) + (float64(m.ComputedScore) * (float64(m.Score) / 100))
+
+		// Favor the mirrors responding faster than the others
+		floatingScore = floatingScore*latencyFactor(m, averageLatency) + 0.5
 
 		// The minimum allowed score is 1
 		m.ComputedScore = int(math.Max(floatingScore, 1))
 
 		if m.ComputedScore > baseScore {
+			// Make the weight proportional to the capacity of the mirror
+			weight := float64(m.ComputedScore-baseScore) * capacityFactor(m, averageBandwidth) * quotaFactor(m) * feedbackFactor(m)
+
 			// The weight must always be > 0 to not break the randomization below
-			totalScore += m.ComputedScore - baseScore
-			weights[m.ID] = m.ComputedScore - baseScore
+			w := int(math.Max(weight+0.5, 1))
+			totalScore += w
+			weights[m.ID] = w
 		}
 	}
 
@@ -227,3 +336,197 @@ func (h DefaultEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *f
 	}
 	return
 }
+
+// capacityFactor returns the bandwidth of the mirror relative to the
+// average bandwidth. Mirrors without a declared bandwidth are average.
+func capacityFactor(m *mirrors.Mirror, averageBandwidth float64) float64 {
+	if m.Bandwidth <= 0 || averageBandwidth <= 0 {
+		return 1
+	}
+	return float64(m.Bandwidth) / averageBandwidth
+}
+
+// latencyFactor returns the ratio between the average latency and the
+// latency of the mirror raised to the power of the configured LatencyWeight.
+// The ratio is bounded to prevent a single mirror from taking all the load.
+func latencyFactor(m *mirrors.Mirror, averageLatency float64) float64 {
+	weight := float64(GetConfig().LatencyWeight)
+	if weight <= 0 || m.Latency <= 0 || averageLatency <= 0 {
+		return 1
+	}
+	ratio := math.Min(math.Max(averageLatency/float64(m.Latency), 0.1), 10)
+	return math.Pow(ratio, weight)
+}
+
+// quotaFactor progressively lowers the weight of a mirror
+// as it gets close to its monthly quota
+func quotaFactor(m *mirrors.Mirror) float64 {
+	usage := float64(m.QuotaUsage)
+	if usage <= quotaSoftLimit {
+		return 1
+	}
+	return math.Max((1-usage)/(1-quotaSoftLimit), 0)
+}
+
+// feedbackFactor lowers the weight of a mirror for which the
+// clients have recently reported failed or slow downloads
+func feedbackFactor(m *mirrors.Mirror) float64 {
+	if m.PenalizedUntil > time.Now().Unix() {
+		return feedbackPenalty
+	}
+	return 1
+}
+
+// RoundRobinEngine hands out the eligible mirrors in turn, regardless
+// of the location of the client.
+type RoundRobinEngine struct {
+	counter uint64
+}
+
+func (h *RoundRobinEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *filesystem.FileInfo, clientInfo network.GeoIPRecord) (mlist mirrors.Mirrors, excluded mirrors.Mirrors, err error) {
+	mlist, excluded, err = filterMirrors(ctx, cache, fileInfo, clientInfo)
+	if err != nil || len(mlist) == 0 {
+		return
+	}
+
+	// Use a stable order so that the rotation is meaningful
+	sort.Sort(mirrors.ByID{Mirrors: mlist})
+
+	n := int(atomic.AddUint64(&h.counter, 1) % uint64(len(mlist)))
+	mlist = append(mlist[n:], mlist[:n]...)
+
+	return finalizeSelection(ctx, mlist), excluded, nil
+}
+
+// LeastBytesEngine selects the mirrors having served the smallest
+// amount of data today.
+type LeastBytesEngine struct {
+	redis *database.Redis
+}
+
+func (h *LeastBytesEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *filesystem.FileInfo, clientInfo network.GeoIPRecord) (mlist mirrors.Mirrors, excluded mirrors.Mirrors, err error) {
+	mlist, excluded, err = filterMirrors(ctx, cache, fileInfo, clientInfo)
+	if err != nil || len(mlist) == 0 {
+		return
+	}
+
+	rconn := h.redis.Get()
+	defer rconn.Close()
+
+	args := redis.Args{}.Add(fmt.Sprintf("STATS_MIRROR_BYTES_%s", time.Now().Format("2006_01_02")))
+	for _, m := range mlist {
+		args = args.Add(m.ID)
+	}
+
+	bytes, err := redis.Strings(rconn.Do("HMGET", args...))
+	if err != nil {
+		return
+	}
+
+	served := make(map[string]int64, len(mlist))
+	for i, m := range mlist {
+		// Mirrors without any download today are missing from the hash
+		served[m.ID], _ = strconv.ParseInt(bytes[i], 10, 64)
+	}
+
+	// Shuffle first so that mirrors with equal counts are picked at random
+	for i := range mlist {
+		j := rand.Intn(i + 1)
+		mlist[i], mlist[j] = mlist[j], mlist[i]
+	}
+	sort.Stable(byServedBytes{mlist, served})
+
+	return finalizeSelection(ctx, mlist), excluded, nil
+}
+
+type byServedBytes struct {
+	mirrors.Mirrors
+	served map[string]int64
+}
+
+func (b byServedBytes) Less(i, j int) bool {
+	return b.served[b.Mirrors[i].ID] < b.served[b.Mirrors[j].ID]
+}
+
+// NearestEngine always selects the closest mirrors to the client
+// without any kind of load distribution.
+type NearestEngine struct{}
+
+func (h NearestEngine) Selection(ctx *Context, cache *mirrors.Cache, fileInfo *filesystem.FileInfo, clientInfo network.GeoIPRecord) (mlist mirrors.Mirrors, excluded mirrors.Mirrors, err error) {
+	mlist, excluded, err = filterMirrors(ctx, cache, fileInfo, clientInfo)
+	if err != nil || len(mlist) == 0 {
+		return
+	}
+
+	if clientInfo.IsValid() {
+		sort.Sort(mirrors.ByDistance{Mirrors: mlist})
+	} else {
+		// Without location the best we can do is to shuffle the list
+		for i := range mlist {
+			j := rand.Intn(i + 1)
+			mlist[i], mlist[j] = mlist[j], mlist[i]
+		}
+	}
+
+	return finalizeSelection(ctx, mlist), excluded, nil
+}
+
+// finalizeSelection moves the mirrors close to their monthly quota and then
+// the mirrors penalized by the feedback of the clients to the end of the list,
+// gives all the weight to the first mirror and reduces the number of mirrors
+// returned unless a mirrorlist is requested
+func finalizeSelection(ctx *Context, mlist mirrors.Mirrors) mirrors.Mirrors {
+	sort.Stable(byQuota{mlist})
+	sort.Stable(byPenalty{mlist, time.Now().Unix()})
+	mlist[0].Weight = 100
+	if !ctx.IsMirrorlist() {
+		mlist = mlist[:utils.Min(5, len(mlist))]
+	}
+	return mlist
+}
+
+type byQuota struct {
+	mirrors.Mirrors
+}
+
+func (b byQuota) Less(i, j int) bool {
+	return quotaFactor(&b.Mirrors[i]) > quotaFactor(&b.Mirrors[j])
+}
+
+type byPenalty struct {
+	mirrors.Mirrors
+	now int64
+}
+
+func (b byPenalty) Less(i, j int) bool {
+	return b.Mirrors[i].PenalizedUntil <= b.now && b.Mirrors[j].PenalizedUntil > b.now
+}
+
+// NewSelectionEngine returns the selection engine matching the given name
+func NewSelectionEngine(name string, r *database.Redis) (MirrorSelection, error) {
+	switch name {
+	case "", "default":
+		return DefaultEngine{}, nil
+	case "roundrobin":
+		return &RoundRobinEngine{}, nil
+	case "leastbytes":
+		return &LeastBytesEngine{redis: r}, nil
+	case "nearest":
+		return NearestEngine{}, nil
+	}
+	return nil, fmt.Errorf("unknown selection engine %s", name)
+}
+
+// isExcludedTier returns true if the mirrors of the given tier must never be
+// returned to the clients
+func isExcludedTier(tier int) bool {
+	if tier == 0 {
+		return false
+	}
+	for _, t := range GetConfig().ExcludedTiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"fmt"
+	"github.com/etix/geoip"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/filesystem"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/wsnipex/mirrorbits/network"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"github.com/rafaeljusto/redigomock"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const selectionPath = "/file.iso"
+
+// selectionMirror describes a mirror serving selectionPath
+type selectionMirror struct {
+	id                  string
+	latitude, longitude float32
+	penalizedUntil      int64
+}
+
+// prepareSelectionTest returns a cache in which the given mirrors are up,
+// enabled and serving an up-to-date copy of selectionPath
+func prepareSelectionTest(t *testing.T, list ...selectionMirror) (*redigomock.Conn, *database.Redis, *mirrors.Cache) {
+	if err := LoadTestConfig(""); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	mock, conn := PrepareRedisTest()
+	conn.ConnectPubsub()
+
+	mock.Command("HMGET", "FILE_"+selectionPath, "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b").
+		Expect([]interface{}{[]byte("1024"), nil, nil, nil, nil, nil, nil})
+
+	ids := []interface{}{}
+	for _, m := range list {
+		ids = append(ids, []byte(m.id))
+		mock.Command("HGETALL", "MIRROR_"+m.id).Expect([]interface{}{
+			[]byte("ID"), []byte(m.id),
+			[]byte("http"), []byte(fmt.Sprintf("http://%s.example.org/", m.id)),
+			[]byte("latitude"), []byte(fmt.Sprintf("%f", m.latitude)),
+			[]byte("longitude"), []byte(fmt.Sprintf("%f", m.longitude)),
+			[]byte("penalizedUntil"), []byte(fmt.Sprintf("%d", m.penalizedUntil)),
+			[]byte("enabled"), []byte("1"),
+			[]byte("up"), []byte("1"),
+		})
+		mock.Command("HMGET", fmt.Sprintf("FILEINFO_%s_%s", m.id, selectionPath), "size", "modTime", "sha1", "sha256", "md5").
+			Expect([]interface{}{[]byte("1024"), nil, nil, nil, nil})
+	}
+	mock.Command("SMEMBERS", "FILEMIRRORS_"+selectionPath).Expect(ids)
+
+	return mock, conn, mirrors.NewCache(conn)
+}
+
+// runSelection returns the identifiers of the mirrors selected by the engine
+func runSelection(t *testing.T, engine MirrorSelection, cache *mirrors.Cache, clientInfo network.GeoIPRecord) string {
+	ctx, _ := testContext(t, selectionPath)
+
+	mlist, excluded, err := engine.Selection(ctx, cache, &filesystem.FileInfo{Path: selectionPath}, clientInfo)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(excluded) != 0 {
+		t.Fatalf("No mirror should have been excluded, got %s (%s)", excluded[0].ID, excluded[0].ExcludeReason)
+	}
+	if len(mlist) == 0 || mlist[0].Weight != 100 {
+		t.Fatalf("Expected the first mirror to get all the weight")
+	}
+
+	var ids []string
+	for _, m := range mlist {
+		ids = append(ids, m.ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestRoundRobinEngine(t *testing.T) {
+	_, _, cache := prepareSelectionTest(t,
+		selectionMirror{id: "m3"},
+		selectionMirror{id: "m1"},
+		selectionMirror{id: "m2"},
+	)
+
+	engine := &RoundRobinEngine{}
+
+	// The mirrors are sorted by identifier and rotated on each request
+	for _, expected := range []string{"m2 m3 m1", "m3 m1 m2", "m1 m2 m3", "m2 m3 m1"} {
+		if ids := runSelection(t, engine, cache, network.GeoIPRecord{}); ids != expected {
+			t.Fatalf("Expected %s, got %s", expected, ids)
+		}
+	}
+}
+
+func TestLeastBytesEngine(t *testing.T) {
+	mock, conn, cache := prepareSelectionTest(t,
+		selectionMirror{id: "m1"},
+		selectionMirror{id: "m2"},
+		selectionMirror{id: "m3"},
+	)
+
+	// m2 hasn't served anything today
+	mock.Command("HMGET", "STATS_MIRROR_BYTES_"+time.Now().Format("2006_01_02"), "m1", "m2", "m3").
+		Expect([]interface{}{[]byte("300"), nil, []byte("100")})
+
+	engine := &LeastBytesEngine{redis: conn}
+
+	for i := 0; i < 10; i++ {
+		if ids := runSelection(t, engine, cache, network.GeoIPRecord{}); ids != "m2 m3 m1" {
+			t.Fatalf("Expected the mirrors ordered by served bytes, got %s", ids)
+		}
+	}
+}
+
+func TestNearestEngine(t *testing.T) {
+	_, _, cache := prepareSelectionTest(t,
+		selectionMirror{id: "newyork", latitude: 40.7, longitude: -74},
+		selectionMirror{id: "berlin", latitude: 52.5, longitude: 13.4},
+		selectionMirror{id: "brussels", latitude: 50.85, longitude: 4.35},
+		selectionMirror{id: "london", latitude: 51.5, longitude: -0.1, penalizedUntil: time.Now().Add(time.Hour).Unix()},
+	)
+
+	paris := network.GeoIPRecord{GeoIPRecord: &geoip.GeoIPRecord{Latitude: 48.85, Longitude: 2.35}}
+
+	// The penalized mirrors come last whatever their distance
+	for i := 0; i < 10; i++ {
+		if ids := runSelection(t, NearestEngine{}, cache, paris); ids != "brussels berlin newyork london" {
+			t.Fatalf("Expected the mirrors ordered by distance, got %s", ids)
+		}
+	}
+}
+
+func TestFinalizeSelection_Trim(t *testing.T) {
+	newList := func() mirrors.Mirrors {
+		mlist := mirrors.Mirrors{}
+		for i := 0; i < 7; i++ {
+			mlist = append(mlist, mirrors.Mirror{ID: fmt.Sprintf("m%d", i)})
+		}
+		return mlist
+	}
+
+	mlist := finalizeSelection(&Context{}, newList())
+	if len(mlist) != 5 || mlist[0].ID != "m0" || mlist[4].ID != "m4" {
+		t.Fatalf("Expected the first 5 mirrors, got %d", len(mlist))
+	}
+
+	// The whole list is returned for a mirrorlist
+	mlist = finalizeSelection(&Context{isMirrorList: true}, newList())
+	if len(mlist) != 7 {
+		t.Fatalf("Expected 7 mirrors, got %d", len(mlist))
+	}
+	for i, m := range mlist {
+		if m.ID != fmt.Sprintf("m%d", i) {
+			t.Fatalf("The order should have been kept, got %s at %d", m.ID, i)
+		}
+	}
+}
+
+func TestFinalizeSelection_Quota(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	mlist := mirrors.Mirrors{
+		{ID: "m1", QuotaUsage: 0.95},
+		{ID: "m2", QuotaUsage: 0.5},
+		{ID: "m3", QuotaUsage: 0.85},
+		{ID: "m4", PenalizedUntil: future},
+		{ID: "m5"},
+	}
+
+	mlist = finalizeSelection(&Context{isMirrorList: true}, mlist)
+
+	var ids []string
+	for _, m := range mlist {
+		ids = append(ids, m.ID)
+	}
+	if strings.Join(ids, " ") != "m2 m5 m3 m1 m4" {
+		t.Fatalf("Expected the mirrors close to their quota before the penalized ones, got %v", ids)
+	}
+}
+
+func TestCapacityFactor(t *testing.T) {
+	tests := []struct {
+		bandwidth int
+		average   float64
+		expected  float64
+	}{
+		{0, 100, 1},
+		{100, 0, 1},
+		{100, 100, 1},
+		{200, 100, 2},
+		{50, 100, 0.5},
+	}
+
+	for _, test := range tests {
+		m := &mirrors.Mirror{Bandwidth: test.bandwidth}
+		if f := capacityFactor(m, test.average); f != test.expected {
+			t.Errorf("capacityFactor(%d, %f): expected %f, got %f", test.bandwidth, test.average, test.expected, f)
+		}
+	}
+}
+
+func TestQuotaFactor(t *testing.T) {
+	tests := []struct {
+		usage    float32
+		expected float64
+	}{
+		{0, 1},
+		{0.5, 1},
+		{quotaSoftLimit, 1},
+		{0.9, 0.5},
+		{1, 0},
+		{1.5, 0},
+	}
+
+	for _, test := range tests {
+		m := &mirrors.Mirror{QuotaUsage: test.usage}
+		if f := quotaFactor(m); math.Abs(f-test.expected) > 1e-6 {
+			t.Errorf("quotaFactor(%f): expected %f, got %f", test.usage, test.expected, f)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/wsnipex/mirrorbits/pgp"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	// Size of the signatures cache, in bytes
+	signatureCacheSize = 1024000
+)
+
+var (
+	errNoSigningKey = errors.New("no signing key")
+)
+
+// signature is an ASCII-armored signature stored in the cache
+type signature []byte
+
+func (s signature) Size() int {
+	return len(s)
+}
+
+// signingKeyStore holds the OpenPGP key used to sign the checksums
+// and the signatures already made with it
+type signingKeyStore struct {
+	sync.RWMutex
+	key        *pgp.PrivateKey
+	signatures *mirrors.LRUCache
+}
+
+// Load (or reload) the signing key set in the configuration.
+// The current key is kept in case of error.
+func (s *signingKeyStore) Load() error {
+	var key *pgp.PrivateKey
+
+	if path := GetConfig().ChecksumSigningKey; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		key, err = pgp.ReadPrivateKey(f, []byte(GetConfig().ChecksumKeyPassphrase))
+		if err != nil {
+			return err
+		}
+		log.Infof("Checksums will be signed with the key %s", key)
+	}
+
+	s.Lock()
+	s.key = key
+	s.signatures = mirrors.NewLRUCache(signatureCacheSize)
+	s.Unlock()
+	return nil
+}
+
+// Sign returns the ASCII-armored detached signature of the given data,
+// reusing the previous signature of the same content
+func (s *signingKeyStore) Sign(data []byte) ([]byte, error) {
+	s.RLock()
+	key, signatures := s.key, s.signatures
+	s.RUnlock()
+
+	if key == nil {
+		return nil, errNoSigningKey
+	}
+
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+
+	if sig, ok := signatures.Get(id); ok {
+		return sig.(signature), nil
+	}
+
+	sig, err := key.ArmoredSign(data)
+	if err != nil {
+		return nil, err
+	}
+	signatures.Set(id, signature(sig))
+	return sig, nil
+}
+
+// writeChecksums writes the generated checksums, or their ASCII-armored
+// detached signature if it has been requested
+func (h *HTTP) writeChecksums(w http.ResponseWriter, ctx *Context, checksums []byte) {
+	if !ctx.IsSignature() {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write(checksums)
+		return
+	}
+
+	sig, err := h.signingKey.Sign(checksums)
+	if err == errNoSigningKey {
+		http.Error(w, "Signatures not available", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf("Cannot sign the checksums: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-signature")
+	w.Write(sig)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	. "github.com/wsnipex/mirrorbits/config"
+	"sync"
+)
+
+var (
+	errNoCertificate = errors.New("no certificate loaded")
+)
+
+// certificateStore holds the certificate served by the TLS listener.
+// The certificate can be replaced at any time without interrupting
+// the established connections.
+type certificateStore struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// tlsEnabled returns true if the configuration provides a certificate
+func tlsEnabled() bool {
+	return GetConfig().TLSCertificate != "" && GetConfig().TLSKey != ""
+}
+
+// Load (or reload) the certificate and key set in the configuration.
+// The current certificate is kept in case of error.
+func (c *certificateStore) Load() error {
+	cert, err := tls.LoadX509KeyPair(GetConfig().TLSCertificate, GetConfig().TLSKey)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.cert = &cert
+	c.Unlock()
+	return nil
+}
+
+// Loaded returns true if a certificate has already been loaded
+func (c *certificateStore) Loaded() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert != nil
+}
+
+// GetCertificate returns the current certificate for the TLS handshakes
+func (c *certificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cert == nil {
+		return nil, errNoCertificate
+	}
+	return c.cert, nil
+}
+
+func (c *certificateStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for the given common
+// name and its key in the cert.pem and key.pem files of the directory
+func writeCertificate(t *testing.T, dir, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName returns the common name of the certificate served by the store
+func servedName(t *testing.T, c *certificateStore) string {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Invalid certificate: %s", err.Error())
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrorbits-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = LoadTestConfig(fmt.Sprintf("TLSCertificate: %s\nTLSKey: %s\n",
+		filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")))
+	if err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	var c certificateStore
+
+	if c.Loaded() {
+		t.Fatalf("No certificate should be loaded yet")
+	}
+	if _, err := c.GetCertificate(nil); err != errNoCertificate {
+		t.Fatalf("Expected errNoCertificate, got %v", err)
+	}
+	if err := c.Load(); err == nil {
+		t.Fatalf("Error expected without any certificate")
+	}
+
+	writeCertificate(t, dir, "first.example.org")
+	if err := c.Load(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !c.Loaded() {
+		t.Fatalf("The certificate should have been loaded")
+	}
+	if name := servedName(t, &c); name != "first.example.org" {
+		t.Fatalf("Expected the first certificate, got %s", name)
+	}
+
+	// The renewed certificate is served once reloaded
+	writeCertificate(t, dir, "second.example.org")
+	if name := servedName(t, &c); name != "first.example.org" {
+		t.Fatalf("The certificate should only change on reload, got %s", name)
+	}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if name := servedName(t, &c); name != "second.example.org" {
+		t.Fatalf("Expected the second certificate, got %s", name)
+	}
+
+	// The current certificate is kept if the new one is invalid
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(); err == nil {
+		t.Fatalf("Error expected with an invalid key")
+	}
+	if name := servedName(t, &c); name != "second.example.org" {
+		t.Fatalf("Expected the second certificate to be kept, got %s", name)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/core"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/wsnipex/mirrorbits/mirrors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/op/go-logging"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+/*
+	Date of the last email sent to the admin of each mirror:
+	ADMIN_NOTIFICATIONS					= mirror ID -> unix timestamp
+*/
+
+const (
+	notificationsKey = "ADMIN_NOTIFICATIONS"
+)
+
+var (
+	log = logging.MustGetLogger("main")
+
+	smtpTimeout = 30 * time.Second
+)
+
+// Mailer emails the admin of the mirrors being down or failing
+// to sync for longer than the configured threshold
+type Mailer struct {
+	redis *database.Redis
+}
+
+// NewMailer returns a new instance of the mailer
+func NewMailer(r *database.Redis) *Mailer {
+	return &Mailer{
+		redis: r,
+	}
+}
+
+// Enabled returns true if the admin notifications are configured
+func Enabled() bool {
+	return GetConfig().AdminNotifications.SMTPServer != "" && GetConfig().AdminNotifications.From != ""
+}
+
+// Check emails the admin of the given mirror if it has a problem
+// for too long and it has not already been notified recently
+func (m *Mailer) Check(mirror mirrors.Mirror) error {
+	conf := GetConfig().AdminNotifications
+	if !Enabled() || !mirror.Enabled {
+		return nil
+	}
+
+	conn := m.redis.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	problem := mirrorProblem(mirror, now.Unix(), int64(conf.Threshold*60))
+
+	if problem == nil {
+		// Send a new notification as soon as the next problem appears.
+		// Most mirrors are healthy, don't write on every check.
+		notified, err := redis.Bool(conn.Do("HEXISTS", notificationsKey, mirror.ID))
+		if err != nil || !notified {
+			return err
+		}
+		_, err = conn.Do("HDEL", notificationsKey, mirror.ID)
+		return err
+	}
+
+	if mirror.AdminEmail == "" || mirror.NoAdminEmails {
+		return nil
+	}
+
+	lastSent, err := redis.Int64(conn.Do("HGET", notificationsKey, mirror.ID))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if lastSent > 0 && now.Unix()-lastSent < int64(conf.ResendInterval*3600) {
+		return nil
+	}
+
+	msg := formatMessage(conf.From, mirror, problem, now)
+	err = SendMail(conf.SMTPServer, conf.SMTPUsername, conf.SMTPPassword, conf.From, mirror.AdminEmail, msg)
+	if err != nil {
+		return fmt.Errorf("cannot email the admin of %s: %s", mirror.ID, err.Error())
+	}
+
+	log.Noticef("Admin of %s notified by email: %s", mirror.ID, problem.summary)
+
+	_, err = conn.Do("HSET", notificationsKey, mirror.ID, now.Unix())
+	return err
+}
+
+// problem describes an issue affecting a mirror
+type problem struct {
+	summary string // e.g. "down since ..."
+	impact  string // Consequence for the clients of the mirror
+}
+
+// mirrorProblem returns the problem affecting the mirror for more than
+// threshold seconds or nil if there is none
+func mirrorProblem(mirror mirrors.Mirror, now, threshold int64) *problem {
+	if !mirror.Up && mirror.StateSince > 0 && now-mirror.StateSince >= threshold {
+		return &problem{
+			summary: fmt.Sprintf("down since %s", formatTime(mirror.StateSince)),
+			impact:  "The mirror will not receive any traffic until the problem is resolved.",
+		}
+	}
+
+	// The last sync time is set when a scan starts, only rely on
+	// the failures counter to tell whether the scans are failing
+	if mirror.ScanFailures == 0 {
+		return nil
+	}
+	since := mirror.ScanFailedSince
+	if since == 0 {
+		since = mirror.LastSuccessfulSync
+	}
+	if since == 0 || now-since < threshold {
+		return nil
+	}
+
+	p := &problem{
+		summary: fmt.Sprintf("failing to sync since %s", formatTime(since)),
+		impact: "The files added or modified since the last successful sync will not be served " +
+			"by the mirror until the problem is resolved.",
+	}
+	if mirror.LastSuccessfulSync == 0 {
+		p.impact = "The mirror will not receive any traffic until it has been synced successfully."
+	}
+	return p
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format("2006-01-02 15:04:05 MST")
+}
+
+func formatMessage(from string, mirror mirrors.Mirror, p *problem, date time.Time) []byte {
+	var b bytes.Buffer
+
+	name := mirror.AdminName
+	if name == "" {
+		name = "Hello"
+	}
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", mirror.AdminEmail)
+	fmt.Fprintf(&b, "Subject: Mirror %s is %s\r\n", mirror.ID, p.summary)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "User-Agent: Mirrorbits/%s\r\n", core.VERSION)
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "%s,\r\n\r\n", name)
+	fmt.Fprintf(&b, "Your mirror %s (%s) is %s.\r\n", mirror.ID, mirror.MainURL(), p.summary)
+	if mirror.ExcludeReason != "" {
+		fmt.Fprintf(&b, "Last error: %s\r\n", mirror.ExcludeReason)
+	}
+	if mirror.ScanFailures > 0 {
+		lastSync := "never"
+		if mirror.LastSuccessfulSync > 0 {
+			lastSync = formatTime(mirror.LastSuccessfulSync)
+		}
+		fmt.Fprintf(&b, "Last successful sync: %s\r\n", lastSync)
+	}
+	fmt.Fprintf(&b, "\r\n%s\r\n", p.impact)
+	fmt.Fprintf(&b, "Please reply to this email if you do not wish to receive these notifications.\r\n")
+
+	return b.Bytes()
+}
+
+// SendMail sends the message through the given SMTP server. The connection
+// is upgraded to TLS if the server supports it and the authentication is
+// only attempted when a username is set.
+func SendMail(server, username, password, from, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", server, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if username != "" {
+		if err = c.Auth(smtp.PlainAuth("", username, password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range strings.Split(to, ",") {
+		if err = c.Rcpt(strings.TrimSpace(addr)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
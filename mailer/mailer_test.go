@@ -0,0 +1,209 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mailer
+
+import (
+	"github.com/wsnipex/mirrorbits/mirrors"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal SMTP server recording the received messages
+type smtpStandIn struct {
+	listener net.Listener
+	rcpt     []string
+	data     chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := &smtpStandIn{
+		listener: l,
+		data:     make(chan string, 1),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *smtpStandIn) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, line)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			b, _ := tp.ReadDotBytes()
+			s.data <- string(b)
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	s := newSMTPStandIn(t)
+	defer s.listener.Close()
+
+	mirror := mirrors.Mirror{
+		ID:            "m1",
+		HttpURL:       "http://m1.mirror/",
+		AdminName:     "John",
+		AdminEmail:    "admin@m1.mirror",
+		ExcludeReason: "Unreachable",
+	}
+
+	p := &problem{
+		summary: "down since yesterday",
+		impact:  "The mirror will not receive any traffic until the problem is resolved.",
+	}
+	msg := formatMessage("mirrors@example.org", mirror, p, time.Now())
+	if err := SendMail(s.listener.Addr().String(), "", "", "mirrors@example.org", mirror.AdminEmail, msg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	data := <-s.data
+	if !strings.Contains(data, "Subject: Mirror m1 is down since yesterday") {
+		t.Fatalf("Subject not found in:\n%s", data)
+	}
+	if !strings.Contains(data, "Last error: Unreachable") {
+		t.Fatalf("Exclude reason not found in:\n%s", data)
+	}
+	if !strings.Contains(data, p.impact) {
+		t.Fatalf("Impact not found in:\n%s", data)
+	}
+	if strings.Contains(data, "Last successful sync") {
+		t.Fatalf("Unexpected sync details in:\n%s", data)
+	}
+	if len(s.rcpt) != 1 || !strings.Contains(s.rcpt[0], "admin@m1.mirror") {
+		t.Fatalf("Unexpected recipients: %v", s.rcpt)
+	}
+}
+
+func TestMirrorProblem(t *testing.T) {
+	now := int64(100000)
+
+	m := mirrors.Mirror{Up: true, LastSync: now - 60, LastSuccessfulSync: now - 60}
+	if p := mirrorProblem(m, now, 3600); p != nil {
+		t.Fatalf("Expected no problem, got %s", p.summary)
+	}
+
+	m = mirrors.Mirror{Up: false, StateSince: now - 60}
+	if p := mirrorProblem(m, now, 3600); p != nil {
+		t.Fatalf("Expected no problem below the threshold, got %s", p.summary)
+	}
+
+	m = mirrors.Mirror{Up: false, StateSince: now - 7200}
+	if p := mirrorProblem(m, now, 3600); p == nil || !strings.HasPrefix(p.summary, "down since") ||
+		!strings.Contains(p.impact, "any traffic") {
+		t.Fatalf("Expected the mirror to be down, got %+v", p)
+	}
+
+	// A scan is running, the last sync time is newer than the last successful one
+	m = mirrors.Mirror{Up: true, LastSync: now - 60, LastSuccessfulSync: now - 7200}
+	if p := mirrorProblem(m, now, 3600); p != nil {
+		t.Fatalf("Expected no problem during a scan, got %s", p.summary)
+	}
+
+	m = mirrors.Mirror{Up: true, LastSync: now - 60, LastSuccessfulSync: now - 7200, ScanFailures: 2, ScanFailedSince: now - 600}
+	if p := mirrorProblem(m, now, 3600); p != nil {
+		t.Fatalf("Expected no problem below the threshold, got %s", p.summary)
+	}
+
+	m.ScanFailedSince = now - 3600
+	if p := mirrorProblem(m, now, 3600); p == nil || !strings.HasPrefix(p.summary, "failing to sync since") ||
+		strings.Contains(p.impact, "any traffic") {
+		t.Fatalf("Expected a sync failure, got %+v", p)
+	}
+
+	// Failures recorded before the first failure time was tracked
+	m = mirrors.Mirror{Up: true, LastSync: now - 60, LastSuccessfulSync: now - 7200, ScanFailures: 1}
+	if p := mirrorProblem(m, now, 3600); p == nil || !strings.HasPrefix(p.summary, "failing to sync") {
+		t.Fatalf("Expected a sync failure, got %+v", p)
+	}
+
+	// The mirror was never synced
+	m = mirrors.Mirror{Up: true, LastSync: now - 60, ScanFailures: 5, ScanFailedSince: now - 7200}
+	if p := mirrorProblem(m, now, 3600); p == nil || !strings.HasPrefix(p.summary, "failing to sync") ||
+		!strings.Contains(p.impact, "synced successfully") {
+		t.Fatalf("Expected a sync failure, got %+v", p)
+	}
+}
+
+func TestFormatMessage(t *testing.T) {
+	now := int64(100000)
+	mirror := mirrors.Mirror{
+		ID:              "m1",
+		HttpURL:         "http://m1.mirror/",
+		AdminEmail:      "admin@m1.mirror",
+		Up:              true,
+		ScanFailures:    3,
+		ScanFailedSince: now - 7200,
+	}
+
+	msg := string(formatMessage("mirrors@example.org", mirror, mirrorProblem(mirror, now, 3600), time.Unix(now, 0)))
+	if !strings.Contains(msg, "Hello,") {
+		t.Fatalf("Greeting not found in:\n%s", msg)
+	}
+	if !strings.Contains(msg, "Last successful sync: never") {
+		t.Fatalf("Last successful sync not found in:\n%s", msg)
+	}
+	if strings.Contains(msg, "until the problem is resolved") {
+		t.Fatalf("Unexpected impact in:\n%s", msg)
+	}
+}
+
+func TestMailer_CheckHealthy(t *testing.T) {
+	err := LoadTestConfig("AdminNotifications:\n    SMTPServer: localhost:25\n    From: mirrors@example.org\n")
+	if err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err)
+	}
+
+	mock, conn := PrepareRedisTest()
+	m := NewMailer(conn)
+
+	mock.Command("HEXISTS", notificationsKey, "m1").Expect(int64(0))
+	mock.Command("HEXISTS", notificationsKey, "m2").Expect(int64(1))
+	hdel1 := mock.Command("HDEL", notificationsKey, "m1")
+	hdel2 := mock.Command("HDEL", notificationsKey, "m2").Expect(int64(1))
+
+	for _, id := range []string{"m1", "m2"} {
+		if err := m.Check(mirrors.Mirror{ID: id, Enabled: true, Up: true}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	if mock.Stats(hdel1) != 0 {
+		t.Fatalf("Nothing to delete for m1")
+	}
+	if mock.Stats(hdel2) != 1 {
+		t.Fatalf("The notification of m2 should have been forgotten")
+	}
+}
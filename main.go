@@ -19,7 +19,6 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
-	"strings"
 	"syscall"
 	"time"
 )
@@ -92,7 +91,7 @@ func main() {
 					os.Exit(0)
 				case syscall.SIGQUIT:
 					m.Stop()
-					if h.Listener != nil {
+					if len(h.Listeners()) > 0 {
 						log.Notice("Waiting for running tasks to finish...")
 						h.Stop(5 * time.Second)
 					} else {
@@ -100,15 +99,13 @@ func main() {
 						os.Exit(0)
 					}
 				case syscall.SIGHUP:
-					listenAddress := GetConfig().ListenAddress
 					if err := ReloadConfig(); err != nil {
 						log.Warningf("SIGHUP Received: %s\n", err)
 					} else {
 						log.Notice("SIGHUP Received: Reloading configuration...")
 					}
-					if GetConfig().ListenAddress != listenAddress {
-						h.Restarting = true
-						h.Stop(1 * time.Second)
+					if h.ListenersChanged() {
+						h.Restart(1 * time.Second)
 					}
 					h.Reload()
 				case syscall.SIGUSR1:
@@ -116,7 +113,7 @@ func main() {
 					logs.ReloadLogs()
 				case syscall.SIGUSR2:
 					log.Notice("SIGUSR2 Received: Seamless binary upgrade...")
-					err := process.Relaunch(*h.Listener)
+					err := process.Relaunch(h.Listeners()...)
 					if err != nil {
 						log.Errorf("Relaunch failed: %s\n", err)
 					} else {
@@ -127,15 +124,18 @@ func main() {
 			}
 		}()
 
-		// Recover an existing listener (see process.go)
+		// Recover the existing listeners (see process.go)
 		if l, ppid, err := process.Recover(); err == nil {
-			h.SetListener(l)
+			h.SetListeners(l)
 			go func() {
 				time.Sleep(500 * time.Millisecond)
 				process.KillParent(ppid)
 			}()
 		}
 
+		/* Start the admin API (if enabled) */
+		go h.RunAdminServer()
+
 		/* Finally start the HTTP server */
 		var err error
 		for {
@@ -144,11 +144,6 @@ func main() {
 				h.Restarting = false
 				continue
 			}
-			// This check is ugly but there's still no way to detect this error by type
-			if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
-				// This error is expected during a graceful shutdown
-				err = nil
-			}
 			break
 		}
 
@@ -0,0 +1,221 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Minimal implementation of the Prometheus text exposition format (v0.0.4).
+	Only counters and gauges are supported, values are kept in memory and
+	collectors can be registered to refresh gauges right before a scrape.
+*/
+
+const (
+	counterType = "counter"
+	gaugeType   = "gauge"
+)
+
+var (
+	registry = &Registry{
+		metrics: make(map[string]*Metric),
+	}
+)
+
+// Registry holds a set of metrics and collectors
+type Registry struct {
+	sync.Mutex
+	metrics    map[string]*Metric
+	collectors []func()
+}
+
+// Metric is a family of samples sharing the same name and label names
+type Metric struct {
+	sync.Mutex
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	samples map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounter registers a new counter within the default registry
+func NewCounter(name, help string, labels ...string) *Metric {
+	return registry.register(name, help, counterType, labels)
+}
+
+// NewGauge registers a new gauge within the default registry
+func NewGauge(name, help string, labels ...string) *Metric {
+	return registry.register(name, help, gaugeType, labels)
+}
+
+// RegisterCollector adds a function called before each scrape of
+// the default registry. It's meant to refresh gauges reflecting a
+// state that is too expensive or impractical to track continuously.
+func RegisterCollector(f func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.collectors = append(registry.collectors, f)
+}
+
+// Handler returns an http.Handler serving the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write writes all the metrics of the default registry to w
+func Write(w io.Writer) error {
+	return registry.Write(w)
+}
+
+func (r *Registry) register(name, help, typ string, labels []string) *Metric {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+
+	m := &Metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Write runs the collectors then writes all the metrics to w
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	collectors := make([]func(), len(r.collectors))
+	copy(collectors, r.collectors)
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.Unlock()
+
+	for _, c := range collectors {
+		c()
+	}
+
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for _, name := range names {
+		r.Lock()
+		m := r.metrics[name]
+		r.Unlock()
+		m.write(b)
+	}
+	return b.Flush()
+}
+
+// Inc increments the sample matching the given label values by one
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Add adds the given value to the sample matching the label values
+func (m *Metric) Add(value float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.get(labelValues).value += value
+}
+
+// Set sets the sample matching the label values to the given value
+func (m *Metric) Set(value float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.get(labelValues).value = value
+}
+
+// Delete removes the sample matching the given label values
+func (m *Metric) Delete(labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.samples, strings.Join(labelValues, "\xff"))
+}
+
+// Reset removes all the samples of the metric
+func (m *Metric) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.samples = make(map[string]*sample)
+}
+
+func (m *Metric) get(labelValues []string) *sample {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{
+			labelValues: append([]string(nil), labelValues...),
+		}
+		m.samples[key] = s
+	}
+	return s
+}
+
+func (m *Metric) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+
+	keys := make([]string, 0, len(m.samples))
+	for k := range m.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.samples[k]
+		fmt.Fprint(w, m.name)
+		if len(m.labels) > 0 {
+			fmt.Fprint(w, "{")
+			for i, l := range m.labels {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabelValue(s.labelValues[i]))
+			}
+			fmt.Fprint(w, "}")
+		}
+		fmt.Fprintf(w, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func escapeHelp(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return strings.Replace(s, "\n", "\\n", -1)
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return strings.Replace(s, "\n", "\\n", -1)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := &Registry{
+		metrics: make(map[string]*Metric),
+	}
+
+	c := r.register("test_requests_total", "Number of requests", counterType, []string{"type"})
+	g := r.register("test_backlog", "Current backlog", gaugeType, nil)
+
+	c.Inc("REDIRECT")
+	c.Inc("REDIRECT")
+	c.Add(3, "JSON")
+	g.Set(42)
+
+	collected := false
+	r.collectors = append(r.collectors, func() {
+		collected = true
+	})
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if !collected {
+		t.Fatalf("Collector not called")
+	}
+
+	expected := `# HELP test_backlog Current backlog
+# TYPE test_backlog gauge
+test_backlog 42
+# HELP test_requests_total Number of requests
+# TYPE test_requests_total counter
+test_requests_total{type="JSON"} 3
+test_requests_total{type="REDIRECT"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestMetric_Delete(t *testing.T) {
+	r := &Registry{
+		metrics: make(map[string]*Metric),
+	}
+
+	g := r.register("test_up", "Up", gaugeType, []string{"mirror"})
+	g.Set(1, "m1")
+	g.Set(0, "m2")
+	g.Delete("m1")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+
+	if strings.Contains(buf.String(), "m1") {
+		t.Fatalf("Sample not deleted")
+	}
+	if !strings.Contains(buf.String(), `test_up{mirror="m2"} 0`) {
+		t.Fatalf("Sample missing")
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	if r := escapeLabelValue("a\"b\\c\nd"); r != `a\"b\\c\nd` {
+		t.Fatalf("Unexpected escaping: %s", r)
+	}
+}
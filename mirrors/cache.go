@@ -12,6 +12,7 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -25,6 +26,9 @@ type Cache struct {
 	mCache   *LRUCache
 	fimCache *LRUCache
 
+	mbLock  sync.Mutex
+	mbCache map[string]monthlyBytesValue
+
 	mirrorUpdateEvent      chan string
 	fileUpdateEvent        chan string
 	mirrorFileUpdateEvent  chan string
@@ -47,6 +51,16 @@ func (f *fileMirrorValue) Size() int {
 	return cap(f.value)
 }
 
+// monthlyBytesTTL is the time during which the monthly traffic of a mirror
+// is served from the cache
+const monthlyBytesTTL = 10 * time.Second
+
+type monthlyBytesValue struct {
+	bytes   int64
+	month   string
+	expires time.Time
+}
+
 type mirrorValue struct {
 	value Mirror
 }
@@ -70,6 +84,7 @@ func NewCache(r *database.Redis) *Cache {
 	c.fmCache = NewLRUCache(2048000)
 	c.mCache = NewLRUCache(1024000)
 	c.fimCache = NewLRUCache(4096000)
+	c.mbCache = make(map[string]monthlyBytesValue)
 
 	// Create event channels
 	c.mirrorUpdateEvent = make(chan string, 10)
@@ -110,6 +125,10 @@ func (c *Cache) Clear() {
 	c.fmCache.Clear()
 	c.mCache.Clear()
 	c.fimCache.Clear()
+
+	c.mbLock.Lock()
+	c.mbCache = make(map[string]monthlyBytesValue)
+	c.mbLock.Unlock()
 }
 
 // GetFileInfo returns file information for a given file either from the cache
@@ -129,7 +148,7 @@ func (c *Cache) fetchFileInfo(path string) (f filesystem.FileInfo, err error) {
 	defer rconn.Close()
 	f.Path = path // Path is not stored in the object instance in redis
 
-	reply, err := redis.Strings(rconn.Do("HMGET", fmt.Sprintf("FILE_%s", path), "size", "modTime", "sha1", "sha256", "md5"))
+	reply, err := redis.Strings(rconn.Do("HMGET", fmt.Sprintf("FILE_%s", path), "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b"))
 	if err != nil {
 		return
 	}
@@ -139,6 +158,8 @@ func (c *Cache) fetchFileInfo(path string) (f filesystem.FileInfo, err error) {
 	f.Sha1 = reply[2]
 	f.Sha256 = reply[3]
 	f.Md5 = reply[4]
+	f.Sha512 = reply[5]
+	f.Blake2b = reply[6]
 	c.fiCache.Set(path, &fileInfoValue{value: f})
 	return
 }
@@ -240,8 +261,9 @@ func (c *Cache) fetchFileInfoMirror(id, path string) (f filesystem.FileInfo, err
 		return
 	}
 
-	// Note: as of today, only the size is stored by the scanners
-	// all other fields are left blank.
+	// Note: as of today, only the size and the modification time
+	// (when available) are stored by the scanners, all other fields
+	// are left blank.
 
 	f.Size, _ = strconv.ParseInt(reply[0], 10, 64)
 	f.ModTime, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", reply[1])
@@ -267,3 +289,65 @@ func (c *Cache) GetMirror(identifier string) (mirror Mirror, err error) {
 	}
 	return
 }
+
+// LRUCaches returns the underlying LRU caches indexed by their name
+func (c *Cache) LRUCaches() map[string]*LRUCache {
+	return map[string]*LRUCache{
+		"fileinfo":       c.fiCache,
+		"filemirrors":    c.fmCache,
+		"mirror":         c.mCache,
+		"fileinfomirror": c.fimCache,
+	}
+}
+
+// GetMonthlyBytes returns the amount of data served by each of the given
+// mirrors since the beginning of the month. The values are kept in the cache
+// for a few seconds to avoid querying the database on each redirection.
+func (c *Cache) GetMonthlyBytes(ids []string) (map[string]int64, error) {
+	traffic := make(map[string]int64, len(ids))
+	if len(ids) == 0 {
+		return traffic, nil
+	}
+
+	now := time.Now()
+	month := now.Format("2006_01")
+
+	missing := make([]string, 0, len(ids))
+	c.mbLock.Lock()
+	for _, id := range ids {
+		v, ok := c.mbCache[id]
+		if ok && v.month == month && now.Before(v.expires) {
+			traffic[id] = v.bytes
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	c.mbLock.Unlock()
+
+	if len(missing) == 0 {
+		return traffic, nil
+	}
+
+	rconn := c.r.Get()
+	defer rconn.Close()
+
+	args := redis.Args{}.Add(fmt.Sprintf("STATS_MIRROR_BYTES_%s", month))
+	args = args.AddFlat(missing)
+
+	reply, err := redis.Strings(rconn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mbLock.Lock()
+	defer c.mbLock.Unlock()
+	for i, id := range missing {
+		traffic[id], _ = strconv.ParseInt(reply[i], 10, 64)
+		c.mbCache[id] = monthlyBytesValue{
+			bytes:   traffic[id],
+			month:   month,
+			expires: now.Add(monthlyBytesTTL),
+		}
+	}
+	return traffic, nil
+}
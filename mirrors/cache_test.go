@@ -81,6 +81,8 @@ func TestCache_fetchFileInfo(t *testing.T) {
 		ModTime: time.Now(),
 		Sha1:    "3ce963aea2d6f23fe915063f8bba21888db0ddfa",
 		Sha256:  "1c8e38c7e03e4d117eba4f82afaf6631a9b79f4c1e9dec144d4faf1d109aacda",
+		Sha512:  "3a6fd74c0e3cfa3ac1d7e5f5a3b1f33a1fa09b6ac2b2ab3b7a3b6b9c2b4c86cdbd5f3b0e3f9a8c5e21af47b58f9e7d25d6b4c9b8e3f1a2d3c4b5a6978877665544",
+		Blake2b: "bdeea863f3e2554ee163dd0162fbff80c316786a2c645fc540db6bb73045467ece5ff950c967947539c5daf2e871b8d1c2acb658f52f00e887fa7232dc9264cc",
 		Md5:     "2c98ec39f49da6ddd9cfa7b1d7342afe",
 	}
 
@@ -89,12 +91,14 @@ func TestCache_fetchFileInfo(t *testing.T) {
 		t.Fatalf("Error expected, mock command not yet registered")
 	}
 
-	cmd_get_fileinfo := mock.Command("HMGET", "FILE_"+testfile.Path, "size", "modTime", "sha1", "sha256", "md5").Expect([]interface{}{
+	cmd_get_fileinfo := mock.Command("HMGET", "FILE_"+testfile.Path, "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b").Expect([]interface{}{
 		[]byte(strconv.FormatInt(testfile.Size, 10)),
 		[]byte(testfile.ModTime.String()),
 		[]byte(testfile.Sha1),
 		[]byte(testfile.Sha256),
 		[]byte(testfile.Md5),
+		[]byte(testfile.Sha512),
+		[]byte(testfile.Blake2b),
 	})
 
 	f, err = c.fetchFileInfo(testfile.Path)
@@ -124,6 +128,12 @@ func TestCache_fetchFileInfo(t *testing.T) {
 	if f.Md5 != testfile.Md5 {
 		t.Fatalf("Md5 doesn't match, expected %#v got %#v", testfile.Md5, f.Md5)
 	}
+	if f.Sha512 != testfile.Sha512 {
+		t.Fatalf("Sha512 doesn't match, expected %#v got %#v", testfile.Sha512, f.Sha512)
+	}
+	if f.Blake2b != testfile.Blake2b {
+		t.Fatalf("Blake2b doesn't match, expected %#v got %#v", testfile.Blake2b, f.Blake2b)
+	}
 
 	_, ok := c.fiCache.Get(testfile.Path)
 	if !ok {
@@ -151,12 +161,14 @@ func TestCache_GetFileInfo(t *testing.T) {
 		t.Fatalf("Error expected, mock command not yet registered")
 	}
 
-	cmd_get_fileinfo := mock.Command("HMGET", "FILE_"+testfile.Path, "size", "modTime", "sha1", "sha256", "md5").Expect([]interface{}{
+	cmd_get_fileinfo := mock.Command("HMGET", "FILE_"+testfile.Path, "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b").Expect([]interface{}{
 		[]byte(strconv.FormatInt(testfile.Size, 10)),
 		[]byte(testfile.ModTime.String()),
 		[]byte(testfile.Sha1),
 		[]byte(testfile.Sha256),
 		[]byte(testfile.Md5),
+		[]byte(testfile.Sha512),
+		[]byte(testfile.Blake2b),
 	})
 
 	f, err := c.GetFileInfo(testfile.Path)
@@ -470,3 +482,57 @@ func TestCache_GetMirrors(t *testing.T) {
 		t.Fatalf("Distance between user and m2 is wrong, got %d, expected 334", int(mirrors[1].Distance))
 	}
 }
+
+func TestCache_GetMonthlyBytes(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	conn.ConnectPubsub()
+
+	c := NewCache(conn)
+
+	traffic, err := c.GetMonthlyBytes(nil)
+	if err != nil || len(traffic) != 0 {
+		t.Fatalf("Expected an empty result")
+	}
+
+	key := fmt.Sprintf("STATS_MIRROR_BYTES_%s", time.Now().Format("2006_01"))
+	mock.Command("HMGET", key, "m1", "m2").Expect([]interface{}{[]byte("1000"), nil})
+
+	traffic, err = c.GetMonthlyBytes([]string{"m1", "m2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if traffic["m1"] != 1000 {
+		t.Fatalf("Expected 1000, got %d", traffic["m1"])
+	}
+	if traffic["m2"] != 0 {
+		t.Fatalf("Expected 0, got %d", traffic["m2"])
+	}
+
+	// Only the mirrors missing from the cache are fetched
+	cmd := mock.Command("HMGET", key, "m3").Expect([]interface{}{[]byte("42")})
+
+	traffic, err = c.GetMonthlyBytes([]string{"m1", "m2", "m3"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if mock.Stats(cmd) != 1 {
+		t.Fatalf("HMGET not executed for the missing mirror")
+	}
+	if traffic["m1"] != 1000 || traffic["m2"] != 0 || traffic["m3"] != 42 {
+		t.Fatalf("Unexpected traffic %v", traffic)
+	}
+
+	// Expired entries are fetched again
+	c.mbLock.Lock()
+	v := c.mbCache["m1"]
+	v.expires = time.Now().Add(-time.Second)
+	c.mbCache["m1"] = v
+	c.mbLock.Unlock()
+
+	mock.Command("HMGET", key, "m1").Expect([]interface{}{[]byte("2000")})
+
+	traffic, err = c.GetMonthlyBytes([]string{"m1"})
+	if err != nil || traffic["m1"] != 2000 {
+		t.Fatalf("Expected 2000, got %d (%v)", traffic["m1"], err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mirrors
+
+import (
+	"fmt"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+/*
+	Problems reported by the clients while downloading from a mirror:
+	FEEDBACK_<id>						= sorted set of client IP -> unix time of the last report
+	FEEDBACK_CLIENT_<ip>				= number of reports sent by the client in the current period
+*/
+
+// AddFeedback records a failed or slow transfer reported by a client and
+// returns the number of distinct clients having reported a problem with
+// the mirror within the given window
+func AddFeedback(r *database.Redis, id, client string, window time.Duration) (int, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	key := fmt.Sprintf("FEEDBACK_%s", id)
+
+	conn.Send("MULTI")
+	conn.Send("ZADD", key, now.Unix(), client)
+	conn.Send("ZREMRANGEBYSCORE", key, "-inf", now.Add(-window).Unix())
+	conn.Send("ZCARD", key)
+	conn.Send("EXPIRE", key, int64(window/time.Second))
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(res[2], nil)
+}
+
+// AddClientReport counts a report sent by a client and returns the number
+// of reports it sent since the beginning of the current period
+func AddClientReport(r *database.Redis, client string, period time.Duration) (int, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("FEEDBACK_CLIENT_%s", client)
+
+	conn.Send("MULTI")
+	conn.Send("SET", key, 0, "EX", int64(period/time.Second), "NX")
+	conn.Send("INCR", key)
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(res[1], nil)
+}
+
+// ClearFeedback forgets about the problems reported on the given mirror
+func ClearFeedback(r *database.Redis, id string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", fmt.Sprintf("FEEDBACK_%s", id))
+	return err
+}
+
+// PenalizeMirror lowers the weight of the mirror in the selection until the given date
+func PenalizeMirror(r *database.Redis, id string, until time.Time) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", fmt.Sprintf("MIRROR_%s", id), "penalizedUntil", until.Unix())
+	if err != nil {
+		return err
+	}
+
+	// Publish update
+	return database.Publish(conn, database.MIRROR_UPDATE, id)
+}
+
+// RequestCheck asks the monitor in charge of the given mirror to check its health as soon as possible
+func RequestCheck(r *database.Redis, id string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	return database.Publish(conn, database.MIRROR_CHECK_REQ, id)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mirrors
+
+import (
+	"github.com/wsnipex/mirrorbits/database"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+func TestAddFeedback(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	if _, err := AddFeedback(conn, "m1", "192.168.0.1", 10*time.Minute); err == nil {
+		t.Fatalf("Error expected but nil returned")
+	}
+
+	mock.Command("MULTI").Expect("OK")
+	cmd_zadd := mock.Command("ZADD", "FEEDBACK_m1", redigomock.NewAnyInt(), "192.168.0.1").Expect("QUEUED")
+	cmd_zrem := mock.Command("ZREMRANGEBYSCORE", "FEEDBACK_m1", "-inf", redigomock.NewAnyInt()).Expect("QUEUED")
+	mock.Command("ZCARD", "FEEDBACK_m1").Expect("QUEUED")
+	cmd_expire := mock.Command("EXPIRE", "FEEDBACK_m1", int64(600)).Expect("QUEUED")
+	mock.Command("EXEC").Expect([]interface{}{int64(1), int64(0), int64(3), int64(1)})
+
+	count, err := AddFeedback(conn, "m1", "192.168.0.1", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 clients, got %d", count)
+	}
+	if mock.Stats(cmd_zadd) != 1 || mock.Stats(cmd_zrem) != 1 {
+		t.Fatalf("The report of the client wasn't recorded")
+	}
+	if mock.Stats(cmd_expire) != 1 {
+		t.Fatalf("The expiration of the reports wasn't set")
+	}
+}
+
+func TestAddClientReport(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	if _, err := AddClientReport(conn, "192.168.0.1", 10*time.Minute); err == nil {
+		t.Fatalf("Error expected but nil returned")
+	}
+
+	mock.Command("MULTI").Expect("OK")
+	cmd_set := mock.Command("SET", "FEEDBACK_CLIENT_192.168.0.1", 0, "EX", int64(600), "NX").Expect("QUEUED")
+	mock.Command("INCR", "FEEDBACK_CLIENT_192.168.0.1").Expect("QUEUED")
+	mock.Command("EXEC").Expect([]interface{}{nil, int64(4)})
+
+	reports, err := AddClientReport(conn, "192.168.0.1", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if reports != 4 {
+		t.Fatalf("Expected 4 reports, got %d", reports)
+	}
+	if mock.Stats(cmd_set) != 1 {
+		t.Fatalf("The period wasn't started")
+	}
+}
+
+func TestPenalizeMirror(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	until := time.Now().Add(30 * time.Minute)
+
+	if err := PenalizeMirror(conn, "m1", until); err == nil {
+		t.Fatalf("Error expected but nil returned")
+	}
+
+	cmd_hset := mock.Command("HSET", "MIRROR_m1", "penalizedUntil", until.Unix()).Expect(int64(1))
+	cmd_publish := mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m1").Expect(int64(1))
+
+	if err := PenalizeMirror(conn, "m1", until); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mock.Stats(cmd_hset) != 1 {
+		t.Fatalf("The penalty wasn't saved")
+	}
+	if mock.Stats(cmd_publish) != 1 {
+		t.Fatalf("Event MIRROR_UPDATE not published")
+	}
+}
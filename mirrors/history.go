@@ -0,0 +1,227 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mirrors
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	History of the mirrors, most recent entries first:
+	HISTORY_STATE_<id>					= list of json encoded StateChange
+	HISTORY_LATENCY_<id>				= list of "<unix time> <latency in ms>"
+*/
+
+const (
+	// Number of state changes kept per mirror
+	stateHistorySize = 1000
+	// Number of latency samples kept per mirror (a month of checks every minute)
+	latencyHistorySize = 31 * 24 * 60
+	// Weight of a new sample in the rolling average of the latency
+	latencySmoothing = 0.2
+	// Relative change of the rolling average notified to the cache
+	latencyUpdateThreshold = 0.1
+)
+
+// StateChange is a transition of a mirror between up and down
+type StateChange struct {
+	Time   int64
+	Up     bool
+	Reason string `json:",omitempty"`
+}
+
+// LatencySample is the response time of a mirror during a health check
+type LatencySample struct {
+	Time    int64
+	Latency int64 // in milliseconds
+}
+
+// History represents the state and latency history of a mirror
+type History struct {
+	States    []StateChange
+	Latencies []LatencySample
+}
+
+// HistoryReport summarizes the history of a mirror over a period of time
+type HistoryReport struct {
+	From           int64
+	To             int64
+	Uptime         float64
+	AverageLatency int64
+	History
+}
+
+// NewHistoryReport returns the report of the given history between
+// the two dates, up being the current state of the mirror
+func NewHistoryReport(h *History, from, to time.Time, up bool) HistoryReport {
+	return HistoryReport{
+		From:           from.Unix(),
+		To:             to.Unix(),
+		Uptime:         h.Uptime(from, to, up),
+		AverageLatency: h.AverageLatency(),
+		History:        *h,
+	}
+}
+
+// recordStateChange adds a state change to the history of a mirror
+func recordStateChange(conn redis.Conn, id string, change StateChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("HISTORY_STATE_%s", id)
+	if _, err = conn.Do("LPUSH", key, data); err != nil {
+		return err
+	}
+	_, err = conn.Do("LTRIM", key, 0, stateHistorySize-1)
+	return err
+}
+
+// AddLatencySample records the response time of a mirror and
+// updates its rolling average used by the selection
+func AddLatencySample(r *database.Redis, id string, latency time.Duration) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	ms := int64(latency / time.Millisecond)
+	mkey := fmt.Sprintf("MIRROR_%s", id)
+
+	previous, err := redis.Int64(conn.Do("HGET", mkey, "latency"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	average := rollingAverage(previous, ms)
+
+	key := fmt.Sprintf("HISTORY_LATENCY_%s", id)
+	conn.Send("MULTI")
+	conn.Send("LPUSH", key, fmt.Sprintf("%d %d", time.Now().Unix(), ms))
+	conn.Send("LTRIM", key, 0, latencyHistorySize-1)
+	conn.Send("HSET", mkey, "latency", average)
+	if _, err = conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	// Don't flush the cache of the mirror for insignificant changes
+	if average != previous && (previous == 0 || math.Abs(float64(average-previous)) > float64(previous)*latencyUpdateThreshold) {
+		database.Publish(conn, database.MIRROR_UPDATE, id)
+	}
+	return nil
+}
+
+// rollingAverage returns the exponentially weighted moving average
+// of the latency given its previous value and a new sample
+func rollingAverage(previous, sample int64) int64 {
+	if previous <= 0 {
+		return sample
+	}
+	return int64(float64(previous)*(1-latencySmoothing) + float64(sample)*latencySmoothing + 0.5)
+}
+
+// GetHistory returns the state changes and the latency samples
+// of a mirror more recent than the given date
+func GetHistory(r *database.Redis, id string, since time.Time) (*History, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	history := &History{}
+
+	states, err := redis.Strings(conn.Do("LRANGE", fmt.Sprintf("HISTORY_STATE_%s", id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		var change StateChange
+		if err := json.Unmarshal([]byte(s), &change); err != nil {
+			continue
+		}
+		history.States = append(history.States, change)
+		// Keep the last change before the period to know the initial state
+		if change.Time < since.Unix() {
+			break
+		}
+	}
+
+	latencies, err := redis.Strings(conn.Do("LRANGE", fmt.Sprintf("HISTORY_LATENCY_%s", id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range latencies {
+		f := strings.Fields(l)
+		if len(f) != 2 {
+			continue
+		}
+		t, err1 := strconv.ParseInt(f[0], 10, 64)
+		ms, err2 := strconv.ParseInt(f[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if t < since.Unix() {
+			break
+		}
+		history.Latencies = append(history.Latencies, LatencySample{
+			Time:    t,
+			Latency: ms,
+		})
+	}
+
+	return history, nil
+}
+
+// Uptime returns the percentage of time the mirror has been up
+// between the two dates given the current state of the mirror.
+func (h *History) Uptime(from, to time.Time, up bool) float64 {
+	start, end := from.Unix(), to.Unix()
+	if end <= start {
+		return 0
+	}
+
+	var upTime int64
+	cursor := end
+
+	for _, c := range h.States {
+		if c.Time >= cursor {
+			// Change after the end of the period
+			up = !c.Up
+			continue
+		}
+		begin := c.Time
+		if begin < start {
+			begin = start
+		}
+		if c.Up {
+			upTime += cursor - begin
+		}
+		cursor = begin
+		up = !c.Up
+		if cursor <= start {
+			break
+		}
+	}
+
+	// The state before the oldest known change
+	if cursor > start && up {
+		upTime += cursor - start
+	}
+
+	return float64(upTime) * 100 / float64(end-start)
+}
+
+// AverageLatency returns the average of the latency samples in milliseconds
+func (h *History) AverageLatency() int64 {
+	if len(h.Latencies) == 0 {
+		return 0
+	}
+	var total int64
+	for _, l := range h.Latencies {
+		total += l.Latency
+	}
+	return total / int64(len(h.Latencies))
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mirrors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory_Uptime(t *testing.T) {
+	from := time.Unix(1000, 0)
+	to := time.Unix(2000, 0)
+
+	// No history, the current state applies to the whole period
+	h := &History{}
+	if u := h.Uptime(from, to, true); u != 100 {
+		t.Fatalf("Expected 100%%, got %f", u)
+	}
+	if u := h.Uptime(from, to, false); u != 0 {
+		t.Fatalf("Expected 0%%, got %f", u)
+	}
+
+	// Down from 1200 to 1500, then up again (most recent first)
+	h = &History{
+		States: []StateChange{
+			{Time: 2500, Up: false},
+			{Time: 1500, Up: true},
+			{Time: 1200, Up: false},
+			{Time: 500, Up: true},
+		},
+	}
+	if u := h.Uptime(from, to, false); u != 70 {
+		t.Fatalf("Expected 70%%, got %f", u)
+	}
+
+	// Truncated history, the state before the oldest change is its opposite
+	h = &History{
+		States: []StateChange{
+			{Time: 1500, Up: false},
+		},
+	}
+	if u := h.Uptime(from, to, false); u != 50 {
+		t.Fatalf("Expected 50%%, got %f", u)
+	}
+}
+
+func TestHistory_AverageLatency(t *testing.T) {
+	h := &History{}
+	if l := h.AverageLatency(); l != 0 {
+		t.Fatalf("Expected 0, got %d", l)
+	}
+
+	h.Latencies = []LatencySample{
+		{Time: 3, Latency: 100},
+		{Time: 2, Latency: 200},
+		{Time: 1, Latency: 300},
+	}
+	if l := h.AverageLatency(); l != 200 {
+		t.Fatalf("Expected 200, got %d", l)
+	}
+}
+
+func TestRollingAverage(t *testing.T) {
+	if a := rollingAverage(0, 150); a != 150 {
+		t.Fatalf("Expected the first sample, got %d", a)
+	}
+	if a := rollingAverage(100, 200); a != 120 {
+		t.Fatalf("Expected 120, got %d", a)
+	}
+	if a := rollingAverage(100, 100); a != 100 {
+		t.Fatalf("Expected 100, got %d", a)
+	}
+}
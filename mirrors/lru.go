@@ -53,6 +53,10 @@ type LRUCache struct {
 
 	// How many bytes we are limiting the cache to.
 	capacity uint64
+
+	// Number of lookups that found, or not, their key.
+	hits   uint64
+	misses uint64
 }
 
 // Values that go into LRUCache need to satisfy this interface.
@@ -86,8 +90,10 @@ func (lru *LRUCache) Get(key string) (v Value, ok bool) {
 
 	element := lru.table[key]
 	if element == nil {
+		lru.misses++
 		return nil, false
 	}
+	lru.hits++
 	lru.moveToFront(element)
 	return element.Value.(*entry).value, true
 }
@@ -155,6 +161,13 @@ func (lru *LRUCache) Stats() (length, size, capacity uint64, oldest time.Time) {
 	return uint64(lru.list.Len()), lru.size, lru.capacity, oldest
 }
 
+// HitStats returns the number of successful and unsuccessful lookups
+func (lru *LRUCache) HitStats() (hits, misses uint64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.hits, lru.misses
+}
+
 func (lru *LRUCache) StatsJSON() string {
 	if lru == nil {
 		return "{}"
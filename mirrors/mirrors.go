@@ -5,6 +5,7 @@ package mirrors
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/wsnipex/mirrorbits/database"
 	"github.com/wsnipex/mirrorbits/filesystem"
@@ -12,13 +13,23 @@ import (
 	"github.com/wsnipex/mirrorbits/utils"
 	"github.com/garyburd/redigo/redis"
 	"math/rand"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrMirrorExists is returned when adding a mirror with an already used identifier
+	ErrMirrorExists = errors.New("mirror already exists")
+
+	// ErrInvalidCheckMethod is returned when the health check method of a mirror is not supported
+	ErrInvalidCheckMethod = errors.New("the check method can only be HEAD or GET")
+)
+
 // Mirror is the structure representing all the information about a mirror
 type Mirror struct {
 	ID                 string   `redis:"ID" yaml:"-"`
 	HttpURL            string   `redis:"http" yaml:"HttpURL"`
+	HttpsURL           string   `redis:"https" json:",omitempty" yaml:"HttpsURL"`
 	RsyncURL           string   `redis:"rsync" yaml:"RsyncURL"`
 	FtpURL             string   `redis:"ftp" yaml:"FtpURL"`
 	SponsorName        string   `redis:"sponsorName" yaml:"SponsorName"`
@@ -26,11 +37,19 @@ type Mirror struct {
 	SponsorLogoURL     string   `redis:"sponsorLogo" yaml:"SponsorLogoURL"`
 	AdminName          string   `redis:"adminName" yaml:"AdminName"`
 	AdminEmail         string   `redis:"adminEmail" yaml:"AdminEmail"`
+	NoAdminEmails      bool     `redis:"noAdminEmails" json:",omitempty" yaml:"NoAdminEmails"`
 	CustomData         string   `redis:"customData" yaml:"CustomData"`
 	ContinentOnly      bool     `redis:"continentOnly" yaml:"ContinentOnly"`
 	CountryOnly        bool     `redis:"countryOnly" yaml:"CountryOnly"`
 	ASOnly             bool     `redis:"asOnly" yaml:"ASOnly"`
 	Score              int      `redis:"score" yaml:"Score"`
+	Tier               int      `redis:"tier" json:",omitempty" yaml:"Tier"`
+	Bandwidth          int      `redis:"bandwidth" json:",omitempty" yaml:"Bandwidth"`
+	MonthlyQuota       int64    `redis:"monthlyQuota" json:",omitempty" yaml:"MonthlyQuota"`
+	CheckMethod        string   `redis:"checkMethod" json:",omitempty" yaml:"CheckMethod"`
+	CheckFiles         string   `redis:"checkFiles" json:",omitempty" yaml:"CheckFiles"`
+	ScanInterval       int      `redis:"scanInterval" json:",omitempty" yaml:"ScanInterval"`
+	PushSync           bool     `redis:"pushSync" json:",omitempty" yaml:"PushSync"`
 	Latitude           float32  `redis:"latitude" yaml:"Latitude"`
 	Longitude          float32  `redis:"longitude" yaml:"Longitude"`
 	ContinentCode      string   `redis:"continentCode" yaml:"ContinentCode"`
@@ -41,13 +60,20 @@ type Mirror struct {
 	Up                 bool     `redis:"up" json:"-" yaml:"-"`
 	ExcludeReason      string   `redis:"excludeReason" json:",omitempty" yaml:"-"`
 	StateSince         int64    `redis:"stateSince" json:",omitempty" yaml:"-"`
+	HttpsUp            bool     `redis:"httpsUp" json:"-" yaml:"-"`
+	HttpsExcludeReason string   `redis:"httpsExcludeReason" json:",omitempty" yaml:"-"`
+	Latency            int64    `redis:"latency" json:",omitempty" yaml:"-"`        // Rolling average of the response time in ms
+	PenalizedUntil     int64    `redis:"penalizedUntil" json:",omitempty" yaml:"-"` // Problems reported by the clients
 	Distance           float32  `redis:"-" yaml:"-"`
 	CountryFields      []string `redis:"-" json:"-" yaml:"-"`
 	Filepath           string   `redis:"-" json:"-" yaml:"-"`
 	Weight             float32  `redis:"-" json:"-" yaml:"-"`
 	ComputedScore      int      `redis:"-" yaml:"-"`
+	QuotaUsage         float32  `redis:"-" json:",omitempty" yaml:"-"`
 	LastSync           int64    `redis:"lastSync" yaml:"-"`
 	LastSuccessfulSync int64    `redis:"lastSuccessfulSync" yaml:"-"`
+	ScanFailures       int      `redis:"scanFailures" json:",omitempty" yaml:"-"`
+	ScanFailedSince    int64    `redis:"scanFailedSince" json:",omitempty" yaml:"-"` // First of the consecutive failed scans
 
 	FileInfo *filesystem.FileInfo `redis:"-" json:"-" yaml:"-"` // Details of the requested file on this specific mirror
 }
@@ -109,6 +135,24 @@ func (b ByComputedScore) Less(i, j int) bool {
 	return b.Mirrors[i].ComputedScore > b.Mirrors[j].ComputedScore
 }
 
+// ByDistance is used to sort a slice of Mirror by their distance to the client
+type ByDistance struct {
+	Mirrors
+}
+
+func (b ByDistance) Less(i, j int) bool {
+	return b.Mirrors[i].Distance < b.Mirrors[j].Distance
+}
+
+// ByID is used to sort a slice of Mirror alphabetically by their identifier
+type ByID struct {
+	Mirrors
+}
+
+func (b ByID) Less(i, j int) bool {
+	return b.Mirrors[i].ID < b.Mirrors[j].ID
+}
+
 // ByExcludeReason is used to sort a slice of Mirror alphabetically by their exclude reason
 type ByExcludeReason struct {
 	Mirrors
@@ -166,13 +210,21 @@ func SetMirrorState(r *database.Redis, id string, state bool, reason string) err
 	var args []interface{}
 	args = append(args, key, "up", state, "excludeReason", reason)
 
+	now := time.Now().Unix()
 	if state != previousState {
-		args = append(args, "stateSince", time.Now().Unix())
+		args = append(args, "stateSince", now)
 	}
 
 	_, err = conn.Do("HMSET", args...)
 
 	if err == nil && state != previousState {
+		// Keep track of the transition
+		recordStateChange(conn, id, StateChange{
+			Time:   now,
+			Up:     state,
+			Reason: reason,
+		})
+
 		// Publish update
 		database.Publish(conn, database.MIRROR_UPDATE, id)
 	}
@@ -180,6 +232,279 @@ func SetMirrorState(r *database.Redis, id string, state bool, reason string) err
 	return err
 }
 
+// GetMirrorStateSince returns the time at which the mirror entered its
+// current state
+func GetMirrorStateSince(r *database.Redis, id string) (int64, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("HGET", fmt.Sprintf("MIRROR_%s", id), "stateSince"))
+}
+
+// SetMirrorHTTPSState saves the state of the HTTPS URL of a mirror when it
+// differs from its main URL
+func SetMirrorHTTPSState(r *database.Redis, id string, state bool, reason string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("MIRROR_%s", id)
+
+	previousState, err := redis.Bool(conn.Do("HGET", key, "httpsUp"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	_, err = conn.Do("HMSET", key, "httpsUp", state, "httpsExcludeReason", reason)
+
+	if err == nil && state != previousState {
+		// Publish update
+		database.Publish(conn, database.MIRROR_UPDATE, id)
+	}
+
+	return err
+}
+
+// MainURL returns the URL used to health-check the mirror and to
+// redirect the clients connected over plain HTTP
+func (m *Mirror) MainURL() string {
+	if m.HttpURL != "" {
+		return m.HttpURL
+	}
+	return m.HttpsURL
+}
+
+// SecureURL returns the URL to use for the clients connected over HTTPS
+// or an empty string if the mirror doesn't support HTTPS
+func (m *Mirror) SecureURL() string {
+	if m.HttpsURL != "" {
+		return m.HttpsURL
+	}
+	if strings.HasPrefix(m.HttpURL, "https://") {
+		return m.HttpURL
+	}
+	return ""
+}
+
+// Normalize reformats the country and continent codes and adds
+// a trailing slash to the URLs of the mirror
+func (m *Mirror) Normalize() {
+	// Reformat country codes
+	ccodes := strings.Fields(strings.Replace(m.CountryCodes, ",", " ", -1))
+	for i, c := range ccodes {
+		ccodes[i] = strings.ToUpper(c)
+	}
+	m.CountryCodes = strings.Join(ccodes, " ")
+	m.CountryFields = ccodes
+
+	// Reformat continent code
+	//FIXME sanitize
+	m.ContinentCode = strings.ToUpper(m.ContinentCode)
+
+	// Reformat the health check settings
+	m.CheckMethod = strings.ToUpper(strings.TrimSpace(m.CheckMethod))
+	m.CheckFiles = strings.Join(strings.Fields(strings.Replace(m.CheckFiles, ",", " ", -1)), " ")
+
+	// Normalize URLs
+	m.HttpURL = utils.NormalizeURL(m.HttpURL)
+	m.HttpsURL = utils.NormalizeURL(m.HttpsURL)
+	m.RsyncURL = utils.NormalizeURL(m.RsyncURL)
+	m.FtpURL = utils.NormalizeURL(m.FtpURL)
+}
+
+// Validate returns an error if the settings of the normalized mirror are invalid
+func (m *Mirror) Validate() error {
+	if !IsValidCheckMethod(m.CheckMethod) {
+		return ErrInvalidCheckMethod
+	}
+	return nil
+}
+
+// IsValidCheckMethod returns true if the given method can be used by the
+// health checks, an empty method meaning the default one
+func IsValidCheckMethod(method string) bool {
+	return method == "" || method == "HEAD" || method == "GET"
+}
+
+// AddMirror stores a new mirror in the database. The mirror
+// is always added in a disabled state.
+func AddMirror(r *database.Redis, mirror Mirror) error {
+	if err := mirror.Validate(); err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("MIRROR_%s", mirror.ID)
+
+	// Reserve the identifier atomically
+	created, err := redis.Bool(conn.Do("HSETNX", key, "ID", mirror.ID))
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrMirrorExists
+	}
+
+	_, err = conn.Do("HMSET", key,
+		"ID", mirror.ID,
+		"http", mirror.HttpURL,
+		"https", mirror.HttpsURL,
+		"rsync", mirror.RsyncURL,
+		"ftp", mirror.FtpURL,
+		"sponsorName", mirror.SponsorName,
+		"sponsorURL", mirror.SponsorURL,
+		"sponsorLogo", mirror.SponsorLogoURL,
+		"adminName", mirror.AdminName,
+		"adminEmail", mirror.AdminEmail,
+		"noAdminEmails", mirror.NoAdminEmails,
+		"customData", mirror.CustomData,
+		"continentOnly", mirror.ContinentOnly,
+		"countryOnly", mirror.CountryOnly,
+		"asOnly", mirror.ASOnly,
+		"score", mirror.Score,
+		"tier", mirror.Tier,
+		"bandwidth", mirror.Bandwidth,
+		"monthlyQuota", mirror.MonthlyQuota,
+		"checkMethod", mirror.CheckMethod,
+		"checkFiles", mirror.CheckFiles,
+		"scanInterval", mirror.ScanInterval,
+		"pushSync", mirror.PushSync,
+		"latitude", fmt.Sprintf("%f", mirror.Latitude),
+		"longitude", fmt.Sprintf("%f", mirror.Longitude),
+		"continentCode", mirror.ContinentCode,
+		"countryCodes", mirror.CountryCodes,
+		"asnum", mirror.Asnum,
+		"comment", strings.TrimSpace(mirror.Comment),
+		"enabled", false,
+		"up", false)
+	if err != nil {
+		// Release the identifier
+		conn.Do("DEL", key)
+		return err
+	}
+
+	_, err = conn.Do("LPUSH", "MIRRORS", mirror.ID)
+	if err != nil {
+		return err
+	}
+
+	// Publish update
+	database.Publish(conn, database.MIRROR_UPDATE, mirror.ID)
+	return nil
+}
+
+// UpdateMirror saves the editable fields of an existing mirror in the database.
+// The mirror is enabled or disabled separately with EnableMirror and DisableMirror.
+func UpdateMirror(r *database.Redis, mirror Mirror) error {
+	if err := mirror.Validate(); err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HMSET", fmt.Sprintf("MIRROR_%s", mirror.ID),
+		"ID", mirror.ID,
+		"http", mirror.HttpURL,
+		"https", mirror.HttpsURL,
+		"rsync", mirror.RsyncURL,
+		"ftp", mirror.FtpURL,
+		"sponsorName", mirror.SponsorName,
+		"sponsorURL", mirror.SponsorURL,
+		"sponsorLogo", mirror.SponsorLogoURL,
+		"adminName", mirror.AdminName,
+		"adminEmail", mirror.AdminEmail,
+		"noAdminEmails", mirror.NoAdminEmails,
+		"customData", mirror.CustomData,
+		"continentOnly", mirror.ContinentOnly,
+		"countryOnly", mirror.CountryOnly,
+		"asOnly", mirror.ASOnly,
+		"score", mirror.Score,
+		"tier", mirror.Tier,
+		"bandwidth", mirror.Bandwidth,
+		"monthlyQuota", mirror.MonthlyQuota,
+		"checkMethod", mirror.CheckMethod,
+		"checkFiles", mirror.CheckFiles,
+		"scanInterval", mirror.ScanInterval,
+		"pushSync", mirror.PushSync,
+		"latitude", fmt.Sprintf("%f", mirror.Latitude),
+		"longitude", fmt.Sprintf("%f", mirror.Longitude),
+		"continentCode", mirror.ContinentCode,
+		"countryCodes", mirror.CountryCodes,
+		"asnum", mirror.Asnum,
+		"comment", mirror.Comment)
+	if err != nil {
+		return err
+	}
+
+	// Publish update
+	database.Publish(conn, database.MIRROR_UPDATE, mirror.ID)
+	return nil
+}
+
+// RemoveMirror disables the given mirror and removes all
+// its associated keys from the database
+func RemoveMirror(r *database.Redis, id string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	// First disable the mirror
+	DisableMirror(r, id)
+
+	// Get all files supported by the given mirror
+	files, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("MIRROR_%s_FILES", id)))
+	if err != nil {
+		return fmt.Errorf("cannot fetch file list: %s", err)
+	}
+
+	conn.Send("MULTI")
+
+	// Remove each FILEINFO / FILEMIRRORS
+	for _, file := range files {
+		conn.Send("DEL", fmt.Sprintf("FILEINFO_%s_%s", id, file))
+		conn.Send("SREM", fmt.Sprintf("FILEMIRRORS_%s", file), id)
+		database.SendPublish(conn, database.MIRROR_FILE_UPDATE, fmt.Sprintf("%s %s", id, file))
+	}
+
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return fmt.Errorf("FILEINFO/FILEMIRRORS keys could not be removed: %s", err)
+	}
+
+	// Remove all other keys
+	_, err = conn.Do("DEL",
+		fmt.Sprintf("MIRROR_%s", id),
+		fmt.Sprintf("MIRROR_%s_FILES", id),
+		fmt.Sprintf("MIRROR_%s_FILES_TMP", id),
+		fmt.Sprintf("HANDLEDFILES_%s", id),
+		fmt.Sprintf("SCANNING_%s", id),
+		fmt.Sprintf("HISTORY_STATE_%s", id),
+		fmt.Sprintf("HISTORY_LATENCY_%s", id),
+		fmt.Sprintf("FEEDBACK_%s", id))
+	if err != nil {
+		return fmt.Errorf("MIRROR keys could not be removed: %s", err)
+	}
+
+	// Remove the last reference
+	_, err = conn.Do("LREM", "MIRRORS", 0, id)
+	if err != nil {
+		return fmt.Errorf("could not remove the reference from key MIRRORS: %s", err)
+	}
+
+	// Publish update
+	database.Publish(conn, database.MIRROR_UPDATE, id)
+	return nil
+}
+
+// RequestScan asks the monitor in charge of the given mirror to scan it as soon as possible
+func RequestScan(r *database.Redis, id string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	return database.Publish(conn, database.MIRROR_SCAN_REQ, id)
+}
+
 func GetMirrorMapUrl(mirrors Mirrors, clientInfo network.GeoIPRecord) string {
 	var buffer bytes.Buffer
 	buffer.WriteString("//maps.googleapis.com/maps/api/staticmap?size=520x320&sensor=false&visual_refresh=true")
@@ -218,5 +543,6 @@ type Results struct {
 	ClientInfo   network.GeoIPRecord
 	MirrorList   Mirrors
 	ExcludedList Mirrors `json:",omitempty"`
+	SyncSources  Mirrors `json:",omitempty"`
 	Fallback     bool    `json:",omitempty"`
 }
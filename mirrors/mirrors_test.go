@@ -461,6 +461,7 @@ func TestSetMirrorState(t *testing.T) {
 	cmd_previous_state := mock.Command("HGET", "MIRROR_m1", "up").Expect(int64(0)).Expect(int64(1))
 	cmd_state_since := mock.Command("HMSET", "MIRROR_m1", "up", true, "excludeReason", "test1", "stateSince", redigomock.NewAnyInt()).Expect("ok")
 	cmd_state := mock.Command("HMSET", "MIRROR_m1", "up", true, "excludeReason", "test2").Expect("ok")
+	cmd_history := mock.Command("LPUSH", "HISTORY_STATE_m1", redigomock.NewAnyData()).Expect(int64(1))
 
 	if err := SetMirrorState(conn, "m1", true, "test1"); err != nil {
 		t.Fatalf("Unexpected error: %s", err)
@@ -480,6 +481,10 @@ func TestSetMirrorState(t *testing.T) {
 		t.Fatalf("Event MIRROR_UPDATE not published")
 	}
 
+	if mock.Stats(cmd_history) != 1 {
+		t.Fatalf("State change not recorded in the history")
+	}
+
 	/* */
 
 	if err := SetMirrorState(conn, "m1", true, "test2"); err != nil {
@@ -494,6 +499,10 @@ func TestSetMirrorState(t *testing.T) {
 		t.Fatalf("Event MIRROR_UPDATE should not be sent")
 	}
 
+	if mock.Stats(cmd_history) != 1 {
+		t.Fatalf("The history isn't supposed to change")
+	}
+
 	/* */
 
 	cmd_previous_state = mock.Command("HGET", "MIRROR_m1", "up").Expect(int64(1))
@@ -518,6 +527,199 @@ func TestSetMirrorState(t *testing.T) {
 	}
 }
 
+func TestGetMirrorStateSince(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	if _, err := GetMirrorStateSince(conn, "m1"); err == nil {
+		t.Fatalf("Error expected but nil returned")
+	}
+
+	mock.Command("HGET", "MIRROR_m1", "stateSince").Expect([]byte("1420070400"))
+
+	since, err := GetMirrorStateSince(conn, "m1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if since != 1420070400 {
+		t.Fatalf("Expected 1420070400, got %d", since)
+	}
+}
+
+func TestMirror_Normalize(t *testing.T) {
+	m := Mirror{
+		HttpURL:       "example.org/pub",
+		ContinentCode: "eu",
+		CountryCodes:  "fr, be  de",
+	}
+
+	m.Normalize()
+
+	if m.HttpURL != "example.org/pub/" {
+		t.Fatalf("Expected example.org/pub/, got %s", m.HttpURL)
+	}
+	if m.ContinentCode != "EU" {
+		t.Fatalf("Expected EU, got %s", m.ContinentCode)
+	}
+	if m.CountryCodes != "FR BE DE" {
+		t.Fatalf("Expected FR BE DE, got %s", m.CountryCodes)
+	}
+	if len(m.CountryFields) != 3 || m.CountryFields[2] != "DE" {
+		t.Fatalf("Invalid country fields: %v", m.CountryFields)
+	}
+}
+
+func TestMirror_Validate(t *testing.T) {
+	for _, method := range []string{"", "HEAD", "GET"} {
+		m := Mirror{CheckMethod: method}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("Unexpected error for %q: %s", method, err)
+		}
+	}
+
+	m := Mirror{CheckMethod: " get "}
+	m.Normalize()
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for _, method := range []string{"POST", "DELETE", "head"} {
+		m := Mirror{CheckMethod: method}
+		if err := m.Validate(); err != ErrInvalidCheckMethod {
+			t.Fatalf("Expected ErrInvalidCheckMethod for %q, got %v", method, err)
+		}
+	}
+}
+
+func TestAddMirror(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	// Rejected before touching the database
+	if err := AddMirror(conn, Mirror{ID: "m1", CheckMethod: "POST"}); err != ErrInvalidCheckMethod {
+		t.Fatalf("Expected ErrInvalidCheckMethod, got %v", err)
+	}
+	if err := UpdateMirror(conn, Mirror{ID: "m1", CheckMethod: "POST"}); err != ErrInvalidCheckMethod {
+		t.Fatalf("Expected ErrInvalidCheckMethod, got %v", err)
+	}
+
+	mock.Command("HSETNX", "MIRROR_m1", "ID", "m1").Expect(int64(0))
+	if err := AddMirror(conn, Mirror{ID: "m1"}); err != ErrMirrorExists {
+		t.Fatalf("Expected ErrMirrorExists, got %v", err)
+	}
+
+	mock.Command("HSETNX", "MIRROR_m1", "ID", "m1").Expect(int64(1))
+	cmd_hmset := mock.Command("HMSET", "MIRROR_m1",
+		"ID", "m1",
+		"http", "http://m1.mirror/",
+		"https", "",
+		"rsync", "",
+		"ftp", "",
+		"sponsorName", "",
+		"sponsorURL", "",
+		"sponsorLogo", "",
+		"adminName", "",
+		"adminEmail", "",
+		"noAdminEmails", false,
+		"customData", "",
+		"continentOnly", false,
+		"countryOnly", false,
+		"asOnly", false,
+		"score", 0,
+		"tier", 0,
+		"bandwidth", 0,
+		"monthlyQuota", 0,
+		"checkMethod", "",
+		"checkFiles", "",
+		"scanInterval", 0,
+		"pushSync", false,
+		"latitude", "0.000000",
+		"longitude", "0.000000",
+		"continentCode", "",
+		"countryCodes", "",
+		"asnum", 0,
+		"comment", "",
+		"enabled", false,
+		"up", false).Expect("ok")
+	cmd_lpush := mock.Command("LPUSH", "MIRRORS", "m1").Expect(int64(1))
+	mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m1").Expect("ok")
+
+	if err := AddMirror(conn, Mirror{ID: "m1", HttpURL: "http://m1.mirror/"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mock.Stats(cmd_hmset) != 1 {
+		t.Fatalf("Mirror not saved")
+	}
+	if mock.Stats(cmd_lpush) != 1 {
+		t.Fatalf("Mirror not added to the list")
+	}
+}
+
+func TestUpdateMirror(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	// Same encoding of the location as AddMirror and no change of state
+	cmd_hmset := mock.Command("HMSET", "MIRROR_m1",
+		"ID", "m1",
+		"http", "http://m1.mirror/",
+		"https", "",
+		"rsync", "",
+		"ftp", "",
+		"sponsorName", "",
+		"sponsorURL", "",
+		"sponsorLogo", "",
+		"adminName", "",
+		"adminEmail", "",
+		"noAdminEmails", false,
+		"customData", "",
+		"continentOnly", false,
+		"countryOnly", false,
+		"asOnly", false,
+		"score", 0,
+		"tier", 0,
+		"bandwidth", 0,
+		"monthlyQuota", 0,
+		"checkMethod", "",
+		"checkFiles", "",
+		"scanInterval", 0,
+		"pushSync", false,
+		"latitude", "48.500000",
+		"longitude", "-2.250000",
+		"continentCode", "",
+		"countryCodes", "",
+		"asnum", 0,
+		"comment", "").Expect("ok")
+	mock.Command("PUBLISH", string(database.MIRROR_UPDATE), "m1").Expect("ok")
+
+	err := UpdateMirror(conn, Mirror{ID: "m1", HttpURL: "http://m1.mirror/", Latitude: 48.5, Longitude: -2.25, Enabled: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mock.Stats(cmd_hmset) != 1 {
+		t.Fatalf("Mirror not saved")
+	}
+}
+
+func TestRequestScan(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	cmd_publish := mock.Command("PUBLISH", string(database.MIRROR_SCAN_REQ), "m1").Expect("ok")
+	RequestScan(conn, "m1")
+
+	if mock.Stats(cmd_publish) != 1 {
+		t.Fatalf("Scan request not published")
+	}
+}
+
+func TestRequestCheck(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+
+	cmd_publish := mock.Command("PUBLISH", string(database.MIRROR_CHECK_REQ), "m1").Expect("ok")
+	RequestCheck(conn, "m1")
+
+	if mock.Stats(cmd_publish) != 1 {
+		t.Fatalf("Check request not published")
+	}
+}
+
 func TestGetMirrorMapUrl(t *testing.T) {
 	m := Mirrors{
 		Mirror{
@@ -0,0 +1,73 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mirrors
+
+import (
+	"fmt"
+	"github.com/wsnipex/mirrorbits/database"
+	"time"
+)
+
+// ScanDelay returns the delay between two scans of the mirror. It uses the
+// interval of the mirror, or defaultInterval if none is set, doubled for each
+// consecutive failed scan up to maxBackoff. All the values are in minutes.
+func (m *Mirror) ScanDelay(defaultInterval, maxBackoff int) time.Duration {
+	interval := m.ScanInterval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	delay := time.Duration(interval) * time.Minute
+	max := time.Duration(maxBackoff) * time.Minute
+
+	for i := 0; i < m.ScanFailures && delay < max; i++ {
+		delay *= 2
+		if delay > max {
+			delay = max
+		}
+	}
+	return delay
+}
+
+// NextScan returns the time of the next periodic scan of the mirror
+// or the zero time if the mirror is only scanned on request
+func (m *Mirror) NextScan(defaultInterval, maxBackoff int) time.Time {
+	if m.PushSync {
+		return time.Time{}
+	}
+	return time.Unix(m.LastSync, 0).Add(m.ScanDelay(defaultInterval, maxBackoff))
+}
+
+// ByNextScan is used to sort a slice of Mirror by the time of their next scan
+type ByNextScan struct {
+	Mirrors
+	DefaultInterval int
+	MaxBackoff      int
+}
+
+func (b ByNextScan) Less(i, j int) bool {
+	return b.Mirrors[i].NextScan(b.DefaultInterval, b.MaxBackoff).Before(b.Mirrors[j].NextScan(b.DefaultInterval, b.MaxBackoff))
+}
+
+// AddScanFailure increments the number of consecutive failed scans of
+// the mirror and records the time of the first one, both being reset
+// by the next successful scan
+func AddScanFailure(r *database.Redis, id string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("MIRROR_%s", id)
+
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", key, "scanFailures", 1)
+	conn.Send("HSETNX", key, "scanFailedSince", time.Now().UTC().Unix())
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+
+	// Publish update
+	database.Publish(conn, database.MIRROR_UPDATE, id)
+	return nil
+}
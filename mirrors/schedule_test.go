@@ -0,0 +1,56 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package mirrors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMirror_ScanDelay(t *testing.T) {
+	m := Mirror{}
+
+	if d := m.ScanDelay(30, 720); d != 30*time.Minute {
+		t.Fatalf("Expected the default interval, got %s", d)
+	}
+
+	m.ScanInterval = 60
+	if d := m.ScanDelay(30, 720); d != 60*time.Minute {
+		t.Fatalf("Expected the interval of the mirror, got %s", d)
+	}
+
+	m.ScanFailures = 2
+	if d := m.ScanDelay(30, 720); d != 240*time.Minute {
+		t.Fatalf("Expected 240m, got %s", d)
+	}
+
+	m.ScanFailures = 10
+	if d := m.ScanDelay(30, 720); d != 720*time.Minute {
+		t.Fatalf("Expected the maximum backoff, got %s", d)
+	}
+
+	// Backoff disabled or lower than the interval
+	if d := m.ScanDelay(30, 0); d != 60*time.Minute {
+		t.Fatalf("Expected no backoff, got %s", d)
+	}
+	if d := m.ScanDelay(30, 45); d != 60*time.Minute {
+		t.Fatalf("Expected no backoff, got %s", d)
+	}
+}
+
+func TestMirror_NextScan(t *testing.T) {
+	m := Mirror{
+		LastSync:     1000,
+		ScanInterval: 1,
+	}
+
+	if n := m.NextScan(30, 720); n.Unix() != 1060 {
+		t.Fatalf("Expected 1060, got %d", n.Unix())
+	}
+
+	m.PushSync = true
+	if n := m.NextScan(30, 720); !n.IsZero() {
+		t.Fatalf("Push mirrors must not be scanned periodically")
+	}
+}
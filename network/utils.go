@@ -4,6 +4,7 @@
 package network
 
 import (
+	"fmt"
 	"net"
 	"strings"
 )
@@ -42,3 +43,80 @@ func ExtractRemoteIP(XForwardedFor string) string {
 	}
 	return ""
 }
+
+// ParseNetworks parses a list of IP addresses and networks in the CIDR notation
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+	}
+	return networks, nil
+}
+
+// ClientIP returns the address of the client having sent the request. The
+// X-Forwarded-For header is only followed as long as the request was
+// forwarded by one of the trusted proxies or through a unix socket.
+func ClientIP(remoteAddr, xForwardedFor string, trusted []*net.IPNet) string {
+	client := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		client = host
+	}
+
+	var forwarded []string
+	if xForwardedFor != "" {
+		forwarded = strings.Split(xForwardedFor, ",")
+	}
+
+	// The right-most addresses are added by the closest proxies
+	for i := len(forwarded) - 1; i >= 0 && IsTrustedProxy(client, trusted); i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		client = addr
+	}
+	return client
+}
+
+// IsTrustedProxy returns true if the given peer is one of the trusted proxies
+// or a local proxy connected through a unix socket, in which case the
+// X-Forwarded-* headers of its requests can be relied upon.
+func IsTrustedProxy(remoteAddr string, trusted []*net.IPNet) bool {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	// The requests received on a unix socket come from a local proxy
+	if net.ParseIP(host) == nil {
+		return true
+	}
+	return isTrusted(host, trusted)
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@
 package network
 
 import (
+	"net"
 	"testing"
 )
 
@@ -35,3 +36,86 @@ func TestExtractRemoteIP(t *testing.T) {
 		t.Fatalf("Expected '192.168.0.1', got %s", r)
 	}
 }
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.0.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(networks) != 4 {
+		t.Fatalf("Expected 4 networks, got %d", len(networks))
+	}
+	if !networks[0].Contains(net.ParseIP("10.1.2.3")) {
+		t.Fatalf("10.1.2.3 should be part of %s", networks[0])
+	}
+	if !networks[1].Contains(net.ParseIP("192.168.0.1")) || networks[1].Contains(net.ParseIP("192.168.0.2")) {
+		t.Fatalf("Only 192.168.0.1 should be part of %s", networks[1])
+	}
+	if !networks[3].Contains(net.ParseIP("::1")) {
+		t.Fatalf("::1 should be part of %s", networks[3])
+	}
+
+	if _, err := ParseNetworks([]string{"192.168.0.300"}); err == nil {
+		t.Fatalf("Error expected")
+	}
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("Error expected")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := ParseNetworks([]string{"10.0.0.0/8", "::1"})
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		// The header is ignored unless the request comes from a trusted proxy
+		{"192.168.0.1:1234", "", "192.168.0.1"},
+		{"192.168.0.1:1234", "1.2.3.4", "192.168.0.1"},
+		{"[2001:db8::1]:1234", "1.2.3.4", "2001:db8::1"},
+		// Forwarded by trusted proxies
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"[::1]:1234", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", "1.2.3.4, 10.0.0.2", "1.2.3.4"},
+		// The addresses added by the client itself are not trusted
+		{"10.0.0.1:1234", "5.6.7.8, 1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		// Unix sockets
+		{"@", "1.2.3.4", "1.2.3.4"},
+		{"@", "5.6.7.8, 1.2.3.4", "1.2.3.4"},
+		{"@", "", "@"},
+	}
+
+	for _, test := range tests {
+		if r := ClientIP(test.remoteAddr, test.xff, trusted); r != test.expected {
+			t.Errorf("ClientIP(%q, %q): expected %s, got %s", test.remoteAddr, test.xff, test.expected, r)
+		}
+	}
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	trusted, _ := ParseNetworks([]string{"10.0.0.0/8", "::1"})
+
+	tests := []struct {
+		remoteAddr string
+		expected   bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"10.0.0.1", true},
+		{"[::1]:1234", true},
+		{"192.168.0.1:1234", false},
+		{"[2001:db8::1]:1234", false},
+		// Unix sockets
+		{"@", true},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		if r := IsTrustedProxy(test.remoteAddr, trusted); r != test.expected {
+			t.Errorf("IsTrustedProxy(%q): expected %t, got %t", test.remoteAddr, test.expected, r)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+// Package pgp produces the OpenPGP detached signatures of the checksums
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	ErrNoSigningKey = errors.New("pgp: no usable signing key found")
+	ErrProtectedKey = errors.New("pgp: the signing key is protected by a passphrase")
+)
+
+// PrivateKey is an OpenPGP secret key able to sign, either with
+// its primary key or with one of its subkeys
+type PrivateKey struct {
+	entity *openpgp.Entity
+	signer *packet.PrivateKey
+}
+
+// KeyID returns the 64-bit identifier of the signing (sub)key
+func (k *PrivateKey) KeyID() uint64 {
+	return k.signer.KeyId
+}
+
+// String returns the fingerprint of the signing (sub)key in hexadecimal
+func (k *PrivateKey) String() string {
+	return fmt.Sprintf("%X", k.signer.Fingerprint)
+}
+
+// ReadPrivateKey reads a secret key exported either in binary or in
+// ASCII-armored form (gpg --export-secret-keys or --export-secret-subkeys)
+// and decrypts its signing key with the given passphrase if it is protected.
+func ReadPrivateKey(r io.Reader, passphrase []byte) (*PrivateKey, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range keyring {
+		// The newest valid signing subkey is preferred to the primary key
+		key, ok := e.SigningKey(time.Now())
+		if !ok || key.PrivateKey == nil || key.PrivateKey.Dummy() {
+			continue
+		}
+		if key.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, ErrProtectedKey
+			}
+			if err := key.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, err
+			}
+		}
+		return &PrivateKey{entity: e, signer: key.PrivateKey}, nil
+	}
+	return nil, ErrNoSigningKey
+}
+
+// Sign returns a detached signature of the given data made at the given time
+func (k *PrivateKey) Sign(data []byte, t time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.DetachSign(&b, k.entity, bytes.NewReader(data), k.config(t)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ArmoredSign returns an ASCII-armored detached signature of the given data
+func (k *PrivateKey) ArmoredSign(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, k.entity, bytes.NewReader(data), k.config(time.Now())); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (k *PrivateKey) config(t time.Time) *packet.Config {
+	return &packet.Config{
+		DefaultHash:  crypto.SHA256,
+		SigningKeyId: k.signer.KeyId,
+		Time: func() time.Time {
+			return t
+		},
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"os/exec"
 	"reflect"
 	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -28,9 +29,9 @@ var (
 	log = logging.MustGetLogger("main")
 )
 
-// Launch {self} as a child process passing listener details
+// Launch {self} as a child process passing listeners details
 // to provide a seamless binary upgrade.
-func Relaunch(l net.Listener) error {
+func Relaunch(listeners ...net.Listener) error {
 	argv0, err := exec.LookPath(os.Args[0])
 	if err != nil {
 		return err
@@ -42,28 +43,45 @@ func Relaunch(l net.Listener) error {
 	if err != nil {
 		return err
 	}
-	v := reflect.ValueOf(l).Elem().FieldByName("fd").Elem()
-	fd := uintptr(v.FieldByName("sysfd").Int())
 
-	if fd < uintptr(syscall.Stderr) {
-		return Invalidfd
+	fds := make([]string, 0, len(listeners))
+	names := make([]string, 0, len(listeners))
+	passed := make(map[uintptr]*os.File)
+	maxfd := uintptr(syscall.Stderr)
+
+	for _, l := range listeners {
+		v := reflect.ValueOf(l).Elem().FieldByName("fd").Elem()
+		fd := uintptr(v.FieldByName("sysfd").Int())
+
+		if fd < uintptr(syscall.Stderr) {
+			return Invalidfd
+		}
+		if fd > maxfd {
+			maxfd = fd
+		}
+
+		fds = append(fds, fmt.Sprint(fd))
+		names = append(names, fmt.Sprintf("%s:%s->", l.Addr().Network(), l.Addr().String()))
+		passed[fd] = os.NewFile(fd, string(v.FieldByName("sysfile").String()))
 	}
 
-	if err := os.Setenv("OLD_FD", fmt.Sprint(fd)); err != nil {
+	if err := os.Setenv("OLD_FD", strings.Join(fds, ",")); err != nil {
 		return err
 	}
-	if err := os.Setenv("OLD_NAME", fmt.Sprintf("tcp:%s->", l.Addr().String())); err != nil {
+	if err := os.Setenv("OLD_NAME", strings.Join(names, ",")); err != nil {
 		return err
 	}
 	if err := os.Setenv("OLD_PPID", fmt.Sprint(syscall.Getpid())); err != nil {
 		return err
 	}
 
-	files := make([]*os.File, fd+1)
+	files := make([]*os.File, maxfd+1)
 	files[syscall.Stdin] = os.Stdin
 	files[syscall.Stdout] = os.Stdout
 	files[syscall.Stderr] = os.Stderr
-	files[fd] = os.NewFile(fd, string(v.FieldByName("sysfile").String()))
+	for fd, f := range passed {
+		files[fd] = f
+	}
 	p, err := os.StartProcess(argv0, os.Args, &os.ProcAttr{
 		Dir:   wd,
 		Env:   os.Environ(),
@@ -77,31 +95,44 @@ func Relaunch(l net.Listener) error {
 	return nil
 }
 
-// Recover from a seamless binary upgrade and use an already
-// existing listener to take over the connections
-func Recover() (l net.Listener, ppid int, err error) {
-	var fd uintptr
-	_, err = fmt.Sscan(os.Getenv("OLD_FD"), &fd)
-	if err != nil {
-		return
-	}
-	var i net.Listener
-	i, err = net.FileListener(os.NewFile(fd, os.Getenv("OLD_NAME")))
-	if err != nil {
+// Recover from a seamless binary upgrade and use the already
+// existing listeners to take over the connections. The listeners
+// are returned in the same order they were given to Relaunch.
+func Recover() (listeners []net.Listener, ppid int, err error) {
+	oldfds := os.Getenv("OLD_FD")
+	if oldfds == "" {
+		err = errors.New("no listener to recover")
 		return
 	}
-	switch i.(type) {
-	case *net.TCPListener:
-		l = i.(*net.TCPListener)
-	case *net.UnixListener:
-		l = i.(*net.UnixListener)
-	default:
-		err = errors.New(fmt.Sprintf(
-			"file descriptor is %T not *net.TCPListener or *net.UnixListener", i))
-		return
-	}
-	if err = syscall.Close(int(fd)); err != nil {
-		return
+	names := strings.Split(os.Getenv("OLD_NAME"), ",")
+
+	for i, s := range strings.Split(oldfds, ",") {
+		var fd uintptr
+		_, err = fmt.Sscan(s, &fd)
+		if err != nil {
+			return
+		}
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		var l net.Listener
+		l, err = net.FileListener(os.NewFile(fd, name))
+		if err != nil {
+			return
+		}
+		switch l.(type) {
+		case *net.TCPListener:
+		case *net.UnixListener:
+		default:
+			err = errors.New(fmt.Sprintf(
+				"file descriptor is %T not *net.TCPListener or *net.UnixListener", l))
+			return
+		}
+		if err = syscall.Close(int(fd)); err != nil {
+			return
+		}
+		listeners = append(listeners, l)
 	}
 	_, err = fmt.Sscan(os.Getenv("OLD_PPID"), &ppid)
 	if err != nil {
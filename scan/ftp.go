@@ -116,6 +116,11 @@ func (f *FTPScanner) walkFtp(c *ftp.ServerConn, files []*filedata, path string,
 			newf := &filedata{}
 			newf.path = path + e.Name
 			newf.size = int64(e.Size)
+			// The times returned by LIST lack a timezone and are often
+			// rounded to the day, only trust the ones coming from MLSD
+			if c.IsTimePreciseInList() {
+				newf.modTime = e.Time
+			}
 			files = append(files, newf)
 		} else if e.Type == ftp.EntryTypeFolder {
 			files, err = f.walkFtp(c, files, path+e.Name+"/", stop)
@@ -0,0 +1,316 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package scan
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/core"
+	"github.com/wsnipex/mirrorbits/utils"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Matches the links of an autoindex page
+	httpListingLink = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']+)["'][^>]*>.*?</a>`)
+	// Exact size in bytes at the end of a listing line (e.g. nginx)
+	httpListingSize = regexp.MustCompile(`\s(\d+)\s*$`)
+	htmlTags        = regexp.MustCompile(`<[^>]*>`)
+
+	// Regular file entry of an ls-lR listing
+	lslrFileLine = regexp.MustCompile(`^-\S*\s+\d+\s+\S+\s+\S+\s+(\d+)\s+\S+\s+\S+\s+\S+\s+(.+)$`)
+
+	httpScanUserAgent = "Mirrorbits/" + core.VERSION + " SCANNER"
+)
+
+// HTTPScanner indexes the content of a mirror available only over HTTP(S).
+// It uses the first file list (ls-lR or JSON manifest) found on the mirror
+// and falls back to crawling the autoindex pages of the web server.
+type HTTPScanner struct {
+	scan   *scan
+	client *http.Client
+}
+
+type httpManifestEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+func (h *HTTPScanner) Scan(scanurl, identifier string, conn redis.Conn, stop chan bool) error {
+	if !strings.HasPrefix(scanurl, "http://") && !strings.HasPrefix(scanurl, "https://") {
+		return fmt.Errorf("%s does not start with http:// or https://", scanurl)
+	}
+
+	base, err := url.Parse(utils.NormalizeURL(scanurl))
+	if err != nil {
+		return err
+	}
+
+	h.client = &http.Client{
+		Timeout: 60 * time.Second,
+	}
+
+	if utils.IsStopped(stop) {
+		return ScanAborted
+	}
+
+	var files []*filedata
+
+	for _, name := range GetConfig().HTTPScanFileLists {
+		u, err := base.Parse(name)
+		if err != nil {
+			continue
+		}
+		files, err = h.fetchFileList(u)
+		if err == nil {
+			log.Infof("[%s] Using the file list %s", identifier, u.String())
+			break
+		}
+		log.Debugf("[%s] File list %s unavailable: %s", identifier, u.String(), err.Error())
+		files = nil
+	}
+
+	if files == nil {
+		log.Infof("[%s] Crawling the file list via http...", identifier)
+
+		files = make([]*filedata, 0, 1000)
+		files, err = h.walkHTTP(base, base, files, make(map[string]bool), stop)
+		if err == ScanAborted {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("http error %s", err.Error())
+		}
+	}
+
+	for _, fd := range files {
+		if utils.IsStopped(stop) {
+			return ScanAborted
+		}
+		h.scan.ScannerAddFile(*fd)
+	}
+
+	return nil
+}
+
+func (h *HTTPScanner) get(u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", httpScanUserAgent)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned status %d", u.String(), resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// fetchFileList downloads and parses a file list provided by the mirror
+func (h *HTTPScanner) fetchFileList(u *url.URL) ([]*filedata, error) {
+	resp, err := h.get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	name := u.Path
+
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	if strings.HasSuffix(name, ".json") {
+		return parseJSONManifest(reader)
+	}
+	return parseLsLR(reader)
+}
+
+// parseJSONManifest parses a list of files of the form
+// [{"path": "/dir/file", "size": 1234, "modtime": "2015-01-02T15:04:05Z"}, ...]
+// where the modification time is optional
+func parseJSONManifest(r io.Reader) ([]*filedata, error) {
+	var entries []httpManifestEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	files := make([]*filedata, 0, len(entries))
+	for _, e := range entries {
+		if e.Path == "" {
+			continue
+		}
+		files = append(files, &filedata{
+			path:    "/" + strings.TrimLeft(e.Path, "/"),
+			size:    e.Size,
+			modTime: e.ModTime,
+		})
+	}
+	return files, nil
+}
+
+// parseLsLR parses the output of a recursive 'ls -lR'
+func parseLsLR(r io.Reader) ([]*filedata, error) {
+	files := make([]*filedata, 0, 1000)
+	dir := "/"
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if strings.HasSuffix(line, ":") && !strings.HasPrefix(line, "-") {
+			// New directory
+			dir = strings.TrimSuffix(line, ":")
+			dir = strings.TrimPrefix(strings.TrimPrefix(dir, "."), "/")
+			dir = "/" + dir
+			if !strings.HasSuffix(dir, "/") {
+				dir += "/"
+			}
+			continue
+		}
+
+		m := lslrFileLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		size, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, &filedata{
+			path: dir + m[2],
+			size: size,
+		})
+	}
+	return files, scanner.Err()
+}
+
+// Walk inside the autoindex pages of an HTTP repository
+func (h *HTTPScanner) walkHTTP(base, dir *url.URL, files []*filedata, visited map[string]bool, stop chan bool) ([]*filedata, error) {
+	if utils.IsStopped(stop) {
+		return nil, ScanAborted
+	}
+
+	visited[dir.Path] = true
+
+	resp, err := h.get(dir)
+	if err != nil {
+		return files, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	resp.Body.Close()
+	if err != nil {
+		return files, err
+	}
+	body := string(data)
+
+	links := httpListingLink.FindAllStringSubmatchIndex(body, -1)
+	for i, m := range links {
+		href := body[m[2]:m[3]]
+
+		// The size of the file, if any, is found between
+		// the end of this link and the start of the next one
+		end := len(body)
+		if i+1 < len(links) {
+			end = links[i+1][0]
+		}
+		if n := strings.Index(body[m[1]:end], "\n"); n >= 0 {
+			end = m[1] + n
+		}
+		following := body[m[1]:end]
+
+		// Skip the sorting links, anchors and absolute links to other hosts
+		if strings.ContainsAny(href, "?#") {
+			continue
+		}
+
+		u, err := dir.Parse(href)
+		if err != nil || u.Host != base.Host || u.Scheme != base.Scheme {
+			continue
+		}
+
+		// Only follow the links below the current directory
+		if !strings.HasPrefix(u.Path, dir.Path) || u.Path == dir.Path {
+			continue
+		}
+
+		if strings.HasSuffix(u.Path, "/") {
+			if visited[u.Path] {
+				continue
+			}
+			files, err = h.walkHTTP(base, u, files, visited, stop)
+			if err != nil {
+				return files, err
+			}
+			continue
+		}
+
+		fd := &filedata{
+			path: path.Clean("/" + strings.TrimPrefix(u.Path, base.Path)),
+		}
+
+		// Use the exact size if the listing provides it
+		text := strings.TrimSpace(htmlTags.ReplaceAllString(following, " "))
+		if s := httpListingSize.FindStringSubmatch(" " + text); s != nil {
+			fd.size, _ = strconv.ParseInt(s[1], 10, 64)
+		} else {
+			// Human readable sizes are not precise enough
+			fd.size, err = h.headSize(u)
+			if err != nil {
+				log.Warningf("Cannot get the size of %s: %s", u.String(), err.Error())
+				continue
+			}
+		}
+
+		files = append(files, fd)
+	}
+	return files, nil
+}
+
+// headSize returns the size of a remote file as announced by the server
+func (h *HTTPScanner) headSize(u *url.URL) (int64, error) {
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", httpScanUserAgent)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("unknown content length")
+	}
+	return resp.ContentLength, nil
+}
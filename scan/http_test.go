@@ -0,0 +1,162 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package scan
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLsLR(t *testing.T) {
+	listing := `.:
+total 8
+drwxr-xr-x 2 ftp ftp 4096 Jan  2  2015 dir
+-rw-r--r-- 1 ftp ftp 1234 Jan  2  2015 README
+lrwxrwxrwx 1 ftp ftp    6 Jan  2  2015 link -> README
+
+./dir:
+total 4
+-rw-r--r-- 1 ftp ftp 56789 Jan  2 15:04 file with spaces.iso
+`
+	files, err := parseLsLR(strings.NewReader(listing))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(files))
+	}
+	if files[0].path != "/README" || files[0].size != 1234 {
+		t.Fatalf("Unexpected file %s (%d)", files[0].path, files[0].size)
+	}
+	if files[1].path != "/dir/file with spaces.iso" || files[1].size != 56789 {
+		t.Fatalf("Unexpected file %s (%d)", files[1].path, files[1].size)
+	}
+}
+
+func TestParseJSONManifest(t *testing.T) {
+	manifest := `[
+		{"path": "dir/a.iso", "size": 10, "modtime": "2015-01-02T15:04:05Z"},
+		{"path": "/b.iso", "size": 20},
+		{"size": 30}
+	]`
+	files, err := parseJSONManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(files))
+	}
+	if files[0].path != "/dir/a.iso" || files[0].size != 10 || !files[0].modTime.Equal(time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Fatalf("Unexpected file %+v", files[0])
+	}
+	if files[1].path != "/b.iso" || files[1].size != 20 || !files[1].modTime.IsZero() {
+		t.Fatalf("Unexpected file %+v", files[1])
+	}
+
+	if _, err := parseJSONManifest(strings.NewReader("{")); err == nil {
+		t.Fatalf("Error expected")
+	}
+}
+
+func TestHTTPScanner_fetchFileList(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`[{"path": "/a.iso", "size": 10}]`))
+	w.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/ls-lR":
+			fmt.Fprint(w, ".:\n-rw-r--r-- 1 ftp ftp 42 Jan  2  2015 b.iso\n")
+		case "/repo/files.json.gz":
+			w.Write(gz.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	h := &HTTPScanner{client: ts.Client()}
+
+	u, _ := url.Parse(ts.URL + "/repo/ls-lR")
+	files, err := h.fetchFileList(u)
+	if err != nil || len(files) != 1 || files[0].path != "/b.iso" || files[0].size != 42 {
+		t.Fatalf("Unexpected ls-lR result: %v %v", files, err)
+	}
+
+	u, _ = url.Parse(ts.URL + "/repo/files.json.gz")
+	files, err = h.fetchFileList(u)
+	if err != nil || len(files) != 1 || files[0].path != "/a.iso" || files[0].size != 10 {
+		t.Fatalf("Unexpected manifest result: %v %v", files, err)
+	}
+
+	u, _ = url.Parse(ts.URL + "/repo/missing.json")
+	if _, err = h.fetchFileList(u); err == nil {
+		t.Fatalf("Error expected for a missing file list")
+	}
+}
+
+func TestHTTPScanner_walkHTTP(t *testing.T) {
+	pages := map[string]string{
+		// nginx autoindex with exact sizes
+		"/repo/": `<html><body><h1>Index of /repo/</h1><hr><pre><a href="../">../</a>
+<a href="dir/">dir/</a>                                               02-Jan-2015 15:04       -
+<a href="a.iso">a.iso</a>                                             02-Jan-2015 15:04    1234
+<a href="?C=N;O=D">Name</a>
+<a href="http://other.example/x.iso">x.iso</a>
+</pre><hr></body></html>`,
+		// Apache autoindex with human readable sizes
+		"/repo/dir/": `<table><tr><td><a href="/repo/">Parent Directory</a></td></tr>
+<tr><td><a href="b.iso">b.iso</a></td><td align="right">2015-01-02 15:04  </td><td align="right">1.2M</td></tr>
+<tr><td><a href="./">.</a></td></tr>
+</table>`,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repo/dir/b.iso" {
+			w.Header().Set("Content-Length", "1234567")
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+	defer ts.Close()
+
+	h := &HTTPScanner{client: ts.Client()}
+	base, _ := url.Parse(ts.URL + "/repo/")
+
+	files, err := h.walkHTTP(base, base, nil, make(map[string]bool), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	var result []string
+	for _, f := range files {
+		result = append(result, fmt.Sprintf("%s %d", f.path, f.size))
+	}
+	sort.Strings(result)
+
+	expected := []string{"/a.iso 1234", "/dir/b.iso 1234567"}
+	if strings.Join(result, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, result)
+	}
+
+	stop := make(chan bool)
+	close(stop)
+	if _, err := h.walkHTTP(base, base, nil, make(map[string]bool), stop); err != ScanAborted {
+		t.Fatalf("Expected ScanAborted, got %v", err)
+	}
+}
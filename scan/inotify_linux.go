@@ -0,0 +1,135 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package scan
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+		syscall.IN_DELETE | syscall.IN_CREATE | syscall.IN_ATTRIB
+)
+
+// inotifyWatcher reports the changes happening inside the watched
+// directories using the inotify API of the Linux kernel
+type inotifyWatcher struct {
+	sync.Mutex
+	fd      int
+	file    *os.File
+	watches map[int32]string
+	events  chan fsEvent
+	closed  bool
+}
+
+func newFSWatcher() (fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]string),
+		events:  make(chan fsEvent, 1000),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Add starts watching the given directory
+func (w *inotifyWatcher) Add(dir string) error {
+	w.Lock()
+	defer w.Unlock()
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask|syscall.IN_ONLYDIR|syscall.IN_DONT_FOLLOW)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.watches[int32(wd)] = dir
+	return nil
+}
+
+// Remove stops watching the given directory and all its subdirectories
+func (w *inotifyWatcher) Remove(dir string) {
+	w.Lock()
+	defer w.Unlock()
+
+	for wd, path := range w.watches {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) Events() <-chan fsEvent {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	w.Lock()
+	w.closed = true
+	w.Unlock()
+	return w.file.Close()
+}
+
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.events)
+
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil {
+			w.Lock()
+			if !w.closed {
+				log.Errorf("[source] inotify: %s", err.Error())
+			}
+			w.Unlock()
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.events <- fsEvent{overflow: true}
+				continue
+			}
+
+			w.Lock()
+			dir, ok := w.watches[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				// The directory has been removed
+				delete(w.watches, raw.Wd)
+			}
+			w.Unlock()
+
+			if !ok || name == "" {
+				continue
+			}
+			if raw.Mask == syscall.IN_CREATE {
+				// Wait for the content of the new file to be written
+				continue
+			}
+
+			w.events <- fsEvent{
+				path:    filepath.Join(dir, name),
+				isDir:   raw.Mask&syscall.IN_ISDIR != 0,
+				created: raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+				removed: raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0,
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+//go:build !linux
+// +build !linux
+
+package scan
+
+import (
+	"errors"
+)
+
+func newFSWatcher() (fsWatcher, error) {
+	return nil, errors.New("watching the repository is only supported on Linux")
+}
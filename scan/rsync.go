@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -112,6 +113,13 @@ func (r *RsyncScanner) Scan(url, identifier string, conn redis.Conn, stop chan b
 		f.size = size
 		f.path = ret[4]
 
+		// rsync lists the modification times in our local timezone
+		f.modTime, err = time.ParseInLocation("2006/01/02 15:04:05", ret[2]+" "+ret[3], time.Local)
+		if err != nil {
+			log.Warningf("[%s] ScanRsync: Invalid modification time: %s %s", identifier, ret[2], ret[3])
+			err = nil
+		}
+
 		if os.Getenv("DEBUG") != "" {
 			//fmt.Printf("[%s] %s", identifier, f.path)
 		}
@@ -9,12 +9,14 @@ import (
 	. "github.com/wsnipex/mirrorbits/config"
 	"github.com/wsnipex/mirrorbits/database"
 	"github.com/wsnipex/mirrorbits/filesystem"
+	"github.com/wsnipex/mirrorbits/metrics"
 	"github.com/wsnipex/mirrorbits/utils"
 	"github.com/garyburd/redigo/redis"
 	"github.com/op/go-logging"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -22,6 +24,15 @@ var (
 	ScanAborted    = errors.New("scan aborted")
 	ScanInProgress = errors.New("scan already in progress")
 
+	scanDuration = metrics.NewGauge("mirrorbits_scan_duration_seconds",
+		"Duration of the last successful scan of a mirror", "mirror")
+	scanFiles = metrics.NewGauge("mirrorbits_scan_files",
+		"Number of files indexed during the last successful scan of a mirror", "mirror")
+	scanKnownFiles = metrics.NewGauge("mirrorbits_scan_known_files",
+		"Number of files found both on a mirror and in the local repository", "mirror")
+	scanFailures = metrics.NewCounter("mirrorbits_scan_failures_total",
+		"Number of failed scans of a mirror", "mirror")
+
 	log = logging.MustGetLogger("main")
 )
 
@@ -30,6 +41,7 @@ type ScannerType int8
 const (
 	RSYNC ScannerType = iota
 	FTP
+	HTTP
 )
 
 type Scanner interface {
@@ -40,6 +52,8 @@ type filedata struct {
 	path    string
 	sha1    string
 	sha256  string
+	sha512  string
+	blake2b string
 	md5     string
 	size    int64
 	modTime time.Time
@@ -48,6 +62,7 @@ type filedata struct {
 type scan struct {
 	redis           *database.Redis
 	walkSourceFiles []*filedata
+	walkHashFiles   []*filedata
 	walkRedisConn   redis.Conn
 
 	conn        redis.Conn
@@ -77,6 +92,10 @@ func Scan(typ ScannerType, r *database.Redis, url, identifier string, stop chan
 		scanner = &FTPScanner{
 			scan: s,
 		}
+	case HTTP:
+		scanner = &HTTPScanner{
+			scan: s,
+		}
 	default:
 		panic(fmt.Sprintf("Unknown scanner"))
 	}
@@ -104,6 +123,8 @@ func Scan(typ ScannerType, r *database.Redis, url, identifier string, stop chan
 		return ScanInProgress
 	}
 
+	start := time.Now()
+
 	s.setLastSync(conn, identifier, false)
 
 	conn.Send("MULTI")
@@ -122,6 +143,10 @@ func Scan(typ ScannerType, r *database.Redis, url, identifier string, stop chan
 		// Remove the temporary key
 		conn.Do("DEL", s.filesTmpKey)
 
+		if err != ScanAborted {
+			scanFailures.Inc(identifier)
+		}
+
 		log.Errorf("[%s] %s", identifier, err.Error())
 		return err
 	}
@@ -169,6 +194,11 @@ func Scan(typ ScannerType, r *database.Redis, url, identifier string, stop chan
 	}
 
 	s.setLastSync(conn, identifier, true)
+
+	scanDuration.Set(time.Since(start).Seconds(), identifier)
+	scanFiles.Set(float64(s.count), identifier)
+	scanKnownFiles.Set(float64(common), identifier)
+
 	log.Infof("[%s] Indexed %d files (%d known), %d removed", identifier, s.count, common, len(toremove))
 	return nil
 }
@@ -183,9 +213,15 @@ func (s *scan) ScannerAddFile(f filedata) {
 	rk := fmt.Sprintf("FILEMIRRORS_%s", f.path)
 	s.conn.Send("SADD", rk, s.identifier)
 
-	// Save the size of the current file found on this mirror
+	// Save the size and the modification time (if known) of
+	// the current file found on this mirror
 	ik := fmt.Sprintf("FILEINFO_%s_%s", s.identifier, f.path)
-	s.conn.Send("HSET", ik, "size", f.size)
+	if f.modTime.IsZero() {
+		s.conn.Send("HSET", ik, "size", f.size)
+		s.conn.Send("HDEL", ik, "modTime")
+	} else {
+		s.conn.Send("HMSET", ik, "size", f.size, "modTime", f.modTime)
+	}
 
 	// Publish update
 	database.SendPublish(s.conn, database.MIRROR_FILE_UPDATE, fmt.Sprintf("%s %s", s.identifier, f.path))
@@ -208,9 +244,10 @@ func (s *scan) setLastSync(conn redis.Conn, identifier string, successful bool)
 	// Set the last sync time
 	conn.Send("HSET", fmt.Sprintf("MIRROR_%s", identifier), "lastSync", now)
 
-	// Set the last successful sync time
+	// Set the last successful sync time and reset the backoff
 	if successful {
-		conn.Send("HSET", fmt.Sprintf("MIRROR_%s", identifier), "lastSuccessfulSync", now)
+		conn.Send("HMSET", fmt.Sprintf("MIRROR_%s", identifier), "lastSuccessfulSync", now, "scanFailures", 0)
+		conn.Send("HDEL", fmt.Sprintf("MIRROR_%s", identifier), "scanFailedSince")
 	}
 
 	_, err := conn.Do("EXEC")
@@ -227,55 +264,136 @@ func (s *scan) walkSource(path string, f os.FileInfo, err error) error {
 		return nil
 	}
 
-	d := new(filedata)
-	d.path = path[len(GetConfig().Repository):]
+	d, rehash, err := sourceFileData(s.walkRedisConn, path[len(GetConfig().Repository):], f)
+	if err != nil {
+		return err
+	}
+
+	s.walkSourceFiles = append(s.walkSourceFiles, d)
+	if rehash {
+		s.walkHashFiles = append(s.walkHashFiles, d)
+	}
+	return nil
+}
+
+// sourceFileData returns the properties of a file of the local repository
+// as they have been indexed. The file must be hashed again if rehash is true.
+func sourceFileData(conn redis.Conn, path string, f os.FileInfo) (d *filedata, rehash bool, err error) {
+	d = new(filedata)
+	d.path = path
 	d.size = f.Size()
 	d.modTime = f.ModTime()
 
 	// Get the previous file properties
-	properties, err := redis.Strings(s.walkRedisConn.Do("HMGET", fmt.Sprintf("FILE_%s", d.path), "size", "modTime", "sha1", "sha256", "md5"))
+	properties, err := redis.Strings(conn.Do("HMGET", fmt.Sprintf("FILE_%s", d.path), "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b"))
 	if err != nil && err != redis.ErrNil {
-		return err
-	} else if len(properties) < 5 {
+		return nil, false, err
+	} else if len(properties) < 7 {
 		// This will force a rehash
-		properties = make([]string, 5)
+		properties = make([]string, 7)
 	}
 
 	size, _ := strconv.ParseInt(properties[0], 10, 64)
 	modTime, _ := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", properties[1])
-	sha1 := properties[2]
-	sha256 := properties[3]
-	md5 := properties[4]
+	d.sha1 = properties[2]
+	d.sha256 = properties[3]
+	d.md5 = properties[4]
+	d.sha512 = properties[5]
+	d.blake2b = properties[6]
+
+	rehash = (GetConfig().Hashes.SHA1 && len(d.sha1) == 0) ||
+		(GetConfig().Hashes.SHA256 && len(d.sha256) == 0) ||
+		(GetConfig().Hashes.SHA512 && len(d.sha512) == 0) ||
+		(GetConfig().Hashes.BLAKE2b && len(d.blake2b) == 0) ||
+		(GetConfig().Hashes.MD5 && len(d.md5) == 0) ||
+		size != d.size || !modTime.Equal(d.modTime)
+
+	return d, rehash, nil
+}
 
-	rehash := (GetConfig().Hashes.SHA1 && len(sha1) == 0) ||
-		(GetConfig().Hashes.SHA256 && len(sha256) == 0) ||
-		(GetConfig().Hashes.MD5 && len(md5) == 0)
+// hashSourceFile computes the hashes of a file of the local repository
+func hashSourceFile(d *filedata) {
+	h, err := filesystem.HashFile(GetConfig().Repository + d.path)
+	if err != nil {
+		log.Warningf("%s: hashing failed: %s", d.path, err.Error())
+		d.sha1, d.sha256, d.sha512, d.blake2b, d.md5 = "", "", "", "", ""
+		return
+	}
+	d.sha1 = h.Sha1
+	d.sha256 = h.Sha256
+	d.sha512 = h.Sha512
+	d.blake2b = h.Blake2b
+	d.md5 = h.Md5
+	if len(d.sha1) > 0 {
+		log.Infof("%s: SHA1 %s", d.path, d.sha1)
+	}
+	if len(d.sha256) > 0 {
+		log.Infof("%s: SHA256 %s", d.path, d.sha256)
+	}
+	if len(d.sha512) > 0 {
+		log.Infof("%s: SHA512 %s", d.path, d.sha512)
+	}
+	if len(d.blake2b) > 0 {
+		log.Infof("%s: BLAKE2b %s", d.path, d.blake2b)
+	}
+	if len(d.md5) > 0 {
+		log.Infof("%s: MD5 %s", d.path, d.md5)
+	}
+}
 
-	if rehash || size != d.size || !modTime.Equal(d.modTime) {
-		h, err := filesystem.HashFile(GetConfig().Repository + d.path)
-		if err != nil {
-			log.Warningf("%s: hashing failed: %s", d.path, err.Error())
-		} else {
-			d.sha1 = h.Sha1
-			d.sha256 = h.Sha256
-			d.md5 = h.Md5
-			if len(d.sha1) > 0 {
-				log.Infof("%s: SHA1 %s", d.path, d.sha1)
-			}
-			if len(d.sha256) > 0 {
-				log.Infof("%s: SHA256 %s", d.path, d.sha256)
-			}
-			if len(d.md5) > 0 {
-				log.Infof("%s: MD5 %s", d.path, d.md5)
+// sendSourceFile queues the update of the index of a file of the local repository
+func sendSourceFile(conn redis.Conn, d *filedata) {
+	conn.Send("HMSET", fmt.Sprintf("FILE_%s", d.path),
+		"size", d.size,
+		"modTime", d.modTime,
+		"sha1", d.sha1,
+		"sha256", d.sha256,
+		"sha512", d.sha512,
+		"blake2b", d.blake2b,
+		"md5", d.md5)
+
+	// Publish update
+	database.SendPublish(conn, database.FILE_UPDATE, d.path)
+}
+
+// hashSourceFiles hashes the given files using a pool of workers
+func hashSourceFiles(files []*filedata, stop chan bool) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	workers := utils.Min(GetConfig().Hashes.Workers, len(files))
+	log.Infof("[source] Hashing %d file%s using %d worker%s...", len(files), utils.Plural(len(files)), workers, utils.Plural(workers))
+
+	jobs := make(chan *filedata)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				hashSourceFile(d)
 			}
+		}()
+	}
+
+	aborted := false
+	for _, d := range files {
+		select {
+		case <-stop:
+			aborted = true
+		case jobs <- d:
+		}
+		if aborted {
+			break
 		}
-	} else {
-		d.sha1 = sha1
-		d.sha256 = sha256
-		d.md5 = md5
 	}
+	close(jobs)
+	wg.Wait()
 
-	s.walkSourceFiles = append(s.walkSourceFiles, d)
+	if aborted {
+		return ScanAborted
+	}
 	return nil
 }
 
@@ -293,12 +411,16 @@ func ScanSource(r *database.Redis, stop chan bool) (err error) {
 
 	s.walkSourceFiles = make([]*filedata, 0, 1000)
 	defer func() {
-		// Reset the slice so it can be garbage collected
+		// Reset the slices so they can be garbage collected
 		s.walkSourceFiles = nil
+		s.walkHashFiles = nil
 	}()
 
 	//TODO lock atomically inside redis to avoid two simultanous scan
 
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+
 	if _, err := os.Stat(GetConfig().Repository); os.IsNotExist(err) {
 		return fmt.Errorf("%s: No such file or directory", GetConfig().Repository)
 	}
@@ -311,6 +433,11 @@ func ScanSource(r *database.Redis, stop chan bool) (err error) {
 	if err != nil {
 		return err
 	}
+
+	if err = hashSourceFiles(s.walkHashFiles, stop); err != nil {
+		return err
+	}
+
 	log.Info("[source] Indexing the files...")
 
 	s.walkRedisConn.Send("MULTI")
@@ -336,15 +463,7 @@ func ScanSource(r *database.Redis, stop chan bool) (err error) {
 	// Create/Update the files' hash keys with the fresh infos
 	s.walkRedisConn.Send("MULTI")
 	for _, e := range s.walkSourceFiles {
-		s.walkRedisConn.Send("HMSET", fmt.Sprintf("FILE_%s", e.path),
-			"size", e.size,
-			"modTime", e.modTime,
-			"sha1", e.sha1,
-			"sha256", e.sha256,
-			"md5", e.md5)
-
-		// Publish update
-		database.SendPublish(s.walkRedisConn, database.FILE_UPDATE, e.path)
+		sendSourceFile(s.walkRedisConn, e)
 	}
 
 	// Remove old keys
@@ -0,0 +1,358 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package scan
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/database"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWatchOverflow is returned when some changes of the repository have been lost
+	ErrWatchOverflow = errors.New("too many changes in the repository, events lost")
+
+	// Delay without any new event on a file before indexing it
+	watchSettleDelay = 2 * time.Second
+
+	// The changes are indexed anyway after this delay or once this
+	// many paths are pending, even if the repository is still changing
+	watchMaxDelay   = 30 * time.Second
+	watchMaxPending = 10000
+
+	// Number of files requested at once when looking for the content
+	// of the removed directories
+	scanBatchSize = 1000
+
+	// Prevents the watcher from indexing files while the
+	// whole repository is being scanned
+	sourceLock sync.Mutex
+)
+
+// fsEvent represents a change inside a watched directory
+type fsEvent struct {
+	path     string
+	isDir    bool
+	created  bool
+	removed  bool
+	overflow bool
+}
+
+// fsWatcher is implemented by the platform specific watchers
+type fsWatcher interface {
+	Add(dir string) error
+	Remove(dir string)
+	Events() <-chan fsEvent
+	Close() error
+}
+
+// WatchSource keeps the index of the local repository up to date by applying
+// the changes reported by the filesystem until stop is closed. The periodic
+// scan of the repository is still required to catch the missed events.
+func WatchSource(r *database.Redis, stop chan bool) error {
+	w, err := newFSWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		w.Close()
+		// Unblock the reader
+		for range w.Events() {
+		}
+	}()
+
+	root := GetConfig().Repository
+	if _, err := watchTree(w, root); err != nil {
+		return err
+	}
+
+	log.Infof("[source] Watching %s for changes", root)
+
+	// Changed paths waiting for the settle delay (path -> is a directory)
+	pending := make(map[string]bool)
+	settle := time.NewTimer(watchSettleDelay)
+	settle.Stop()
+	defer settle.Stop()
+
+	// Time of the oldest pending change
+	var oldest time.Time
+
+	// The changes are applied in the background so that the events keep
+	// being read while the new files are hashed
+	batches := make(chan map[string]bool)
+	applied := make(chan bool)
+	go func() {
+		defer close(applied)
+		for paths := range batches {
+			if err := applySourceChanges(r, root, paths, stop); err != nil {
+				log.Errorf("[source] Cannot apply the changes: %s", err.Error())
+			}
+		}
+	}()
+	defer func() {
+		close(batches)
+		<-applied
+	}()
+
+	// flush hands the pending changes over unless the previous ones are
+	// still being applied, in which case they are kept for the next try.
+	// Once the pending changes are too many, it waits for its turn.
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if len(pending) >= watchMaxPending {
+			select {
+			case batches <- pending:
+			case <-stop:
+				return
+			}
+		} else {
+			select {
+			case batches <- pending:
+			default:
+				settle.Reset(watchSettleDelay)
+				return
+			}
+		}
+		pending = make(map[string]bool)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case e, ok := <-w.Events():
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			if e.overflow {
+				return ErrWatchOverflow
+			}
+			if len(pending) == 0 {
+				oldest = time.Now()
+			}
+			if e.isDir {
+				if e.removed {
+					w.Remove(e.path)
+				}
+				if e.created {
+					// Watch the new directory and index its content
+					files, err := watchTree(w, e.path)
+					if err != nil {
+						log.Warningf("[source] Cannot watch %s: %s", e.path, err.Error())
+					}
+					for _, f := range files {
+						pending[f] = false
+					}
+				}
+			}
+			pending[e.path] = pending[e.path] || e.isDir
+
+			// Don't wait forever for a file being continuously written
+			if len(pending) >= watchMaxPending || time.Since(oldest) >= watchMaxDelay {
+				settle.Stop()
+				flush()
+			} else {
+				settle.Reset(watchSettleDelay)
+			}
+		case <-settle.C:
+			flush()
+		}
+	}
+}
+
+// watchTree watches the given directory and all its subdirectories
+// and returns the files found inside
+func watchTree(w fsWatcher, dir string) (files []string, err error) {
+	err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			// Skip the unreadable directories
+			return nil
+		}
+		if f.IsDir() {
+			return w.Add(path)
+		}
+		files = append(files, path)
+		return nil
+	})
+	return
+}
+
+// applySourceChanges updates the index of the given paths of the repository.
+// The new and modified files are hashed without holding sourceLock.
+func applySourceChanges(r *database.Redis, root string, paths map[string]bool, stop chan bool) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	indexed, rehash, removed, err := collectSourceChanges(conn, root, paths)
+	if err != nil {
+		return err
+	}
+
+	if err := hashSourceFiles(rehash, stop); err != nil {
+		return err
+	}
+
+	if len(indexed) > 0 {
+		sourceLock.Lock()
+		err = indexSourceFiles(conn, indexed)
+		sourceLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(indexed) > 0 || removed > 0 {
+		log.Infof("[source] %d file(s) indexed, %d removed", len(indexed), removed)
+	}
+	return nil
+}
+
+// collectSourceChanges removes the missing paths from the index and returns
+// the files to index along with the ones that must be hashed first
+func collectSourceChanges(conn redis.Conn, root string, paths map[string]bool) (indexed, rehash []*filedata, removed int, err error) {
+	sourceLock.Lock()
+	defer sourceLock.Unlock()
+
+	var files, dirs []string
+
+	for fullpath, isDir := range paths {
+		if !strings.HasPrefix(fullpath, root+"/") {
+			continue
+		}
+		path := fullpath[len(root):]
+
+		f, err := os.Lstat(fullpath)
+		if err == nil && f.IsDir() {
+			// Its content is reported separately
+			continue
+		} else if err == nil && f.Mode().IsRegular() {
+			d, hash, err := sourceFileData(conn, path, f)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			indexed = append(indexed, d)
+			if hash {
+				rehash = append(rehash, d)
+			}
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Warningf("[source] %s: %s", path, err.Error())
+			continue
+		}
+
+		// The file (or the directory) doesn't exist anymore
+		if isDir {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, path)
+		}
+	}
+
+	removed, err = removeSourceFiles(conn, files, dirs)
+	return
+}
+
+// indexSourceFiles adds or updates the given files of the repository
+func indexSourceFiles(conn redis.Conn, files []*filedata) error {
+	conn.Send("MULTI")
+	for _, d := range files {
+		sendSourceFile(conn, d)
+		conn.Send("SADD", "FILES", d.path)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// removeSourceFiles removes the given files from the index as well as all
+// the files the given directories contained and returns the number of files
+// removed. The files of a directory are usually reported one by one before
+// the directory itself, so the index only has to be searched when a whole
+// directory was moved out of the repository.
+func removeSourceFiles(conn redis.Conn, files, dirs []string) (int, error) {
+	var paths []string
+
+	// A removed file may also belong to a removed directory
+	seen := make(map[string]bool)
+
+	for _, path := range files {
+		exists, err := redis.Bool(conn.Do("SISMEMBER", "FILES", path))
+		if err != nil {
+			return 0, err
+		}
+		if exists && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	if len(dirs) > 0 {
+		content, err := filesInDirs(conn, dirs)
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range content {
+			if !seen[f] {
+				seen[f] = true
+				paths = append(paths, f)
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	conn.Send("MULTI")
+	for _, p := range paths {
+		conn.Send("SREM", "FILES", p)
+		conn.Send("DEL", fmt.Sprintf("FILE_%s", p))
+		database.SendPublish(conn, database.FILE_UPDATE, p)
+	}
+	_, err := conn.Do("EXEC")
+	return len(paths), err
+}
+
+// filesInDirs returns the indexed files found below the given directories
+// in a single incremental iteration over the index
+func filesInDirs(conn redis.Conn, dirs []string) ([]string, error) {
+	var files []string
+
+	removed := make(map[string]bool, len(dirs))
+	for _, d := range dirs {
+		removed[d] = true
+	}
+
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", "FILES", cursor, "COUNT", scanBatchSize))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err = redis.Scan(values, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		for _, f := range batch {
+			// Look for a removed parent
+			for dir := filepath.Dir(f); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+				if removed[dir] {
+					files = append(files, f)
+					break
+				}
+			}
+		}
+		if cursor == 0 {
+			return files, nil
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package scan
+
+import (
+	"github.com/wsnipex/mirrorbits/database"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"github.com/rafaeljusto/redigomock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// expectRemoval registers the commands removing the given path from the index
+func expectRemoval(mock *redigomock.Conn, path string) (srem, del *redigomock.Cmd) {
+	srem = mock.Command("SREM", "FILES", path)
+	del = mock.Command("DEL", "FILE_"+path)
+	mock.Command("PUBLISH", string(database.FILE_UPDATE), path)
+	return
+}
+
+func TestRemoveSourceFiles_Files(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	c := conn.Get()
+
+	mock.Command("SISMEMBER", "FILES", "/a").Expect(int64(1))
+	mock.Command("SISMEMBER", "FILES", "/b").Expect(int64(0))
+	mock.Command("MULTI")
+	srem, del := expectRemoval(mock, "/a")
+	sremB, _ := expectRemoval(mock, "/b")
+	mock.Command("EXEC").Expect([]interface{}{int64(1), int64(1), int64(0)})
+
+	n, err := removeSourceFiles(c, []string{"/a", "/b"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 file removed, got %d", n)
+	}
+	if mock.Stats(srem) != 1 || mock.Stats(del) != 1 {
+		t.Fatalf("/a should have been removed from the index")
+	}
+	if mock.Stats(sremB) != 0 {
+		t.Fatalf("/b is not indexed and should have been ignored")
+	}
+}
+
+func TestRemoveSourceFiles_Dirs(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	c := conn.Get()
+
+	scanBatchSize = 2
+	defer func() { scanBatchSize = 1000 }()
+
+	// The index is returned in two batches
+	first := mock.Command("SSCAN", "FILES", 0, "COUNT", 2).Expect([]interface{}{
+		[]byte("7"),
+		[]interface{}{[]byte("/dir/a"), []byte("/dirb/c")},
+	})
+	second := mock.Command("SSCAN", "FILES", 7, "COUNT", 2).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("/dir/sub/b"), []byte("/d")},
+	})
+	mock.Command("SISMEMBER", "FILES", "/dir/a").Expect(int64(1))
+	mock.Command("MULTI")
+	sremA, _ := expectRemoval(mock, "/dir/a")
+	sremB, _ := expectRemoval(mock, "/dir/sub/b")
+	sremC, _ := expectRemoval(mock, "/dirb/c")
+	sremD, _ := expectRemoval(mock, "/d")
+	mock.Command("EXEC").Expect([]interface{}{})
+
+	// /dir/a is reported both as a file and as the content of /dir
+	n, err := removeSourceFiles(c, []string{"/dir/a"}, []string{"/dir"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 files removed, got %d", n)
+	}
+	if mock.Stats(first) != 1 || mock.Stats(second) != 1 {
+		t.Fatalf("The index should have been scanned once")
+	}
+	if mock.Stats(sremA) != 1 {
+		t.Fatalf("/dir/a should have been removed once, got %d", mock.Stats(sremA))
+	}
+	if mock.Stats(sremB) != 1 {
+		t.Fatalf("/dir/sub/b should have been removed")
+	}
+	if mock.Stats(sremC) != 0 || mock.Stats(sremD) != 0 {
+		t.Fatalf("The files outside of /dir should have been kept")
+	}
+}
+
+func TestRemoveSourceFiles_Nothing(t *testing.T) {
+	mock, conn := PrepareRedisTest()
+	c := conn.Get()
+
+	multi := mock.Command("MULTI")
+
+	n, err := removeSourceFiles(c, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != 0 {
+		t.Fatalf("Expected no file removed, got %d", n)
+	}
+	if mock.Stats(multi) != 0 {
+		t.Fatalf("No transaction expected")
+	}
+}
+
+func TestApplySourceChanges(t *testing.T) {
+	root, err := ioutil.TempDir("", "mirrorbits-watch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := LoadTestConfig("Repository: " + root + "\n"); err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err.Error())
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dir", "new"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mock, conn := PrepareRedisTest()
+
+	// New file
+	mock.Command("HMGET", "FILE_/dir/new", "size", "modTime", "sha1", "sha256", "md5", "sha512", "blake2b")
+	hmset := mock.Command("HMSET", "FILE_/dir/new",
+		"size", int64(3),
+		"modTime", redigomock.NewAnyData(),
+		"sha1", "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"sha256", "",
+		"sha512", "",
+		"blake2b", "",
+		"md5", "")
+	sadd := mock.Command("SADD", "FILES", "/dir/new")
+	mock.Command("PUBLISH", string(database.FILE_UPDATE), "/dir/new")
+
+	// Removed file and directory
+	mock.Command("SISMEMBER", "FILES", "/old").Expect(int64(1))
+	mock.Command("SSCAN", "FILES", 0, "COUNT", scanBatchSize).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("/dir/new"), []byte("/old"), []byte("/gone/a"), []byte("/gone/b")},
+	})
+	sremOld, _ := expectRemoval(mock, "/old")
+	sremA, _ := expectRemoval(mock, "/gone/a")
+	sremB, _ := expectRemoval(mock, "/gone/b")
+	sremNew, _ := expectRemoval(mock, "/dir/new")
+
+	mock.Command("MULTI")
+	mock.Command("EXEC").Expect([]interface{}{})
+
+	err = applySourceChanges(conn, root, map[string]bool{
+		filepath.Join(root, "dir"):        true,
+		filepath.Join(root, "dir", "new"): false,
+		filepath.Join(root, "old"):        false,
+		filepath.Join(root, "gone"):       true,
+		"/outside/of/the/repository":      false,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if mock.Stats(hmset) != 1 || mock.Stats(sadd) != 1 {
+		t.Fatalf("/dir/new should have been indexed")
+	}
+	if mock.Stats(sremOld) != 1 || mock.Stats(sremA) != 1 || mock.Stats(sremB) != 1 {
+		t.Fatalf("/old and the content of /gone should have been removed")
+	}
+	if mock.Stats(sremNew) != 0 {
+		t.Fatalf("/dir/new should have been kept")
+	}
+}
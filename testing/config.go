@@ -0,0 +1,29 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package testing
+
+import (
+	"github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/core"
+	"io/ioutil"
+	"os"
+)
+
+// LoadTestConfig loads the given YAML document on top of the default configuration
+func LoadTestConfig(content string) error {
+	f, err := ioutil.TempFile("", "mirrorbits-test-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	core.ConfigFile = f.Name()
+	return config.ReloadConfig()
+}
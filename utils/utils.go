@@ -56,6 +56,14 @@ func Add(x, y int) int {
 	return x + y
 }
 
+// BoolToFloat returns 1 for true and 0 for false, as used by the metrics
+func BoolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func Version() string {
 	return core.VERSION
 }
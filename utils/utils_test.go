@@ -56,6 +56,15 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestBoolToFloat(t *testing.T) {
+	if r := BoolToFloat(true); r != 1 {
+		t.Fatalf("Expected 1, got %f", r)
+	}
+	if r := BoolToFloat(false); r != 0 {
+		t.Fatalf("Expected 0, got %f", r)
+	}
+}
+
 func TestIsInSlice(t *testing.T) {
 	var b bool
 	list := []string{"aaa", "bbb", "ccc"}
@@ -0,0 +1,293 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/config"
+	"github.com/wsnipex/mirrorbits/core"
+	"github.com/wsnipex/mirrorbits/utils"
+	"github.com/op/go-logging"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of events sent to the webhooks
+const (
+	MirrorUp       = "up"
+	MirrorDown     = "down"
+	MirrorDisabled = "disabled"
+	SyncFailed     = "syncfailed"
+)
+
+var (
+	log = logging.MustGetLogger("main")
+
+	minRetryDelay = time.Second
+	maxRetryDelay = 5 * time.Minute
+
+	userAgent = "Mirrorbits/" + core.VERSION + " WEBHOOK"
+)
+
+// Event is the JSON document posted to the webhooks
+type Event struct {
+	Event         string
+	MirrorID      string
+	OldState      string
+	NewState      string
+	ExcludeReason string `json:",omitempty"`
+	StateSince    int64
+	Error         string `json:",omitempty"`
+}
+
+type pendingEvent struct {
+	event Event
+	timer *time.Timer
+}
+
+// Notifier posts the changes affecting the mirrors to the configured
+// webhooks. The events are delayed by WebhookDebounce seconds so that
+// a mirror going down and up again within this delay is not reported.
+type Notifier struct {
+	sync.Mutex
+	pending    map[string]*pendingEvent
+	syncFailed map[string]bool
+	client     http.Client
+	stop       chan bool
+}
+
+// NewNotifier returns a new instance of the webhooks notifier
+func NewNotifier() *Notifier {
+	return &Notifier{
+		pending:    make(map[string]*pendingEvent),
+		syncFailed: make(map[string]bool),
+		client: http.Client{
+			Timeout: 10 * time.Second,
+		},
+		stop: make(chan bool),
+	}
+}
+
+// Stop discards the pending events and aborts the retries
+func (n *Notifier) Stop() {
+	n.Lock()
+	defer n.Unlock()
+	if n.stopped() {
+		return
+	}
+	close(n.stop)
+	for key, p := range n.pending {
+		p.timer.Stop()
+		delete(n.pending, key)
+	}
+}
+
+// stopped returns true once the notifier has been stopped
+func (n *Notifier) stopped() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// StateChanged reports a mirror going up or down since the given time
+func (n *Notifier) StateChanged(id string, up bool, reason string, stateSince int64) {
+	if !enabled() || n.stopped() {
+		return
+	}
+
+	e := Event{
+		Event:         MirrorDown,
+		MirrorID:      id,
+		OldState:      "up",
+		NewState:      "down",
+		ExcludeReason: reason,
+		StateSince:    stateSince,
+	}
+	if up {
+		e.Event = MirrorUp
+		e.OldState, e.NewState = e.NewState, e.OldState
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	key := id + "_state"
+	if p, ok := n.pending[key]; ok {
+		if p.event.OldState == e.NewState {
+			// The mirror went back to its original state
+			// before the event was sent, forget about it.
+			p.timer.Stop()
+			delete(n.pending, key)
+			return
+		}
+		p.event = e
+		return
+	}
+	n.schedule(key, e)
+}
+
+// Disabled reports a mirror automatically disabled by the monitor
+func (n *Notifier) Disabled(id string, reason string, stateSince int64) {
+	if !enabled() {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	key := id + "_disabled"
+	if _, ok := n.pending[key]; ok {
+		return
+	}
+	n.schedule(key, Event{
+		Event:         MirrorDisabled,
+		MirrorID:      id,
+		OldState:      "enabled",
+		NewState:      "disabled",
+		ExcludeReason: reason,
+		StateSince:    stateSince,
+	})
+}
+
+// SyncFailed reports a failed scan of a mirror. Only the first failure
+// is reported until the mirror is successfully scanned again.
+func (n *Notifier) SyncFailed(id string, up bool, stateSince int64, err error) {
+	if !enabled() {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.syncFailed[id] {
+		return
+	}
+	n.syncFailed[id] = true
+
+	state := "down"
+	if up {
+		state = "up"
+	}
+
+	n.schedule(id+"_sync", Event{
+		Event:      SyncFailed,
+		MirrorID:   id,
+		OldState:   state,
+		NewState:   state,
+		StateSince: stateSince,
+		Error:      err.Error(),
+	})
+}
+
+// SyncSucceeded reports a successful scan of a mirror
+func (n *Notifier) SyncSucceeded(id string) {
+	n.Lock()
+	defer n.Unlock()
+
+	delete(n.syncFailed, id)
+	if p, ok := n.pending[id+"_sync"]; ok {
+		p.timer.Stop()
+		delete(n.pending, id+"_sync")
+	}
+}
+
+// schedule sends the event once the debounce delay is over. Nothing
+// is sent once the notifier is stopped. The lock must be held by the caller.
+func (n *Notifier) schedule(key string, e Event) {
+	if n.stopped() {
+		return
+	}
+	p := &pendingEvent{
+		event: e,
+	}
+	p.timer = time.AfterFunc(time.Duration(GetConfig().WebhookDebounce)*time.Second, func() {
+		n.Lock()
+		if n.pending[key] != p {
+			n.Unlock()
+			return
+		}
+		delete(n.pending, key)
+		e := p.event
+		n.Unlock()
+
+		n.dispatch(e)
+	})
+	n.pending[key] = p
+}
+
+// dispatch posts the event to all the webhooks interested in it
+func (n *Notifier) dispatch(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Webhook: %s", err.Error())
+		return
+	}
+
+	for _, w := range GetConfig().Webhooks {
+		if len(w.Events) > 0 && !utils.IsInSlice(e.Event, w.Events) {
+			continue
+		}
+		go n.post(w.URL, body)
+	}
+}
+
+// post sends the document to the given URL, retrying with an
+// exponential backoff in case of failure
+func (n *Notifier) post(url string, body []byte) {
+	delay := minRetryDelay
+	retries := GetConfig().WebhookRetries
+
+	for i := 0; ; i++ {
+		err := n.postOnce(url, body)
+		if err == nil {
+			return
+		}
+		if i >= retries {
+			log.Errorf("Webhook %s: %s, giving up", url, err.Error())
+			return
+		}
+		log.Warningf("Webhook %s: %s, retrying in %s", url, err.Error(), delay)
+
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (n *Notifier) postOnce(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func enabled() bool {
+	return len(GetConfig().Webhooks) > 0
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2014-2015 Ludovic Fauvet
+// Licensed under the MIT license
+
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/wsnipex/mirrorbits/testing"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer returns a server sending the received events on the channel.
+// The first failures requests are answered with an error.
+func webhookServer(t *testing.T, failures int32) (*httptest.Server, chan Event, *int32) {
+	events := make(chan Event, 10)
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != "POST" {
+			t.Errorf("Expected a POST request, got %s", r.Method)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected content type %s", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("User-Agent") != userAgent {
+			t.Errorf("Unexpected user agent %s", r.Header.Get("User-Agent"))
+		}
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("Cannot decode the event: %s", err)
+		}
+		events <- e
+	}))
+	return ts, events, &requests
+}
+
+func loadConfig(t *testing.T, url string, debounce, retries int, events string) {
+	err := LoadTestConfig(fmt.Sprintf("Webhooks:\n  - URL: %s\n    Events: [%s]\nWebhookDebounce: %d\nWebhookRetries: %d\n",
+		url, events, debounce, retries))
+	if err != nil {
+		t.Fatalf("Cannot load the configuration: %s", err)
+	}
+}
+
+func expectEvent(t *testing.T, events chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event received")
+	}
+	return Event{}
+}
+
+func expectNoEvent(t *testing.T, events chan Event, d time.Duration) {
+	select {
+	case e := <-events:
+		t.Fatalf("Unexpected event %+v", e)
+	case <-time.After(d):
+	}
+}
+
+func TestNotifier_StateChanged(t *testing.T) {
+	ts, events, _ := webhookServer(t, 0)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 0, 0, "")
+
+	n := NewNotifier()
+	defer n.Stop()
+
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	e := expectEvent(t, events)
+	if e.Event != MirrorDown || e.MirrorID != "m1" || e.OldState != "up" || e.NewState != "down" ||
+		e.ExcludeReason != "Unreachable" || e.StateSince != 1420070400 {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+
+	n.StateChanged("m1", true, "", 1420070500)
+	e = expectEvent(t, events)
+	if e.Event != MirrorUp || e.OldState != "down" || e.NewState != "up" || e.StateSince != 1420070500 {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+}
+
+func TestNotifier_Debounce(t *testing.T) {
+	ts, events, _ := webhookServer(t, 0)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 1, 0, "")
+
+	n := NewNotifier()
+	defer n.Stop()
+
+	// The mirror goes back up before the end of the delay
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	n.StateChanged("m1", true, "", 1420070410)
+	expectNoEvent(t, events, 1500*time.Millisecond)
+
+	// A mirror already pending is only reported once
+	n.Disabled("m1", "File not found", 1420070400)
+	n.Disabled("m1", "Unreachable", 1420070400)
+	start := time.Now()
+	e := expectEvent(t, events)
+	if time.Since(start) < 500*time.Millisecond {
+		t.Fatalf("The event wasn't delayed")
+	}
+	if e.Event != MirrorDisabled || e.NewState != "disabled" || e.ExcludeReason != "File not found" {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+	expectNoEvent(t, events, 100*time.Millisecond)
+}
+
+func TestNotifier_SyncFailed(t *testing.T) {
+	ts, events, _ := webhookServer(t, 0)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 0, 0, "syncfailed")
+
+	n := NewNotifier()
+	defer n.Stop()
+
+	// Filtered out by the webhook
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	expectNoEvent(t, events, 100*time.Millisecond)
+
+	n.SyncFailed("m1", true, 1420070400, errors.New("rsync: timeout"))
+	e := expectEvent(t, events)
+	if e.Event != SyncFailed || e.OldState != "up" || e.NewState != "up" ||
+		e.Error != "rsync: timeout" || e.StateSince != 1420070400 {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+
+	// Only the first failure is reported
+	n.SyncFailed("m1", true, 1420070400, errors.New("rsync: timeout"))
+	expectNoEvent(t, events, 100*time.Millisecond)
+
+	n.SyncSucceeded("m1")
+	n.SyncFailed("m1", false, 1420070400, errors.New("rsync: timeout"))
+	e = expectEvent(t, events)
+	if e.NewState != "down" {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+}
+
+func TestNotifier_Retry(t *testing.T) {
+	delay := minRetryDelay
+	minRetryDelay = 10 * time.Millisecond
+	defer func() { minRetryDelay = delay }()
+
+	ts, events, requests := webhookServer(t, 2)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 0, 2, "")
+
+	n := NewNotifier()
+	defer n.Stop()
+
+	start := time.Now()
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	expectEvent(t, events)
+
+	if r := atomic.LoadInt32(requests); r != 3 {
+		t.Fatalf("Expected 3 requests, got %d", r)
+	}
+	// 10ms then 20ms
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatalf("The retry delay isn't doubled")
+	}
+}
+
+func TestNotifier_RetryGiveUp(t *testing.T) {
+	delay := minRetryDelay
+	minRetryDelay = 10 * time.Millisecond
+	defer func() { minRetryDelay = delay }()
+
+	ts, events, requests := webhookServer(t, 10)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 0, 2, "")
+
+	n := NewNotifier()
+	defer n.Stop()
+
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	expectNoEvent(t, events, 300*time.Millisecond)
+
+	if r := atomic.LoadInt32(requests); r != 3 {
+		t.Fatalf("Expected 3 requests, got %d", r)
+	}
+}
+
+func TestNotifier_Stop(t *testing.T) {
+	ts, events, _ := webhookServer(t, 0)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 1, 0, "")
+
+	n := NewNotifier()
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	n.Stop()
+	n.Stop()
+
+	expectNoEvent(t, events, 1500*time.Millisecond)
+}
+
+func TestNotifier_StoppedEvents(t *testing.T) {
+	ts, events, _ := webhookServer(t, 0)
+	defer ts.Close()
+	loadConfig(t, ts.URL, 0, 0, "")
+
+	n := NewNotifier()
+	n.Stop()
+
+	n.StateChanged("m1", false, "Unreachable", 1420070400)
+	n.Disabled("m1", "Unreachable", 1420070400)
+	n.SyncFailed("m1", true, 1420070400, errors.New("timeout"))
+
+	n.Lock()
+	pending := len(n.pending)
+	n.Unlock()
+	if pending != 0 {
+		t.Fatalf("No event should be scheduled once stopped, got %d", pending)
+	}
+	expectNoEvent(t, events, 500*time.Millisecond)
+}